@@ -0,0 +1,188 @@
+// cmd/api/audit.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+const auditContextKey contextKey = "audit"
+
+// auditRecord collects what a request did as it passes through the auth
+// wrappers and the handler. The audit middleware writes it out afterwards.
+type auditRecord struct {
+	actor   string
+	nodeIDs []string
+	detail  string
+	routine bool
+}
+
+func auditFromContext(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditContextKey).(*auditRecord)
+	return rec
+}
+
+// auditActor records who made the request
+func auditActor(r *http.Request, actor string) {
+	if rec := auditFromContext(r.Context()); rec != nil {
+		rec.actor = actor
+	}
+}
+
+// auditNodes records the nodes a request read or changed
+func auditNodes(r *http.Request, nodeIDs ...string) {
+	if rec := auditFromContext(r.Context()); rec != nil {
+		rec.nodeIDs = append(rec.nodeIDs, nodeIDs...)
+	}
+}
+
+// auditDetail attaches a short description of what the request changed
+func auditDetail(r *http.Request, detail string) {
+	if rec := auditFromContext(r.Context()); rec != nil {
+		rec.detail = detail
+	}
+}
+
+// auditRoutine marks a request as routine, so it is only recorded if it
+// fails. Used for heartbeats that change nothing, which would otherwise fill
+// the append-only table at one row per node per interval.
+func auditRoutine(r *http.Request) {
+	if rec := auditFromContext(r.Context()); rec != nil {
+		rec.routine = true
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// audit wraps a handler so every request to route is recorded in the audit
+// log once the handler returns, apart from successful routine ones. It is
+// the outermost wrapper, so requests turned away by rate limiting are
+// recorded too.
+func (api *APIServer) audit(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &auditRecord{actor: "anonymous"}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey, rec)))
+		if rec.routine && recorder.status < 400 {
+			return
+		}
+
+		event := &storage.AuditEvent{
+			Actor:    rec.actor,
+			Method:   r.Method,
+			Route:    route,
+			NodeIDs:  rec.nodeIDs,
+			Status:   recorder.status,
+			Result:   storage.AuditResult(recorder.status),
+			Detail:   rec.detail,
+			RemoteIP: api.clientIP(r),
+		}
+		if err := api.storage.RecordAuditEvent(event); err != nil {
+			log.Printf("[-] Failed to record audit event for %s %s: %v", r.Method, route, err)
+		}
+	}
+}
+
+// pruneAuditLog deletes audit events older than retention. It runs once at
+// startup, before any route is served, so API requests can never remove
+// events. A zero retention keeps the log forever.
+func (api *APIServer) pruneAuditLog(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	n, err := api.storage.PruneAuditEvents(retention)
+	if err != nil {
+		log.Printf("[-] Audit log pruning error: %v", err)
+	} else if n > 0 {
+		log.Printf("[*] Pruned %d audit events older than %s", n, retention)
+	}
+}
+
+// handleAuditLog lists audit events, newest first. Filters: actor, route,
+// node, result, since and until (RFC 3339). Pages are walked by passing the
+// returned next_before as before.
+func (api *APIServer) handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	filter := storage.AuditFilter{
+		Actor:  q.Get("actor"),
+		Route:  q.Get("route"),
+		NodeID: q.Get("node"),
+		Result: q.Get("result"),
+		Limit:  100,
+	}
+
+	switch filter.Result {
+	case "", storage.AuditSuccess, storage.AuditDenied, storage.AuditError:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "result must be success, denied or error")
+		return
+	}
+
+	for name, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if raw := q.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, name+" must be an RFC 3339 timestamp")
+				return
+			}
+			*dest = parsed
+		}
+	}
+
+	if raw := q.Get("before"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || parsed <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "before must be a positive event ID")
+			return
+		}
+		filter.Before = parsed
+	}
+
+	if raw := q.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	events, err := api.storage.ListAuditEvents(filter)
+	if err != nil {
+		log.Printf("[-] Failed to list audit events: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"events": events,
+		"count":  len(events),
+	}
+	if len(events) == filter.Limit {
+		resp["next_before"] = events[len(events)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
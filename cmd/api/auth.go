@@ -0,0 +1,206 @@
+// cmd/api/auth.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+type contextKey string
+
+const apiKeyContextKey contextKey = "api-key"
+
+// writeJSONError sends an error response as {"error": "..."}
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// extractAPIKey reads the key from "Authorization: Bearer <key>" or "X-API-Key"
+func extractAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// apiKeyFromContext returns the authenticated key for the request, if any
+func apiKeyFromContext(ctx context.Context) *storage.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey).(*storage.APIKey)
+	return key
+}
+
+// requireScope wraps a handler so it only runs for requests carrying a
+// valid API key that grants the given scope
+func (api *APIServer) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := extractAPIKey(r)
+		if raw == "" {
+			api.rejectCredentials(w, r, http.StatusUnauthorized, "API key required")
+			return
+		}
+
+		key, err := api.storage.AuthenticateAPIKey(raw)
+		if err == storage.ErrInvalidAPIKey {
+			api.rejectCredentials(w, r, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		if err != nil {
+			log.Printf("[-] Failed to authenticate API key: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		auditActor(r, "key:"+key.ID)
+		if !allowRequest(w, r, "key:"+key.ID) {
+			return
+		}
+		if !key.HasScope(scope) {
+			writeJSONError(w, http.StatusForbidden, "API key lacks scope "+scope)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key)))
+	}
+}
+
+// ensureAdminKey creates an initial admin key when none exists so a fresh
+// controller is not left without a way to manage keys
+func (api *APIServer) ensureAdminKey() error {
+	exists, err := api.storage.HasActiveAdminKey()
+	if err != nil || exists {
+		return err
+	}
+
+	key, raw, err := api.storage.CreateAPIKey("bootstrap-admin", []string{storage.ScopeAdmin})
+	if err != nil {
+		return err
+	}
+
+	log.Println("[!] No admin API key found, generated a bootstrap key:")
+	log.Printf("    ID:  %s", key.ID)
+	log.Printf("    Key: %s", raw)
+	log.Println("[!] Store this key now, it will not be shown again")
+	return nil
+}
+
+// heartbeatScopeKey reports whether the request carries a valid key with the
+// removed agent-heartbeat scope, as agents from before enrollment send
+func (api *APIServer) heartbeatScopeKey(r *http.Request) bool {
+	raw := extractAPIKey(r)
+	if raw == "" {
+		return false
+	}
+	key, err := api.storage.AuthenticateAPIKey(raw)
+	return err == nil && slices.Contains(key.Scopes, storage.ScopeAgentHeartbeat)
+}
+
+// warnHeartbeatScopeKeys logs the unrevoked keys still holding the removed
+// agent-heartbeat scope, which no longer authenticate heartbeats
+func (api *APIServer) warnHeartbeatScopeKeys() {
+	keys, err := api.storage.ListAPIKeys()
+	if err != nil {
+		log.Printf("[-] Failed to list API keys: %v", err)
+		return
+	}
+	for _, key := range keys {
+		if key.RevokedAt == nil && slices.Contains(key.Scopes, storage.ScopeAgentHeartbeat) {
+			log.Printf("[!] API key %s (%s) has the removed agent-heartbeat scope; enroll its agents with a join token and revoke it",
+				key.ID, key.Name)
+		}
+	}
+}
+
+type createKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+func (api *APIServer) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		keys, err := api.storage.ListAPIKeys()
+		if err != nil {
+			log.Printf("[-] Failed to list API keys: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys":  keys,
+			"count": len(keys),
+		})
+
+	case "POST":
+		var req createKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		if req.Name == "" {
+			writeJSONError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+
+		key, raw, err := api.storage.CreateAPIKey(req.Name, req.Scopes)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		log.Printf("[+] Created API key %s (%s) with scopes %v", key.ID, key.Name, key.Scopes)
+		auditDetail(r, "created API key "+key.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"key":     key,
+			"api_key": raw,
+		})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (api *APIServer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSONError(w, http.StatusBadRequest, "id parameter required")
+		return
+	}
+
+	if caller := apiKeyFromContext(r.Context()); caller != nil && caller.ID == id {
+		writeJSONError(w, http.StatusBadRequest, "cannot revoke the key used for this request")
+		return
+	}
+
+	err := api.storage.RevokeAPIKey(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "API key not found or already revoked")
+		return
+	}
+	if err != nil {
+		log.Printf("[-] Failed to revoke API key: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	log.Printf("[+] Revoked API key %s", id)
+	auditDetail(r, "revoked API key "+id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked", "id": id})
+}
@@ -0,0 +1,95 @@
+// cmd/api/backfill.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// maxBackfillBatch is the most spooled heartbeats accepted in one request
+const maxBackfillBatch = 500
+
+// spooledHeartbeat is a heartbeat snapshot the agent could not deliver.
+// Seq is the sequence number reserved for the original attempt.
+type spooledHeartbeat struct {
+	Seq       int64                `json:"seq"`
+	Timestamp int64                `json:"timestamp"`
+	Metrics   *storage.NodeMetrics `json:"metrics,omitempty"`
+	SelfCheck *selfCheckResult     `json:"self_check,omitempty"`
+}
+
+// heartbeatBatch is the body of POST /api/heartbeat/batch. Seq and Timestamp
+// belong to the batch itself and are checked like a heartbeat's.
+type heartbeatBatch struct {
+	Heartbeats []spooledHeartbeat `json:"heartbeats"`
+	Seq        int64              `json:"seq"`
+	Timestamp  int64              `json:"timestamp"`
+}
+
+// handleHeartbeatBatch backfills history from heartbeats an agent spooled
+// while the controller was unreachable. Only the metrics time series is
+// written: the node's online state, address and credentials come from live
+// heartbeats alone, so replaying an outage does not flap the node.
+func (api *APIServer) handleHeartbeatBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var batch heartbeatBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if len(batch.Heartbeats) > maxBackfillBatch {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("at most %d heartbeats per batch", maxBackfillBatch))
+		return
+	}
+
+	nodeID := nodeIDFromContext(r.Context())
+	if !api.checkHeartbeatFreshness(w, r, nodeID, batch.Seq, batch.Timestamp) {
+		return
+	}
+
+	// Spooled heartbeats were given earlier sequence numbers than the
+	// batch carrying them, and cannot have been sent from the future
+	latest := time.Now().Add(maxHeartbeatSkew)
+	var samples []storage.BackfillSample
+	for _, hb := range batch.Heartbeats {
+		sentAt := time.Unix(hb.Timestamp, 0)
+		if hb.Metrics == nil || hb.Seq <= 0 || hb.Seq >= batch.Seq || sentAt.After(latest) {
+			continue
+		}
+		hb.Metrics.RecordedAt = sentAt
+		if hb.SelfCheck != nil {
+			hb.Metrics.SelfCheck = hb.SelfCheck.Status
+		}
+		samples = append(samples, storage.BackfillSample{Seq: hb.Seq, Metrics: hb.Metrics})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Seq < samples[j].Seq })
+
+	auditNodes(r, nodeID)
+	stored, err := api.storage.BackfillMetrics(nodeID, samples)
+	if err != nil {
+		log.Printf("[-] Failed to backfill metrics for %s: %v", nodeID, err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	skipped := len(batch.Heartbeats) - stored
+	auditDetail(r, fmt.Sprintf("backfilled %d heartbeats, skipped %d", stored, skipped))
+	log.Printf("[*] Backfilled %d spooled heartbeats from %s (%d skipped)", stored, nodeID, skipped)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "ok",
+		"accepted": stored,
+		"skipped":  skipped,
+	})
+}
@@ -0,0 +1,327 @@
+// cmd/api/commands.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+const (
+	minCommandInterval = 10 * time.Second
+	maxCommandInterval = 24 * time.Hour
+)
+
+// nodeCommand is a command as sent to an agent in a heartbeat response
+type nodeCommand struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// commandAck is an agent's report of a command it ran, sent with the next
+// heartbeat. Status is "succeeded" or "failed".
+type commandAck struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// queueCommandRequest is the body of POST /api/admin/commands
+type queueCommandRequest struct {
+	Type string          `json:"type"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// pendingCommands returns the node's unacknowledged commands for the
+// heartbeat response
+func (api *APIServer) pendingCommands(nodeID string) []nodeCommand {
+	due, err := api.storage.DueCommands(nodeID)
+	if err != nil {
+		log.Printf("[-] Failed to load commands for %s: %v", nodeID, err)
+		return nil
+	}
+
+	commands := make([]nodeCommand, len(due))
+	for i, cmd := range due {
+		commands[i] = nodeCommand{ID: cmd.ID, Type: cmd.Type, Args: cmd.Args}
+	}
+	if len(commands) > 0 {
+		log.Printf("[*] Sending %d commands to %s", len(commands), nodeID)
+	}
+	return commands
+}
+
+// recordCommandAcks stores the outcomes reported in a heartbeat
+func (api *APIServer) recordCommandAcks(nodeID string, acks []commandAck) {
+	for _, ack := range acks {
+		succeeded := ack.Status == storage.CommandSucceeded
+		if !succeeded && ack.Status != storage.CommandFailed {
+			log.Printf("[-] Node %s sent unknown status %q for command %s", nodeID, ack.Status, ack.ID)
+			continue
+		}
+
+		err := api.storage.AckCommand(ack.ID, nodeID, succeeded, ack.Result, ack.Error)
+		if err == storage.ErrCommandNotFound {
+			log.Printf("[-] Node %s acknowledged unknown command %s", nodeID, ack.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("[-] Failed to record command %s: %v", ack.ID, err)
+			continue
+		}
+
+		if succeeded {
+			log.Printf("[+] Node %s completed command %s", nodeID, ack.ID)
+		} else {
+			log.Printf("[-] Node %s failed command %s: %s", nodeID, ack.ID, ack.Error)
+		}
+	}
+}
+
+// validateCommand checks a command's type and arguments, returning the
+// arguments in the form sent to agents
+func (api *APIServer) validateCommand(req *queueCommandRequest) (json.RawMessage, error) {
+	switch req.Type {
+	case storage.CommandRestartProxy, storage.CommandReloadPolicy, storage.CommandRunDiagnostics:
+		return nil, nil
+
+	case storage.CommandRotateCredentials:
+		// Arguments are filled in per node when the rotation is scheduled
+		var args struct {
+			Overlap string `json:"overlap"`
+		}
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		if args.Overlap != "" {
+			overlap, err := time.ParseDuration(args.Overlap)
+			if err != nil || overlap < 0 || overlap > maxRotationOverlap {
+				return nil, fmt.Errorf("overlap must be a duration between 0s and 24h")
+			}
+		}
+		return req.Args, nil
+
+	case storage.CommandDrain:
+		args := struct {
+			Enabled *bool `json:"enabled"`
+		}{}
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		enabled := args.Enabled == nil || *args.Enabled
+		return json.Marshal(map[string]bool{"enabled": enabled})
+
+	case storage.CommandSetInterval:
+		var args struct {
+			Interval string `json:"interval"`
+		}
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		interval, err := time.ParseDuration(args.Interval)
+		if err != nil || interval < minCommandInterval || interval > maxCommandInterval {
+			return nil, fmt.Errorf("interval must be a duration between %s and %s", minCommandInterval, maxCommandInterval)
+		}
+		return json.Marshal(map[string]string{"interval": interval.String()})
+
+	case storage.CommandUpdateAgent:
+		var args struct {
+			Version string `json:"version"`
+		}
+		if err := decodeArgs(req.Args, &args); err != nil {
+			return nil, err
+		}
+		return api.updateArgs(args.Version)
+
+	default:
+		return nil, fmt.Errorf("unknown command type %q", req.Type)
+	}
+}
+
+func decodeArgs(raw json.RawMessage, dest interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return fmt.Errorf("invalid args: %v", err)
+	}
+	return nil
+}
+
+// queueCommand queues a validated command for one node. Credential rotation
+// goes through the rotation schedule so the controller knows which
+// credentials to expect; the command carries the rotation to start.
+func (api *APIServer) queueCommand(nodeID string, req *queueCommandRequest, args json.RawMessage, requestedBy string) (*storage.NodeCommand, error) {
+	if req.Type == storage.CommandRotateCredentials {
+		overlap := defaultRotationOverlap
+		var opts struct {
+			Overlap string `json:"overlap"`
+		}
+		if decodeArgs(args, &opts) == nil && opts.Overlap != "" {
+			overlap, _ = time.ParseDuration(opts.Overlap)
+		}
+
+		rot, err := api.storage.ScheduleRotation(nodeID, requestedBy, overlap, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		args, err = json.Marshal(rotationInstruction{ID: rot.ID, OverlapSeconds: rot.OverlapSeconds})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return api.storage.QueueCommand(nodeID, req.Type, args, requestedBy)
+}
+
+// startCommandPruner deletes commands older than the retention period
+func (api *APIServer) startCommandPruner(retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	go func() {
+		for range ticker.C {
+			n, err := api.storage.PruneCommands(retention)
+			if err != nil {
+				log.Printf("[-] Command pruning error: %v", err)
+			} else if n > 0 {
+				log.Printf("[*] Pruned %d commands older than %s", n, retention)
+			}
+		}
+	}()
+}
+
+// handleCommands lists commands (GET, filter by node, type and status) or
+// queues one (POST) for a single node (?node=ID), the online nodes in a
+// country (?country=US) or every online node (?all=true)
+func (api *APIServer) handleCommands(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	switch r.Method {
+	case "GET":
+		filter := storage.CommandFilter{NodeID: q.Get("node"), Type: q.Get("type"), Status: q.Get("status"), Limit: 100}
+		switch filter.Status {
+		case "", storage.CommandPending, storage.CommandSent, storage.CommandSucceeded, storage.CommandFailed:
+		default:
+			writeJSONError(w, http.StatusBadRequest, "status must be pending, sent, succeeded or failed")
+			return
+		}
+		if raw := q.Get("limit"); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed <= 0 || parsed > 1000 {
+				writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+				return
+			}
+			filter.Limit = parsed
+		}
+
+		commands, err := api.storage.ListCommands(filter)
+		if err != nil {
+			log.Printf("[-] Failed to list commands: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"commands": commands,
+			"count":    len(commands),
+		})
+
+	case "POST":
+		var req queueCommandRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+		args, err := api.validateCommand(&req)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		nodeID, country := q.Get("node"), q.Get("country")
+		all, _ := strconv.ParseBool(q.Get("all"))
+		targets := 0
+		for _, set := range []bool{nodeID != "", country != "", all} {
+			if set {
+				targets++
+			}
+		}
+		if targets != 1 {
+			writeJSONError(w, http.StatusBadRequest, "pass exactly one of node=ID, country=CODE or all=true")
+			return
+		}
+
+		var targetIDs []string
+		switch {
+		case nodeID != "":
+			node, err := api.storage.GetNode(nodeID)
+			if err != nil {
+				writeJSONError(w, http.StatusNotFound, "node not found")
+				return
+			}
+			targetIDs = []string{hostOf(node)}
+		default:
+			var nodes []storage.ProxyNode
+			if all {
+				nodes, err = api.storage.GetOnlineNodes()
+			} else {
+				nodes, err = api.storage.GetNodesByCountry(country)
+			}
+			if err != nil {
+				log.Printf("[-] Failed to select nodes for command: %v", err)
+				writeJSONError(w, http.StatusInternalServerError, "storage error")
+				return
+			}
+			targetIDs = hostIDs(nodes)
+		}
+
+		requestedBy := ""
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			requestedBy = key.ID
+		}
+
+		var commands []storage.NodeCommand
+		skipped := 0
+		for _, id := range targetIDs {
+			cmd, err := api.queueCommand(id, &req, args, requestedBy)
+			if err == storage.ErrRotationInProgress {
+				skipped++
+				continue
+			}
+			if err != nil {
+				log.Printf("[-] Failed to queue %s for %s: %v", req.Type, id, err)
+				writeJSONError(w, http.StatusInternalServerError, "storage error")
+				return
+			}
+			commands = append(commands, *cmd)
+		}
+
+		log.Printf("[+] Queued %s for %d nodes", req.Type, len(commands))
+		auditNodes(r, commandNodeIDs(commands)...)
+		auditDetail(r, "queued command "+req.Type)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"commands": commands,
+			"count":    len(commands),
+			"skipped":  skipped,
+		})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func commandNodeIDs(commands []storage.NodeCommand) []string {
+	ids := make([]string, len(commands))
+	for i, cmd := range commands {
+		ids[i] = cmd.NodeID
+	}
+	return ids
+}
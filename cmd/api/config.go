@@ -0,0 +1,135 @@
+// cmd/api/config.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// controllerConfig holds the controller's runtime settings. Each value can be
+// set by flag or by the matching TRINITY_* environment variable, which is
+// how the systemd unit and main.go pass settings through.
+type controllerConfig struct {
+	Listen        string
+	DBPath        string
+	MasterKeyFile string
+	TLS           bool
+	TLSDir        string
+	TLSHosts      []string
+
+	// Connections from these addresses may set X-Forwarded-For
+	TrustedProxies []string
+	// MaxMind-format database used to check the location agents report
+	GeoDatabase string
+	// How long heartbeat metrics samples are kept
+	MetricsRetention time.Duration
+	// How long remote commands are kept
+	CommandRetention time.Duration
+	// How long audit events are kept, pruned at startup; zero keeps them
+	AuditRetention time.Duration
+	// Base64 Ed25519 key that uploaded agent releases must be signed with
+	ReleasePublicKey string
+	// Directory agent release binaries are kept in
+	ReleaseDir string
+	// Token bucket per route, keyed by route pattern or "*"
+	RateLimits map[string]rateLimit
+}
+
+func envOr(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if val, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return val
+	}
+	return fallback
+}
+
+func envBool(key string, fallback bool) bool {
+	if val, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return val
+	}
+	return fallback
+}
+
+// splitList parses a comma-separated list, dropping empty entries
+func splitList(val string) []string {
+	var out []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func loadConfig() *controllerConfig {
+	cfg := &controllerConfig{}
+	hostname, _ := os.Hostname()
+
+	var tlsHosts, trustedProxies, rateLimits string
+	flag.StringVar(&cfg.Listen, "listen", envOr("TRINITY_LISTEN", ":3100"), "address to listen on")
+	flag.StringVar(&cfg.DBPath, "db", envOr("TRINITY_DB", "./trinityproxy.db"), "path to the SQLite database")
+	flag.StringVar(&cfg.MasterKeyFile, "master-key-file", envOr("TRINITY_MASTER_KEY_FILE", "./trinityproxy.key"), "file holding the credential encryption key, created if missing")
+	flag.BoolVar(&cfg.TLS, "tls", envBool("TRINITY_TLS", false), "serve TLS with the embedded CA and accept agent client certificates")
+	flag.StringVar(&cfg.TLSDir, "tls-dir", envOr("TRINITY_TLS_DIR", "./tls"), "directory holding the CA and server certificate")
+	flag.StringVar(&tlsHosts, "tls-hosts", envOr("TRINITY_TLS_HOSTS", "localhost,127.0.0.1,"+hostname), "comma-separated hostnames and IPs for the server certificate")
+	flag.StringVar(&trustedProxies, "trusted-proxies", envOr("TRINITY_TRUSTED_PROXIES", defaultTrustedProxies), "comma-separated IPs and CIDRs of reverse proxies whose X-Forwarded-For is honored")
+	flag.StringVar(&cfg.GeoDatabase, "geo-db", envOr("TRINITY_GEO_DATABASE", ""), "MaxMind-format .mmdb file used to verify node locations")
+	flag.StringVar(&cfg.ReleasePublicKey, "release-public-key", envOr("TRINITY_RELEASE_PUBLIC_KEY", ""), "base64 Ed25519 public key agent releases must be signed with")
+	flag.StringVar(&cfg.ReleaseDir, "release-dir", envOr("TRINITY_RELEASE_DIR", "./releases"), "directory agent release binaries are kept in")
+	flag.DurationVar(&cfg.MetricsRetention, "metrics-retention", envDuration("TRINITY_METRICS_RETENTION", 7*24*time.Hour), "how long node metrics samples are kept")
+	flag.DurationVar(&cfg.CommandRetention, "command-retention", envDuration("TRINITY_COMMAND_RETENTION", 30*24*time.Hour), "how long remote commands are kept")
+	flag.DurationVar(&cfg.AuditRetention, "audit-retention", envDuration("TRINITY_AUDIT_RETENTION", 90*24*time.Hour), "how long audit events are kept, pruned at startup; 0 keeps them forever")
+	flag.StringVar(&rateLimits, "rate-limits", envOr("TRINITY_RATE_LIMITS", ""), "comma-separated route=rate/burst overrides of the default rate limits, rate per second")
+	flag.Parse()
+
+	cfg.TLSHosts = splitList(tlsHosts)
+	cfg.TrustedProxies = splitList(trustedProxies)
+
+	var err error
+	if cfg.RateLimits, err = parseRateLimits(rateLimits); err != nil {
+		log.Fatalf("[-] Invalid -rate-limits: %v", err)
+	}
+	return cfg
+}
+
+// loadMasterKey returns the credential encryption key from TRINITY_MASTER_KEY
+// if set, otherwise from the master key file, generating it on first start.
+// A new key is never generated for a database that already holds encrypted
+// credentials: they could not be read under it.
+func loadMasterKey(cfg *controllerConfig) ([]byte, error) {
+	if encoded := os.Getenv("TRINITY_MASTER_KEY"); encoded != "" {
+		return storage.ParseMasterKey(encoded)
+	}
+
+	if _, err := os.Stat(cfg.MasterKeyFile); os.IsNotExist(err) {
+		encrypted, err := storage.HasEncryptedCredentials(cfg.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		if encrypted {
+			return nil, fmt.Errorf("%s is missing but %s holds encrypted credentials; restore the key file or set TRINITY_MASTER_KEY", cfg.MasterKeyFile, cfg.DBPath)
+		}
+	}
+
+	key, created, err := storage.LoadOrCreateMasterKey(cfg.MasterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		log.Printf("[!] Generated new master key at %s, back it up: without it stored credentials cannot be read", cfg.MasterKeyFile)
+	}
+	return key, nil
+}
@@ -0,0 +1,52 @@
+// cmd/api/deregister.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type deregisterRequest struct {
+	Reason    string `json:"reason"`
+	Seq       int64  `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// handleDeregister is called by an agent that is shutting down. The node is
+// marked offline at once, so it is no longer listed or handed out, instead
+// of lingering until its heartbeats time out.
+func (api *APIServer) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req deregisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	// Sharing the heartbeat sequence keeps a captured request from being
+	// replayed to take the node offline
+	nodeID := nodeIDFromContext(r.Context())
+	if !api.checkHeartbeatFreshness(w, r, nodeID, req.Seq, req.Timestamp) {
+		return
+	}
+
+	auditNodes(r, nodeID)
+	if err := api.storage.DeregisterNode(nodeID); err != nil {
+		log.Printf("[-] Failed to deregister node %s: %v", nodeID, err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	if req.Reason != "" {
+		auditDetail(r, "deregistered: "+req.Reason)
+	}
+	log.Printf("[*] Node %s deregistered (%s)", nodeID, req.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deregistered", "node_id": nodeID})
+}
@@ -2,18 +2,29 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Skillz147/TrinityProxy/internal/mmdb"
+	"github.com/Skillz147/TrinityProxy/internal/pki"
+	"github.com/Skillz147/TrinityProxy/internal/policy"
 	"github.com/Skillz147/TrinityProxy/internal/storage"
 )
 
 type NodeMetadata struct {
 	IP       string `json:"ip"`
+	IPv6     string `json:"ipv6,omitempty"`
 	Port     int    `json:"port"`
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -21,23 +32,71 @@ type NodeMetadata struct {
 	Region   string `json:"region"`
 	City     string `json:"city"`
 	Zip      string `json:"zip"`
+
+	PolicyVersion string `json:"policy_version,omitempty"`
+
+	Metrics   *storage.NodeMetrics `json:"metrics,omitempty"`
+	SelfCheck *selfCheckResult     `json:"self_check,omitempty"`
+	Draining  bool                 `json:"draining,omitempty"`
+	Version   string               `json:"version,omitempty"`
+
+	// Additional public addresses served by the same SOCKS service
+	Exits []exitReport `json:"exits,omitempty"`
+
+	// Outcomes of commands from earlier heartbeat responses
+	CommandAcks []commandAck `json:"command_acks,omitempty"`
+
+	// Replay protection: a per-node counter and the send time in Unix seconds
+	Seq       int64 `json:"seq"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+// heartbeatResponse is returned to agents. Fields other than Status are
+// instructions the agent should act on.
+type heartbeatResponse struct {
+	Status   string               `json:"status"`
+	Policy   *policy.Policy       `json:"policy,omitempty"`
+	Rotation *rotationInstruction `json:"rotation,omitempty"`
+	Commands []nodeCommand        `json:"commands,omitempty"`
 }
 
 type APIServer struct {
 	storage *storage.NodeStorage
+	ca      *pki.Authority // nil unless the controller serves TLS itself
+	geo     *mmdb.Reader   // nil unless a geo database is configured
+
+	// Agent releases must be signed with this key; nil disables uploads
+	releaseKey ed25519.PublicKey
+	releaseDir string
+	releasesMu sync.Mutex
+
+	trustedProxies []*net.IPNet
+
+	// Per-route token bucket limits, keyed by route pattern ("*" is the default)
+	rateLimits map[string]rateLimit
+	limitersMu sync.Mutex
+	limiters   map[string]*rateLimiter
 }
 
-func NewAPIServer(dbPath string) (*APIServer, error) {
-	nodeStorage, err := storage.NewNodeStorage(dbPath)
+func NewAPIServer(dbPath string, masterKey []byte) (*APIServer, error) {
+	nodeStorage, err := storage.NewNodeStorage(dbPath, masterKey)
 	if err != nil {
 		return nil, err
 	}
 
 	return &APIServer{
-		storage: nodeStorage,
+		storage:    nodeStorage,
+		rateLimits: defaultRateLimits(),
+		limiters:   make(map[string]*rateLimiter),
 	}, nil
 }
 
+// route registers an API handler behind the route's rate limiter and the
+// audit log
+func (api *APIServer) route(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, api.audit(pattern, api.rateLimit(pattern, handler)))
+}
+
 func (api *APIServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -50,27 +109,107 @@ func (api *APIServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Convert to storage format
+	nodeID := nodeIDFromContext(r.Context())
+	if !api.checkHeartbeatFreshness(w, r, nodeID, meta.Seq, meta.Timestamp) {
+		return
+	}
+
+	// Convert to storage format, keyed by the verified node identity
 	node := &storage.ProxyNode{
+		ID:       nodeID,
 		IP:       meta.IP,
+		IPv6:     meta.IPv6,
 		Port:     meta.Port,
 		Username: meta.Username,
 		Password: meta.Password,
 		Country:  meta.Country,
 		Region:   meta.Region,
 		City:     meta.City,
+		Draining: meta.Draining,
+		HostID:   nodeID,
+
+		AgentVersion: meta.Version,
+	}
+
+	normalizeAddrs(node)
+	api.verifyNode(node, api.clientIP(r))
+	applySelfCheck(node, meta.SelfCheck)
+	var previousMismatch, previousSelfCheck, previousVersion string
+	var previousDraining bool
+	if prev, err := api.storage.GetNode(nodeID); err == nil {
+		previousMismatch = prev.Mismatch
+		previousSelfCheck = prev.SelfCheck
+		previousDraining = prev.Draining
+		previousVersion = prev.AgentVersion
 	}
 
 	// Store/update node
-	if err := api.storage.UpsertNode(node); err != nil {
+	auditNodes(r, node.ID)
+	changed, err := api.storage.UpsertNode(node)
+	if err != nil {
 		log.Printf("[-] Failed to store node: %v", err)
 		http.Error(w, "storage error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("[+] Received heartbeat: %s:%d (%s, %s)", meta.IP, meta.Port, meta.City, meta.Country)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "ok")
+	api.upsertExits(r, node, meta.Exits)
+	api.recordMetrics(nodeID, &meta)
+	api.recordCommandAcks(nodeID, meta.CommandAcks)
+
+	var details []string
+	if changed {
+		details = append(details, "credentials changed")
+	}
+	if node.Mismatch != "" {
+		details = append(details, "mismatch: "+node.Mismatch)
+	}
+	if node.SelfCheck != "" && node.SelfCheck != selfCheckOK {
+		details = append(details, "self-check: "+node.SelfCheck)
+	}
+	if len(details) > 0 {
+		auditDetail(r, strings.Join(details, "; "))
+	} else {
+		auditRoutine(r)
+	}
+
+	if node.Mismatch != previousMismatch {
+		if node.Mismatch != "" {
+			log.Printf("[!] Node %s reports %s (%s) but connects from %s (%s): mismatched %s",
+				node.ID, meta.IP, meta.Country, node.ObservedIP, node.VerifiedCountry, node.Mismatch)
+		} else {
+			log.Printf("[+] Node %s reported IP and location verified again", node.ID)
+		}
+	}
+
+	if node.SelfCheck != previousSelfCheck && node.SelfCheck != "" {
+		if node.SelfCheck != selfCheckOK {
+			log.Printf("[!] Node %s SOCKS self-check failed (%s): %s", node.ID, node.SelfCheck, node.SelfCheckError)
+		} else if previousSelfCheck != "" {
+			log.Printf("[+] Node %s SOCKS self-check passing again", node.ID)
+		}
+	}
+
+	if node.Draining != previousDraining {
+		if node.Draining {
+			log.Printf("[*] Node %s is draining", node.ID)
+		} else {
+			log.Printf("[+] Node %s is accepting clients again", node.ID)
+		}
+	}
+
+	if node.AgentVersion != previousVersion && previousVersion != "" {
+		log.Printf("[+] Node %s now runs agent %s (was %s)", node.ID, node.AgentVersion, previousVersion)
+	}
+
+	log.Printf("[+] Received heartbeat from %s: %s (%s, %s)", node.ID, net.JoinHostPort(node.IP, strconv.Itoa(node.Port)), meta.City, meta.Country)
+
+	resp := heartbeatResponse{Status: "ok"}
+	resp.Policy = api.pendingPolicy(node.ID, meta.PolicyVersion)
+	resp.Rotation = api.pendingRotation(node.ID)
+	resp.Commands = api.pendingCommands(node.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (api *APIServer) handleGetNodes(w http.ResponseWriter, r *http.Request) {
@@ -89,9 +228,22 @@ func (api *APIServer) handleGetNodes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	nodes, ok := filterByMismatch(nodes, r.URL.Query().Get("mismatch"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "mismatch must be true or false")
+		return
+	}
+	nodes, ok = filterByFamily(nodes, r.URL.Query().Get("family"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "family must be ipv4 or ipv6")
+		return
+	}
+	nodes = filterByHost(nodes, r.URL.Query().Get("host"))
+
+	auditNodes(r, nodeIDs(nodes)...)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"nodes": nodes,
+		"nodes": redactCredentials(nodes),
 		"count": len(nodes),
 	})
 }
@@ -115,9 +267,21 @@ func (api *APIServer) handleGetNodesByCountry(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	nodes, ok := filterByMismatch(nodes, r.URL.Query().Get("mismatch"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "mismatch must be true or false")
+		return
+	}
+	nodes, ok = filterByFamily(nodes, r.URL.Query().Get("family"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "family must be ipv4 or ipv6")
+		return
+	}
+
+	auditNodes(r, nodeIDs(nodes)...)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"nodes":   nodes,
+		"nodes":   redactCredentials(nodes),
 		"country": country,
 		"count":   len(nodes),
 	})
@@ -136,13 +300,30 @@ func (api *APIServer) handleGetRandomNode(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	nodes, ok := filterByMismatch(nodes, r.URL.Query().Get("mismatch"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "mismatch must be true or false")
+		return
+	}
+	nodes, ok = filterByFamily(nodes, r.URL.Query().Get("family"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "family must be ipv4 or ipv6")
+		return
+	}
+
+	// Never hand out a node that cannot currently proxy or is draining
+	nodes = excludeUnavailable(nodes)
+
 	if len(nodes) == 0 {
 		http.Error(w, "no nodes available", http.StatusNotFound)
 		return
 	}
 
-	// Select random node
+	// Select random node; credentials are only available through a lease
 	randomNode := nodes[rand.Intn(len(nodes))]
+	randomNode.Username = ""
+	randomNode.Password = ""
+	auditNodes(r, randomNode.ID)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(randomNode)
@@ -159,20 +340,117 @@ func (api *APIServer) startCleanupRoutine() {
 	}()
 }
 
+// tlsConfig prepares the embedded CA and returns a server TLS config that
+// requests, but does not require, agent client certificates. Enrollment and
+// client/admin routes still work without one.
+func (api *APIServer) tlsConfig(cfg *controllerConfig) (*tls.Config, error) {
+	ca, err := pki.LoadOrCreateAuthority(cfg.TLSDir)
+	if err != nil {
+		return nil, err
+	}
+
+	serverCert, err := ca.ServerCertificate(cfg.TLSDir, cfg.TLSHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the CA along with the leaf so agents can pin it by fingerprint
+	// before they have enrolled
+	serverCert.Certificate = append(serverCert.Certificate, ca.Cert.Raw)
+
+	api.ca = ca
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.CertPool(),
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
 func main() {
-	api, err := NewAPIServer("./trinityproxy.db")
+	cfg := loadConfig()
+
+	// Release signing happens away from the controller and needs no database
+	switch flag.Arg(0) {
+	case "release-keygen":
+		runReleaseKeygen(flag.Arg(1))
+		return
+	case "sign-release":
+		runSignRelease(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		return
+	}
+
+	masterKey, err := loadMasterKey(cfg)
+	if err != nil {
+		log.Fatalf("[-] Failed to load master key: %v", err)
+	}
+
+	if flag.Arg(0) == "rekey" {
+		runRekey(cfg, masterKey, flag.Arg(1))
+		return
+	}
+
+	api, err := NewAPIServer(cfg.DBPath, masterKey)
 	if err != nil {
 		log.Fatalf("[-] Failed to initialize API server: %v", err)
 	}
+	api.rateLimits = cfg.RateLimits
+
+	server := &http.Server{Addr: cfg.Listen}
+	if cfg.TLS {
+		server.TLSConfig, err = api.tlsConfig(cfg)
+		if err != nil {
+			log.Fatalf("[-] Failed to initialize TLS: %v", err)
+		}
+		log.Printf("[*] Embedded CA fingerprint: %s", api.ca.Fingerprint())
+	}
+
+	if err := api.configureVerification(cfg); err != nil {
+		log.Fatalf("[-] Failed to configure node verification: %v", err)
+	}
+	if err := api.configureReleases(cfg); err != nil {
+		log.Fatalf("[-] Failed to configure agent releases: %v", err)
+	}
 
-	// Start cleanup routine
+	if err := api.ensureAdminKey(); err != nil {
+		log.Fatalf("[-] Failed to bootstrap admin API key: %v", err)
+	}
+	api.warnHeartbeatScopeKeys()
+
+	// Start cleanup routines
 	api.startCleanupRoutine()
+	api.startRateLimitPruner()
+	api.startMetricsPruner(cfg.MetricsRetention)
+	api.startCommandPruner(cfg.CommandRetention)
+	api.pruneAuditLog(cfg.AuditRetention)
 
 	// Routes
-	http.HandleFunc("/api/heartbeat", api.handleHeartbeat)
-	http.HandleFunc("/api/nodes", api.handleGetNodes)
-	http.HandleFunc("/api/nodes/country", api.handleGetNodesByCountry)
-	http.HandleFunc("/api/nodes/random", api.handleGetRandomNode)
+	api.route("/api/enroll", api.limitByIP(api.handleEnroll))
+	api.route("/api/heartbeat", api.requireNodeIdentity(api.handleHeartbeat))
+	api.route("/api/heartbeat/batch", api.requireNodeIdentity(api.handleHeartbeatBatch))
+	api.route("/api/rotations/confirm", api.requireNodeIdentity(api.handleConfirmRotation))
+	api.route("/api/nodes/deregister", api.requireNodeIdentity(api.handleDeregister))
+	api.route("/api/releases/download", api.requireNodeIdentity(api.handleReleaseDownload))
+	api.route("/api/nodes", api.requireScope(storage.ScopeReadNodes, api.handleGetNodes))
+	api.route("/api/nodes/country", api.requireScope(storage.ScopeReadNodes, api.handleGetNodesByCountry))
+	api.route("/api/nodes/random", api.requireScope(storage.ScopeReadNodes, api.handleGetRandomNode))
+	api.route("/api/nodes/lease", api.requireScope(storage.ScopeReadNodes, api.handleLeaseCredentials))
+	api.route("/api/nodes/metrics", api.requireScope(storage.ScopeReadNodes, api.handleNodeMetrics))
+
+	// Admin routes
+	api.route("/api/admin/keys", api.requireScope(storage.ScopeAdmin, api.handleAPIKeys))
+	api.route("/api/admin/keys/revoke", api.requireScope(storage.ScopeAdmin, api.handleRevokeAPIKey))
+	api.route("/api/admin/join-tokens", api.requireScope(storage.ScopeAdmin, api.handleJoinTokens))
+	api.route("/api/admin/node-keys", api.requireScope(storage.ScopeAdmin, api.handleNodeKeys))
+	api.route("/api/admin/node-keys/revoke", api.requireScope(storage.ScopeAdmin, api.handleRevokeNodeKey))
+	api.route("/api/admin/leases", api.requireScope(storage.ScopeAdmin, api.handleListLeases))
+	api.route("/api/admin/policy", api.requireScope(storage.ScopeAdmin, api.handleFleetPolicy))
+	api.route("/api/admin/rotations", api.requireScope(storage.ScopeAdmin, api.handleRotations))
+	api.route("/api/admin/commands", api.requireScope(storage.ScopeAdmin, api.handleCommands))
+	api.route("/api/admin/releases", api.requireScope(storage.ScopeAdmin, api.handleReleases))
+	api.route("/api/admin/replays", api.requireScope(storage.ScopeAdmin, api.handleListReplays))
+	api.route("/api/admin/ratelimits", api.requireScope(storage.ScopeAdmin, api.handleRateLimitStats))
+	api.route("/api/audit", api.requireScope(storage.ScopeAdmin, api.handleAuditLog))
 
 	// Health check
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -180,15 +458,49 @@ func main() {
 		fmt.Fprint(w, "ok")
 	})
 
-	log.Println("[*] Enhanced API server listening on :3100")
+	scheme := "http"
+	if cfg.TLS {
+		scheme = "https"
+	}
+	log.Printf("[*] Enhanced API server listening on %s (%s)", cfg.Listen, scheme)
 	log.Println("[*] Available endpoints:")
-	log.Println("    POST /api/heartbeat     - Node heartbeat")
-	log.Println("    GET  /api/nodes         - List all online nodes")
-	log.Println("    GET  /api/nodes/country?country=US - Filter by country")
-	log.Println("    GET  /api/nodes/random  - Get random node")
+	log.Println("    POST /api/enroll        - Enroll agent with join token")
+	log.Println("    POST /api/heartbeat     - Signed node heartbeat")
+	log.Println("    POST /api/heartbeat/batch - Signed; backfill heartbeats spooled during an outage")
+	log.Println("    POST /api/rotations/confirm - Agent confirms new credentials")
+	log.Println("    POST /api/nodes/deregister - Signed; agent is shutting down")
+	log.Println("    POST /api/releases/download - Signed; fetch an agent release binary")
+	log.Println("    GET  /api/nodes?mismatch=false&family=ipv6&host=ID - List all online nodes")
+	log.Println("    GET  /api/nodes/country?country=US&mismatch=false&family=ipv6 - Filter by country")
+	log.Println("    GET  /api/nodes/random?mismatch=false&family=ipv6 - Get random node")
+	log.Println("    POST /api/nodes/lease?id=ID&ttl=15m&family=ipv6 - Lease node credentials")
+	log.Println("    GET  /api/nodes/metrics?id=ID&since=&until= - Node metrics time series")
+	log.Println("    GET  /api/admin/keys    - List API keys (admin)")
+	log.Println("    POST /api/admin/keys    - Create API key (admin)")
+	log.Println("    POST /api/admin/keys/revoke?id=ID - Revoke API key (admin)")
+	log.Println("    POST /api/admin/join-tokens?ttl=1h - Issue join token (admin)")
+	log.Println("    GET  /api/admin/node-keys - List enrolled nodes (admin)")
+	log.Println("    POST /api/admin/node-keys/revoke?id=ID - Revoke node (admin)")
+	log.Println("    GET  /api/admin/leases?status=expired - List credential leases (admin)")
+	log.Println("    GET  /api/admin/policy  - Show fleet access policy (admin)")
+	log.Println("    PUT  /api/admin/policy  - Push access policy to all agents (admin)")
+	log.Println("    GET  /api/admin/rotations?node=ID - Credential rotation history (admin)")
+	log.Println("    POST /api/admin/rotations?node=ID|all=true&overlap=10m - Schedule credential rotation (admin)")
+	log.Println("    GET  /api/admin/commands?node=ID&status= - Node command history (admin)")
+	log.Println("    POST /api/admin/commands?node=ID|country=US|all=true - Queue a node command (admin)")
+	log.Println("    GET  /api/admin/releases - List agent releases (admin)")
+	log.Println("    POST /api/admin/releases?version=V&signature=SIG - Upload a signed agent release (admin)")
+	log.Println("    GET  /api/admin/replays?node=ID - Rejected (replayed) heartbeats (admin)")
+	log.Println("    GET  /api/admin/ratelimits - Rate limit settings and hit counts (admin)")
+	log.Println("    GET  /api/audit?actor=&node=&result=&before= - Audit log (admin)")
 	log.Println("    GET  /health            - Health check")
 
-	if err := http.ListenAndServe(":3100", nil); err != nil {
+	if cfg.TLS {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("[-] API server failed: %v", err)
 	}
 }
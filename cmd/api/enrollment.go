@@ -0,0 +1,330 @@
+// cmd/api/enrollment.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/pki"
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+const (
+	nodeIDHeader        = "X-Trinity-Node-ID"
+	nodeSignatureHeader = "X-Trinity-Signature"
+
+	nodeIDContextKey contextKey = "node-id"
+
+	defaultJoinTokenTTL = 1 * time.Hour
+	maxSignedBodySize   = 1 << 20
+)
+
+// nodeIDFromContext returns the verified node ID for a signed request
+func nodeIDFromContext(ctx context.Context) string {
+	nodeID, _ := ctx.Value(nodeIDContextKey).(string)
+	return nodeID
+}
+
+// requireNodeIdentity wraps a handler so it only runs for requests from an
+// enrolled, unrevoked node. Over mutual TLS the node ID is taken from the
+// verified client certificate; otherwise the request must carry an Ed25519
+// signature, sent base64-encoded alongside the node ID, of the method, path
+// and raw body joined by newlines. Covering the route keeps a body signed
+// for one endpoint from being replayed against another.
+func (api *APIServer) requireNodeIdentity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			api.authenticateClientCert(w, r, next)
+			return
+		}
+
+		nodeID := r.Header.Get(nodeIDHeader)
+		sigHeader := r.Header.Get(nodeSignatureHeader)
+		if nodeID == "" || sigHeader == "" {
+			msg := "node signature required"
+			if api.heartbeatScopeKey(r) {
+				msg = storage.ErrHeartbeatScopeRemoved.Error()
+			}
+			api.rejectCredentials(w, r, http.StatusUnauthorized, msg)
+			return
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(sigHeader)
+		if err != nil {
+			api.rejectCredentials(w, r, http.StatusUnauthorized, "malformed signature")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+
+		key, err := api.storage.GetNodeKey(nodeID)
+		if err == storage.ErrUnknownNode {
+			log.Printf("[-] Rejected request from unknown or revoked node %s", nodeID)
+			api.rejectCredentials(w, r, http.StatusUnauthorized, "unknown or revoked node")
+			return
+		}
+		if err != nil {
+			log.Printf("[-] Failed to load node key: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		publicKey, err := base64.StdEncoding.DecodeString(key.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			log.Printf("[-] Stored public key for node %s is corrupt", nodeID)
+			writeJSONError(w, http.StatusInternalServerError, "invalid node key")
+			return
+		}
+
+		message := append([]byte(r.Method+"\n"+r.URL.Path+"\n"), body...)
+		if !ed25519.Verify(publicKey, message, signature) {
+			log.Printf("[-] Invalid signature from node %s", nodeID)
+			api.rejectCredentials(w, r, http.StatusUnauthorized, "invalid signature")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		auditActor(r, "node:"+nodeID)
+		if !allowRequest(w, r, "node:"+nodeID) {
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), nodeIDContextKey, nodeID)))
+	}
+}
+
+// authenticateClientCert identifies the node by the common name of its
+// verified client certificate and checks the certificate still carries the
+// node's registered key, so revoking the node also revokes the certificate
+func (api *APIServer) authenticateClientCert(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	cert := r.TLS.VerifiedChains[0][0]
+	nodeID := cert.Subject.CommonName
+
+	if header := r.Header.Get(nodeIDHeader); header != "" && header != nodeID {
+		api.rejectCredentials(w, r, http.StatusForbidden, "node ID does not match client certificate")
+		return
+	}
+
+	key, err := api.storage.GetNodeKey(nodeID)
+	if err == storage.ErrUnknownNode {
+		log.Printf("[-] Rejected certificate for unknown or revoked node %s", nodeID)
+		api.rejectCredentials(w, r, http.StatusUnauthorized, "unknown or revoked node")
+		return
+	}
+	if err != nil {
+		log.Printf("[-] Failed to load node key: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	certKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if err != nil || !ok || !certKey.Equal(ed25519.PublicKey(publicKey)) {
+		log.Printf("[-] Client certificate for node %s does not match its registered key", nodeID)
+		api.rejectCredentials(w, r, http.StatusUnauthorized, "certificate does not match node key")
+		return
+	}
+
+	auditActor(r, "node:"+nodeID)
+	if !allowRequest(w, r, "node:"+nodeID) {
+		return
+	}
+	next(w, r.WithContext(context.WithValue(r.Context(), nodeIDContextKey, nodeID)))
+}
+
+type enrollRequest struct {
+	Token     string `json:"token"`
+	Hostname  string `json:"hostname"`
+	PublicKey string `json:"public_key"`
+	CSR       string `json:"csr,omitempty"`
+}
+
+type enrollResponse struct {
+	NodeID        string `json:"node_id"`
+	Certificate   string `json:"certificate,omitempty"`
+	CACertificate string `json:"ca_certificate,omitempty"`
+
+	// Key the agent checks releases against before installing them
+	ReleasePublicKey string `json:"release_public_key,omitempty"`
+}
+
+// handleEnroll exchanges a one-time join token for a node ID bound to the
+// agent's Ed25519 public key. The join token is the only credential required.
+// When the controller serves TLS and the agent sends a CSR for the same key,
+// the response also carries a client certificate and the CA to pin.
+func (api *APIServer) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req enrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(req.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		writeJSONError(w, http.StatusBadRequest, "public_key must be a base64 Ed25519 public key")
+		return
+	}
+
+	var csr *x509.CertificateRequest
+	if api.ca != nil && req.CSR != "" {
+		csr, err = pki.ParseClientCSR([]byte(req.CSR), ed25519.PublicKey(publicKey))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	nodeID, err := api.storage.EnrollNode(req.Token, req.Hostname, req.PublicKey)
+	if err == storage.ErrInvalidJoinToken {
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("[-] Failed to enroll node: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	resp := enrollResponse{NodeID: nodeID}
+	if api.releaseKey != nil {
+		resp.ReleasePublicKey = base64.StdEncoding.EncodeToString(api.releaseKey)
+	}
+	if csr != nil {
+		cert, err := api.ca.SignClientCSR(csr, nodeID)
+		if err != nil {
+			log.Printf("[-] Failed to issue certificate for node %s: %v", nodeID, err)
+			writeJSONError(w, http.StatusInternalServerError, "certificate error")
+			return
+		}
+		resp.Certificate = string(cert)
+		resp.CACertificate = string(api.ca.CertPEM)
+	}
+
+	log.Printf("[+] Enrolled node %s (%s)", nodeID, req.Hostname)
+	auditActor(r, "node:"+nodeID)
+	auditNodes(r, nodeID)
+	auditDetail(r, "enrolled "+req.Hostname)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (api *APIServer) handleJoinTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		tokens, err := api.storage.ListJoinTokens()
+		if err != nil {
+			log.Printf("[-] Failed to list join tokens: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tokens": tokens,
+			"count":  len(tokens),
+		})
+
+	case "POST":
+		ttl := defaultJoinTokenTTL
+		if raw := r.URL.Query().Get("ttl"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "ttl must be a positive duration such as 30m")
+				return
+			}
+			ttl = parsed
+		}
+
+		token, raw, err := api.storage.CreateJoinToken(ttl)
+		if err != nil {
+			log.Printf("[-] Failed to create join token: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		log.Printf("[+] Issued join token %s (expires %s)", token.ID, token.ExpiresAt.Format(time.RFC3339))
+		auditDetail(r, "issued join token "+token.ID)
+		resp := map[string]interface{}{
+			"token":      token,
+			"join_token": raw,
+		}
+		if api.ca != nil {
+			resp["ca_fingerprint"] = api.ca.Fingerprint()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (api *APIServer) handleNodeKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	keys, err := api.storage.ListNodeKeys()
+	if err != nil {
+		log.Printf("[-] Failed to list node keys: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nodes": keys,
+		"count": len(keys),
+	})
+}
+
+func (api *APIServer) handleRevokeNodeKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSONError(w, http.StatusBadRequest, "id parameter required")
+		return
+	}
+
+	err := api.storage.RevokeNodeKey(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "node not found or already revoked")
+		return
+	}
+	if err != nil {
+		log.Printf("[-] Failed to revoke node key: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	log.Printf("[+] Revoked node %s", id)
+	auditNodes(r, id)
+	auditDetail(r, "revoked node key")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "revoked", "node_id": id})
+}
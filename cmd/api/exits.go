@@ -0,0 +1,115 @@
+// cmd/api/exits.go
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// maxExits is the most additional addresses registered for one host
+const maxExits = 64
+
+// exitReport is an additional public address a host's SOCKS service listens
+// on and sends traffic from, with the agent's self-check through it
+type exitReport struct {
+	IP        string           `json:"ip"`
+	SelfCheck *selfCheckResult `json:"self_check,omitempty"`
+}
+
+// upsertExits registers each additional address of a host as its own node.
+// Exits share the host's port, credentials, location, verification and drain
+// state; only the address and self-check are their own. Addresses the host
+// no longer reports are taken offline.
+func (api *APIServer) upsertExits(r *http.Request, host *storage.ProxyNode, reports []exitReport) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, report := range reports {
+		if len(ids) >= maxExits {
+			log.Printf("[!] Node %s reported more than %d exits, ignoring the rest", host.ID, maxExits)
+			break
+		}
+		ip := net.ParseIP(report.IP)
+		if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		if ip.Equal(net.ParseIP(host.IP)) || ip.Equal(net.ParseIP(host.IPv6)) || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+
+		exit := *host
+		exit.ID = storage.ExitID(host.ID, ip.String())
+		exit.HostID = host.ID
+		exit.IP, exit.IPv6 = ip.String(), ""
+		normalizeAddrs(&exit)
+		exit.SelfCheck, exit.SelfCheckError, exit.SelfCheckLatencyMs = "", "", 0
+		applySelfCheck(&exit, report.SelfCheck)
+
+		var previousSelfCheck string
+		if prev, err := api.storage.GetNode(exit.ID); err == nil {
+			previousSelfCheck = prev.SelfCheck
+		} else {
+			log.Printf("[+] Node %s registered exit %s", host.ID, exit.IP)
+		}
+		if _, err := api.storage.UpsertNode(&exit); err != nil {
+			log.Printf("[-] Failed to store exit %s: %v", exit.ID, err)
+			continue
+		}
+		ids = append(ids, exit.ID)
+
+		if exit.SelfCheck != previousSelfCheck && exit.SelfCheck != "" {
+			if exit.SelfCheck != selfCheckOK {
+				log.Printf("[!] Exit %s SOCKS self-check failed (%s): %s", exit.ID, exit.SelfCheck, exit.SelfCheckError)
+			} else if previousSelfCheck != "" {
+				log.Printf("[+] Exit %s SOCKS self-check passing again", exit.ID)
+			}
+		}
+	}
+
+	auditNodes(r, ids...)
+	if err := api.storage.RetireExits(host.ID, ids); err != nil {
+		log.Printf("[-] Failed to retire exits of %s: %v", host.ID, err)
+	}
+}
+
+// hostOf returns the ID of the agent serving a node. Commands and rotations
+// go to the host, since its exits have no agent of their own.
+func hostOf(node *storage.ProxyNode) string {
+	if node.IsExit() {
+		return node.HostID
+	}
+	return node.ID
+}
+
+// hostIDs returns the distinct hosts serving the nodes, in order
+func hostIDs(nodes []storage.ProxyNode) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for i := range nodes {
+		id := hostOf(&nodes[i])
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// filterByHost keeps a host's own node and its exits. An empty host keeps
+// every node.
+func filterByHost(nodes []storage.ProxyNode, host string) []storage.ProxyNode {
+	if host == "" {
+		return nodes
+	}
+
+	var out []storage.ProxyNode
+	for i := range nodes {
+		if hostOf(&nodes[i]) == host {
+			out = append(out, nodes[i])
+		}
+	}
+	return out
+}
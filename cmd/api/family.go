@@ -0,0 +1,71 @@
+// cmd/api/family.go
+package main
+
+import (
+	"net"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// Address families accepted by the family query parameter
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// normalizeAddrs tidies the addresses a heartbeat reported. IP is the
+// node's primary address, which is its IPv6 address on an IPv6-only host;
+// IPv6 must be an IPv6 address. Older agents on IPv6-only hosts only sent IP.
+func normalizeAddrs(node *storage.ProxyNode) {
+	if ip := net.ParseIP(node.IP); ip != nil {
+		node.IP = ip.String()
+		if ip.To4() == nil && node.IPv6 == "" {
+			node.IPv6 = node.IP
+		}
+	}
+	if ip := net.ParseIP(node.IPv6); ip == nil || ip.To4() != nil {
+		node.IPv6 = ""
+	} else {
+		node.IPv6 = ip.String()
+	}
+}
+
+// nodeAddr returns the node's address in the family, or "" if it has none.
+// An empty family means the primary address.
+func nodeAddr(node *storage.ProxyNode, family string) string {
+	switch family {
+	case familyIPv4:
+		if ip := net.ParseIP(node.IP); ip != nil && ip.To4() != nil {
+			return node.IP
+		}
+		return ""
+	case familyIPv6:
+		return node.IPv6
+	default:
+		return node.IP
+	}
+}
+
+// validFamily reports whether the family query parameter is usable
+func validFamily(family string) bool {
+	return family == "" || family == familyIPv4 || family == familyIPv6
+}
+
+// filterByFamily keeps nodes with an address in the family, so clients can
+// ask for IPv6 (or IPv4) exits. It reports false for an unknown family.
+func filterByFamily(nodes []storage.ProxyNode, family string) ([]storage.ProxyNode, bool) {
+	if !validFamily(family) {
+		return nil, false
+	}
+	if family == "" {
+		return nodes, true
+	}
+
+	var out []storage.ProxyNode
+	for i := range nodes {
+		if nodeAddr(&nodes[i], family) != "" {
+			out = append(out, nodes[i])
+		}
+	}
+	return out, true
+}
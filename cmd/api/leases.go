@@ -0,0 +1,201 @@
+// cmd/api/leases.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+const (
+	defaultLeaseTTL = 15 * time.Minute
+	maxLeaseTTL     = 24 * time.Hour
+)
+
+// nodeIDs lists the IDs of nodes, for the audit log
+func nodeIDs(nodes []storage.ProxyNode) []string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+	return ids
+}
+
+// redactCredentials strips SOCKS credentials from node listings. Clients
+// obtain credentials for a single node through a lease instead.
+func redactCredentials(nodes []storage.ProxyNode) []storage.ProxyNode {
+	for i := range nodes {
+		nodes[i].Username = ""
+		nodes[i].Password = ""
+	}
+	return nodes
+}
+
+type leaseResponse struct {
+	Lease    *storage.CredentialLease `json:"lease"`
+	IP       string                   `json:"ip"`
+	IPv6     string                   `json:"ipv6,omitempty"`
+	Port     int                      `json:"port"`
+	Username string                   `json:"username"`
+	Password string                   `json:"password"`
+}
+
+// handleLeaseCredentials hands out connection credentials for one node with
+// an expiry and records which API key took them. The node is chosen by id,
+// or at random among online nodes (optionally within a country) that pass
+// their self-check and are not draining. A node chosen by id must pass its
+// self-check and not be draining either. With family=ipv4 or ipv6 only
+// nodes with such an address qualify, and ip is that address. mismatch
+// filters on the geo mismatch flag as in node listings.
+func (api *APIServer) handleLeaseCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ttl := defaultLeaseTTL
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 || parsed > maxLeaseTTL {
+			writeJSONError(w, http.StatusBadRequest, "ttl must be a duration between 1s and 24h")
+			return
+		}
+		ttl = parsed
+	}
+
+	family := r.URL.Query().Get("family")
+	if !validFamily(family) {
+		writeJSONError(w, http.StatusBadRequest, "family must be ipv4 or ipv6")
+		return
+	}
+
+	mismatch := r.URL.Query().Get("mismatch")
+	if _, ok := filterByMismatch(nil, mismatch); !ok {
+		writeJSONError(w, http.StatusBadRequest, "mismatch must be true or false")
+		return
+	}
+
+	var node *storage.ProxyNode
+	if id := r.URL.Query().Get("id"); id != "" {
+		found, err := api.storage.GetNode(id)
+		if err == sql.ErrNoRows || (err == nil && !found.IsOnline) {
+			writeJSONError(w, http.StatusNotFound, "node not found or offline")
+			return
+		}
+		if err != nil {
+			log.Printf("[-] Failed to load node %s: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		if found.Draining {
+			writeJSONError(w, http.StatusConflict, "node is draining")
+			return
+		}
+		if !selfCheckPassing(found) {
+			writeJSONError(w, http.StatusConflict, "node is failing its SOCKS self-check")
+			return
+		}
+		if matching, _ := filterByMismatch([]storage.ProxyNode{*found}, mismatch); len(matching) == 0 {
+			writeJSONError(w, http.StatusNotFound, "node does not match mismatch="+mismatch)
+			return
+		}
+		if nodeAddr(found, family) == "" {
+			writeJSONError(w, http.StatusNotFound, "node has no "+family+" address")
+			return
+		}
+		node = found
+	} else {
+		var nodes []storage.ProxyNode
+		var err error
+		if country := r.URL.Query().Get("country"); country != "" {
+			nodes, err = api.storage.GetNodesByCountry(country)
+		} else {
+			nodes, err = api.storage.GetOnlineNodes()
+		}
+		if err != nil {
+			log.Printf("[-] Failed to get nodes: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		nodes, _ = filterByMismatch(nodes, mismatch)
+		nodes, _ = filterByFamily(nodes, family)
+		nodes = excludeUnavailable(nodes)
+		if len(nodes) == 0 {
+			writeJSONError(w, http.StatusNotFound, "no nodes available")
+			return
+		}
+		node = &nodes[rand.Intn(len(nodes))]
+	}
+
+	leasedBy := ""
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		leasedBy = key.ID
+	}
+
+	lease, err := api.storage.CreateLease(node.ID, leasedBy, ttl)
+	if err != nil {
+		log.Printf("[-] Failed to record lease: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	log.Printf("[+] Leased credentials for %s to key %s until %s", node.ID, leasedBy, lease.ExpiresAt.Format(time.RFC3339))
+	auditNodes(r, node.ID)
+	auditDetail(r, "lease "+lease.ID+" until "+lease.ExpiresAt.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leaseResponse{
+		Lease:    lease,
+		IP:       nodeAddr(node, family),
+		IPv6:     node.IPv6,
+		Port:     node.Port,
+		Username: node.Username,
+		Password: node.Password,
+	})
+}
+
+// handleListLeases reports leases, filterable by status (active, expired,
+// invalidated) and node. Expired leases stay "expired" until the node's
+// credentials are rotated.
+func (api *APIServer) handleListLeases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", storage.LeaseActive, storage.LeaseExpired, storage.LeaseInvalidated:
+	default:
+		writeJSONError(w, http.StatusBadRequest, "status must be active, expired or invalidated")
+		return
+	}
+
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = parsed
+	}
+
+	leases, err := api.storage.ListLeases(status, r.URL.Query().Get("node"), limit)
+	if err != nil {
+		log.Printf("[-] Failed to list leases: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"leases": leases,
+		"count":  len(leases),
+	})
+}
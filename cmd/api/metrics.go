@@ -0,0 +1,94 @@
+// cmd/api/metrics.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// recordMetrics stores the metrics sample carried by a heartbeat, stamped
+// with the heartbeat's (already skew-checked) send time
+func (api *APIServer) recordMetrics(nodeID string, meta *NodeMetadata) {
+	if meta.Metrics == nil {
+		return
+	}
+	meta.Metrics.RecordedAt = time.Unix(meta.Timestamp, 0)
+	meta.Metrics.Seq = meta.Seq
+	if meta.SelfCheck != nil {
+		meta.Metrics.SelfCheck = meta.SelfCheck.Status
+	}
+	if err := api.storage.RecordMetrics(nodeID, meta.Metrics); err != nil {
+		log.Printf("[-] Failed to store metrics for %s: %v", nodeID, err)
+	}
+}
+
+// startMetricsPruner deletes samples older than the retention period
+func (api *APIServer) startMetricsPruner(retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	go func() {
+		for range ticker.C {
+			n, err := api.storage.PruneMetrics(retention)
+			if err != nil {
+				log.Printf("[-] Metrics pruning error: %v", err)
+			} else if n > 0 {
+				log.Printf("[*] Pruned %d metrics samples older than %s", n, retention)
+			}
+		}
+	}()
+}
+
+// handleNodeMetrics returns a node's metrics time series, oldest first.
+// since and until are RFC 3339; limit keeps the most recent samples.
+func (api *APIServer) handleNodeMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	filter := storage.MetricsFilter{NodeID: q.Get("id"), Limit: 1440}
+	if filter.NodeID == "" {
+		writeJSONError(w, http.StatusBadRequest, "id parameter required")
+		return
+	}
+
+	for name, dest := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if raw := q.Get(name); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, name+" must be an RFC 3339 timestamp")
+				return
+			}
+			*dest = parsed
+		}
+	}
+
+	if raw := q.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > 10000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 10000")
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	samples, err := api.storage.ListMetrics(filter)
+	if err != nil {
+		log.Printf("[-] Failed to list metrics for %s: %v", filter.NodeID, err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	auditNodes(r, filter.NodeID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id": filter.NodeID,
+		"samples": samples,
+		"count":   len(samples),
+	})
+}
@@ -0,0 +1,72 @@
+// cmd/api/policy.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+// pendingPolicy returns the fleet policy if the agent reports a different
+// version, so each agent receives a new policy once and then acknowledges it
+// by reporting the new version on its next heartbeat
+func (api *APIServer) pendingPolicy(nodeID, agentVersion string) *policy.Policy {
+	fleet, err := api.storage.GetFleetPolicy()
+	if err != nil {
+		log.Printf("[-] Failed to load fleet policy: %v", err)
+		return nil
+	}
+	if fleet == nil || fleet.Version == agentVersion {
+		return nil
+	}
+
+	log.Printf("[*] Sending access policy %s to %s (has %q)", fleet.Version, nodeID, agentVersion)
+	return fleet
+}
+
+func (api *APIServer) handleFleetPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		fleet, err := api.storage.GetFleetPolicy()
+		if err != nil {
+			log.Printf("[-] Failed to load fleet policy: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		if fleet == nil {
+			writeJSONError(w, http.StatusNotFound, "no fleet policy set, agents use their installed policy")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fleet)
+
+	case "PUT":
+		var p policy.Policy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+			return
+		}
+
+		if err := p.Validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := api.storage.SetFleetPolicy(&p); err != nil {
+			log.Printf("[-] Failed to store fleet policy: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		log.Printf("[+] Fleet access policy updated to %s", p.Version)
+		auditDetail(r, "fleet policy "+p.Version)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&p)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,238 @@
+// cmd/api/ratelimit.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimit is a token bucket: Rate tokens per second refill up to Burst
+type rateLimit struct {
+	Rate  float64 `json:"rate_per_second"`
+	Burst int     `json:"burst"`
+}
+
+const bucketIdleTTL = 10 * time.Minute
+
+// defaultRateLimits are the per-route limits applied to each client. Routes
+// not listed use the "*" entry. -rate-limits overrides them.
+func defaultRateLimits() map[string]rateLimit {
+	return map[string]rateLimit{
+		"*":                    {Rate: 5, Burst: 20},
+		"/api/heartbeat":       {Rate: 1.0 / 10, Burst: 6},
+		"/api/enroll":          {Rate: 1.0 / 60, Burst: 5},
+		"/api/nodes/random":    {Rate: 2, Burst: 10},
+		"/api/nodes/lease":     {Rate: 1, Burst: 10},
+		"/api/nodes/metrics":   {Rate: 1, Burst: 10},
+		"/api/nodes":           {Rate: 1, Burst: 5},
+		"/api/nodes/country":   {Rate: 1, Burst: 5},
+		"/api/admin/keys":      {Rate: 1, Burst: 10},
+		"/api/admin/policy":    {Rate: 1, Burst: 5},
+		"/api/admin/leases":    {Rate: 2, Burst: 10},
+		"/api/admin/node-keys": {Rate: 1, Burst: 10},
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets for one route
+type rateLimiter struct {
+	limit rateLimit
+	hits  atomic.Uint64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token for key, returning how long to wait when none is left
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+elapsed*l.limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	l.hits.Add(1)
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops buckets that have been idle long enough to be full again
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > bucketIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limiterFor returns the limiter for a route, creating it on first use
+func (api *APIServer) limiterFor(route string) *rateLimiter {
+	api.limitersMu.Lock()
+	defer api.limitersMu.Unlock()
+
+	if l, ok := api.limiters[route]; ok {
+		return l
+	}
+
+	limit, ok := api.rateLimits[route]
+	if !ok {
+		limit = api.rateLimits["*"]
+	}
+	l := newRateLimiter(limit)
+	api.limiters[route] = l
+	return l
+}
+
+const rateLimitContextKey contextKey = "rate-limit"
+
+// rateLimit hands the route's limiter to the handler. Buckets are charged by
+// the handler's wrappers: limitByIP for open routes, and requireScope or
+// requireNodeIdentity, which charge the API key or node once it has been
+// validated and the client IP when the credentials are missing or invalid.
+// Keying on unvalidated headers would let a client pick a fresh bucket per
+// request.
+func (api *APIServer) rateLimit(route string, next http.HandlerFunc) http.HandlerFunc {
+	limiter := api.limiterFor(route)
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), rateLimitContextKey, limiter)))
+	}
+}
+
+// allowRequest takes a token for key from the route's limiter. Over the
+// limit it answers 429 and returns false.
+func allowRequest(w http.ResponseWriter, r *http.Request, key string) bool {
+	limiter, _ := r.Context().Value(rateLimitContextKey).(*rateLimiter)
+	if limiter == nil {
+		return true
+	}
+
+	ok, wait := limiter.allow(key, time.Now())
+	if !ok {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded, retry in "+strconv.Itoa(seconds)+"s")
+	}
+	return ok
+}
+
+// limitByIP rate limits an unauthenticated route per client IP
+func (api *APIServer) limitByIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowRequest(w, r, "ip:"+api.clientIP(r)) {
+			next(w, r)
+		}
+	}
+}
+
+// rejectCredentials answers a request whose credentials are missing or
+// invalid. It counts against the client IP, so guessing keys is limited
+// without creating a bucket per guess.
+func (api *APIServer) rejectCredentials(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if allowRequest(w, r, "ip:"+api.clientIP(r)) {
+		writeJSONError(w, status, msg)
+	}
+}
+
+// parseRateLimits overrides the default limits with a comma-separated list
+// of route=rate/burst entries, rate in requests per second:
+// "/api/heartbeat=0.2/10,*=10/40"
+func parseRateLimits(spec string) (map[string]rateLimit, error) {
+	limits := defaultRateLimits()
+	for _, entry := range splitList(spec) {
+		route, value, ok := strings.Cut(entry, "=")
+		rateStr, burstStr, ok2 := strings.Cut(value, "/")
+		if !ok || !ok2 || route == "" {
+			return nil, fmt.Errorf("rate limit %q is not route=rate/burst", entry)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("rate limit %q: rate must be a positive number", entry)
+		}
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("rate limit %q: burst must be at least 1", entry)
+		}
+		limits[route] = rateLimit{Rate: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// startRateLimitPruner periodically frees idle buckets
+func (api *APIServer) startRateLimitPruner() {
+	ticker := time.NewTicker(bucketIdleTTL)
+	go func() {
+		for now := range ticker.C {
+			api.limitersMu.Lock()
+			for _, l := range api.limiters {
+				l.prune(now)
+			}
+			api.limitersMu.Unlock()
+		}
+	}()
+}
+
+type rateLimitStats struct {
+	rateLimit
+	Hits    uint64 `json:"hits"`
+	Clients int    `json:"active_clients"`
+}
+
+// handleRateLimitStats exposes per-route limits and how often they were hit
+func (api *APIServer) handleRateLimitStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stats := make(map[string]rateLimitStats)
+	var total uint64
+
+	api.limitersMu.Lock()
+	for route, l := range api.limiters {
+		l.mu.Lock()
+		clients := len(l.buckets)
+		l.mu.Unlock()
+
+		hits := l.hits.Load()
+		total += hits
+		stats[route] = rateLimitStats{rateLimit: l.limit, Hits: hits, Clients: clients}
+	}
+	api.limitersMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"routes":     stats,
+		"total_hits": total,
+	})
+}
@@ -0,0 +1,42 @@
+// cmd/api/rekey.go
+package main
+
+import (
+	"log"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// runRekey re-encrypts all stored SOCKS credentials under the key in
+// newKeyFile, generating that key if the file does not exist yet. The
+// controller must be stopped while this runs.
+func runRekey(cfg *controllerConfig, currentKey []byte, newKeyFile string) {
+	if newKeyFile == "" {
+		log.Fatalf("[-] Usage: api rekey <new-key-file>")
+	}
+	if newKeyFile == cfg.MasterKeyFile {
+		log.Fatalf("[-] New key file must differ from the current one (%s)", cfg.MasterKeyFile)
+	}
+
+	newKey, created, err := storage.LoadOrCreateMasterKey(newKeyFile)
+	if err != nil {
+		log.Fatalf("[-] Failed to load new master key: %v", err)
+	}
+	if created {
+		log.Printf("[+] Generated new master key at %s", newKeyFile)
+	}
+
+	nodeStorage, err := storage.NewNodeStorage(cfg.DBPath, currentKey)
+	if err != nil {
+		log.Fatalf("[-] Failed to open database with current key: %v", err)
+	}
+	defer nodeStorage.Close()
+
+	count, err := nodeStorage.Rekey(newKey)
+	if err != nil {
+		log.Fatalf("[-] Rekey failed, database unchanged: %v", err)
+	}
+
+	log.Printf("[+] Re-encrypted credentials for %d nodes", count)
+	log.Printf("[*] Point TRINITY_MASTER_KEY_FILE (or -master-key-file) at %s before restarting the controller", newKeyFile)
+}
@@ -0,0 +1,313 @@
+// cmd/api/releases.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/release"
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// updateInstruction is the argument of an update_agent command: the release
+// to install and what the agent checks the download against
+type updateInstruction struct {
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Signature string `json:"signature"`
+}
+
+// configureReleases sets up the directory release binaries are kept in and
+// loads the public key releases must be signed with. Without a key, releases
+// cannot be uploaded.
+func (api *APIServer) configureReleases(cfg *controllerConfig) error {
+	if err := os.MkdirAll(cfg.ReleaseDir, 0750); err != nil {
+		return err
+	}
+	api.releaseDir = cfg.ReleaseDir
+
+	moved, err := api.storage.MoveReleaseBinaries(func(version string, binary []byte) error {
+		return writeReleaseFile(api.releasePath(version), binary)
+	})
+	if moved > 0 {
+		log.Printf("[+] Moved %d release binaries from the database to %s", moved, cfg.ReleaseDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.ReleasePublicKey == "" {
+		return nil
+	}
+	key, err := release.ParsePublicKey(cfg.ReleasePublicKey)
+	if err != nil {
+		return err
+	}
+	api.releaseKey = key
+	log.Printf("[*] Accepting agent releases signed by %s", base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+// releasePath is where a release's binary is kept. Versions are checked by
+// release.ValidVersion, so they are safe as file names.
+func (api *APIServer) releasePath(version string) string {
+	return filepath.Join(api.releaseDir, version)
+}
+
+func writeReleaseFile(path string, binary []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, binary, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// updateArgs returns the update_agent arguments for a stored release
+func (api *APIServer) updateArgs(version string) (json.RawMessage, error) {
+	rel, err := api.storage.GetRelease(version)
+	if err == storage.ErrReleaseNotFound {
+		return nil, fmt.Errorf("unknown release %q", version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load release: %v", err)
+	}
+	return json.Marshal(updateInstruction{
+		Version:   rel.Version,
+		SHA256:    rel.SHA256,
+		Size:      rel.Size,
+		Signature: rel.Signature,
+	})
+}
+
+// handleReleases lists agent releases (GET) or uploads one (POST). The body
+// is the binary; version and signature are query parameters, and the
+// signature must verify against the configured release key.
+func (api *APIServer) handleReleases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		releases, err := api.storage.ListReleases()
+		if err != nil {
+			log.Printf("[-] Failed to list releases: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"releases": releases,
+			"count":    len(releases),
+		})
+
+	case "POST":
+		if api.releaseKey == nil {
+			writeJSONError(w, http.StatusBadRequest, "no release public key configured (-release-public-key)")
+			return
+		}
+
+		version, signature := r.URL.Query().Get("version"), r.URL.Query().Get("signature")
+		if !release.ValidVersion(version) {
+			writeJSONError(w, http.StatusBadRequest, "version must be up to 64 letters, digits, '.', '_', '+' or '-'")
+			return
+		}
+		if signature == "" {
+			writeJSONError(w, http.StatusBadRequest, "signature parameter required")
+			return
+		}
+
+		// The binary is streamed to disk while it is hashed, so uploads are
+		// not held in memory
+		tmp, err := os.CreateTemp(api.releaseDir, ".upload-*")
+		if err != nil {
+			log.Printf("[-] Failed to stage release upload: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		defer os.Remove(tmp.Name())
+
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(tmp, hash), http.MaxBytesReader(w, r.Body, release.MaxSize))
+		if closeErr := tmp.Close(); err == nil && closeErr != nil {
+			log.Printf("[-] Failed to stage release upload: %v", closeErr)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("binary larger than %d MiB", release.MaxSize>>20))
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+		if size == 0 {
+			writeJSONError(w, http.StatusBadRequest, "binary required as the request body")
+			return
+		}
+
+		digest := hex.EncodeToString(hash.Sum(nil))
+		if err := release.Verify(api.releaseKey, version, digest, signature); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rel := &storage.AgentRelease{
+			Version:   version,
+			SHA256:    digest,
+			Signature: signature,
+			Size:      size,
+			CreatedAt: time.Now(),
+		}
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			rel.UploadedBy = key.ID
+		}
+		err = api.storeRelease(rel, tmp.Name())
+		if err == storage.ErrReleaseExists {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("[-] Failed to store release %s: %v", version, err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		log.Printf("[+] Stored agent release %s (%d bytes, sha256 %s)", version, rel.Size, digest)
+		auditDetail(r, "uploaded agent release "+version)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rel)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// storeRelease moves an uploaded binary into the release directory and
+// records the release. The binary is linked rather than renamed into place,
+// so an existing release's file is never replaced.
+func (api *APIServer) storeRelease(rel *storage.AgentRelease, staged string) error {
+	api.releasesMu.Lock()
+	defer api.releasesMu.Unlock()
+
+	if _, err := api.storage.GetRelease(rel.Version); err != storage.ErrReleaseNotFound {
+		if err == nil {
+			return storage.ErrReleaseExists
+		}
+		return err
+	}
+
+	// A file without a release is left from an upload that did not finish
+	path := api.releasePath(rel.Version)
+	os.Remove(path)
+	if err := os.Link(staged, path); err != nil {
+		return err
+	}
+	if err := api.storage.CreateRelease(rel); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// handleReleaseDownload serves a release binary to an enrolled agent. The
+// request is a signed {"version": "..."}; the agent verifies what it gets
+// against the update instruction, so this only limits who can fetch it.
+func (api *APIServer) handleReleaseDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	rel, err := api.storage.GetRelease(req.Version)
+	if err == storage.ErrReleaseNotFound {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("[-] Failed to load release %s: %v", req.Version, err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	binary, err := os.Open(api.releasePath(rel.Version))
+	if err != nil {
+		log.Printf("[-] Failed to open release %s: %v", rel.Version, err)
+		writeJSONError(w, http.StatusInternalServerError, "release binary missing")
+		return
+	}
+	defer binary.Close()
+
+	nodeID := nodeIDFromContext(r.Context())
+	auditNodes(r, nodeID)
+	auditDetail(r, "downloaded agent release "+rel.Version)
+	log.Printf("[*] Node %s downloading agent release %s", nodeID, rel.Version)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, rel.Version, rel.CreatedAt, binary)
+}
+
+// runReleaseKeygen creates a release signing key. Keep it off the
+// controller: agents install anything it signs.
+func runReleaseKeygen(keyFile string) {
+	if keyFile == "" {
+		log.Fatalf("[-] Usage: api release-keygen <key-file>")
+	}
+	publicKey, err := release.GenerateKey(keyFile)
+	if err != nil {
+		log.Fatalf("[-] Failed to generate release key: %v", err)
+	}
+	log.Printf("[+] Wrote release signing key to %s", keyFile)
+	log.Printf("[*] Public key: %s", publicKey)
+	log.Printf("[*] Start the controller with -release-public-key %s (or TRINITY_RELEASE_PUBLIC_KEY)", publicKey)
+}
+
+// runSignRelease prints the signature for an agent binary
+func runSignRelease(keyFile, version, binaryPath string) {
+	if keyFile == "" || version == "" || binaryPath == "" {
+		log.Fatalf("[-] Usage: api sign-release <key-file> <version> <binary>")
+	}
+	if !release.ValidVersion(version) {
+		log.Fatalf("[-] Invalid version %q", version)
+	}
+	// The agent checks the release's version against its own after the
+	// restart, so a label that differs would look like a failed update
+	stamped, err := release.StampedVersion(binaryPath)
+	if err != nil {
+		log.Fatalf("[-] Failed to read the binary's version: %v", err)
+	}
+	if stamped != version {
+		log.Fatalf("[-] %s reports version %s, not %s", binaryPath, stamped, version)
+	}
+	key, err := release.LoadKey(keyFile)
+	if err != nil {
+		log.Fatalf("[-] Failed to load release key: %v", err)
+	}
+	binary, err := os.ReadFile(binaryPath)
+	if err != nil {
+		log.Fatalf("[-] Failed to read binary: %v", err)
+	}
+
+	digest := release.Digest(binary)
+	log.Printf("[*] %s: %d bytes, sha256 %s", binaryPath, len(binary), digest)
+	fmt.Println(release.Sign(key, version, digest))
+}
@@ -0,0 +1,117 @@
+// cmd/api/replay.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// maxHeartbeatSkew is how far a heartbeat's timestamp may drift from the
+// controller's clock
+const maxHeartbeatSkew = 5 * time.Minute
+
+// checkHeartbeatFreshness rejects heartbeats, and other signed requests
+// sharing their sequence, with a timestamp outside the allowed skew or a
+// sequence number that is not newer than the last one accepted from the
+// node. Rejections are recorded as possible replays. It reports whether the
+// handler may continue.
+func (api *APIServer) checkHeartbeatFreshness(w http.ResponseWriter, r *http.Request, nodeID string, seq, timestamp int64) bool {
+	if seq <= 0 || timestamp <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "seq and timestamp are required")
+		return false
+	}
+
+	now := time.Now()
+	sentAt := time.Unix(timestamp, 0)
+	replay := &storage.HeartbeatReplay{
+		NodeID:   nodeID,
+		Seq:      seq,
+		SentAt:   sentAt,
+		RemoteIP: api.clientIP(r),
+	}
+
+	if skew := now.Sub(sentAt); skew > maxHeartbeatSkew || skew < -maxHeartbeatSkew {
+		replay.Reason = storage.ReplayClockSkew
+		replay.LastSeq, _ = api.storage.LastHeartbeatSequence(nodeID)
+		api.recordReplay(r, replay)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":       "timestamp outside allowed clock skew of " + maxHeartbeatSkew.String(),
+			"server_time": now.Unix(),
+		})
+		return false
+	}
+
+	last, err := api.storage.AdvanceHeartbeatSequence(nodeID, seq, sentAt)
+	if err == storage.ErrStaleSequence {
+		replay.Reason = storage.ReplayStaleSequence
+		replay.LastSeq = last
+		api.recordReplay(r, replay)
+
+		// The agent resumes from last_seq, which only helps a sender that
+		// can sign new heartbeats
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    err.Error(),
+			"last_seq": last,
+		})
+		return false
+	}
+	if err != nil {
+		log.Printf("[-] Failed to check heartbeat sequence: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return false
+	}
+
+	return true
+}
+
+func (api *APIServer) recordReplay(r *http.Request, replay *storage.HeartbeatReplay) {
+	log.Printf("[!] Rejected heartbeat from %s (%s): seq %d, last accepted %d, sent %s",
+		replay.NodeID, replay.Reason, replay.Seq, replay.LastSeq, replay.SentAt.Format(time.RFC3339))
+	auditNodes(r, replay.NodeID)
+	auditDetail(r, "possible replay: "+replay.Reason)
+
+	if err := api.storage.RecordReplay(replay); err != nil {
+		log.Printf("[-] Failed to record heartbeat replay: %v", err)
+	}
+}
+
+// handleListReplays reports rejected heartbeats, optionally for one node
+func (api *APIServer) handleListReplays(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := 100
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = parsed
+	}
+
+	replays, err := api.storage.ListReplays(r.URL.Query().Get("node"), limit)
+	if err != nil {
+		log.Printf("[-] Failed to list heartbeat replays: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"replays": replays,
+		"count":   len(replays),
+	})
+}
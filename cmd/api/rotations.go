@@ -0,0 +1,226 @@
+// cmd/api/rotations.go
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+const (
+	defaultRotationOverlap = 10 * time.Minute
+	maxRotationOverlap     = 24 * time.Hour
+)
+
+// rotationInstruction tells an agent to switch to new credentials, keeping
+// the old ones valid for OverlapSeconds after it confirms
+type rotationInstruction struct {
+	ID             string `json:"id"`
+	OverlapSeconds int64  `json:"overlap_seconds"`
+}
+
+// pendingRotation returns the node's due rotation, if any, for the heartbeat
+// response
+func (api *APIServer) pendingRotation(nodeID string) *rotationInstruction {
+	rot, err := api.storage.DueRotation(nodeID)
+	if err != nil {
+		log.Printf("[-] Failed to load rotation for %s: %v", nodeID, err)
+		return nil
+	}
+	if rot == nil {
+		return nil
+	}
+
+	log.Printf("[*] Sending credential rotation %s to %s", rot.ID, nodeID)
+	return &rotationInstruction{ID: rot.ID, OverlapSeconds: rot.OverlapSeconds}
+}
+
+// handleRotations lists rotation history (GET, filter by node and status) or
+// schedules a rotation (POST) for one node (?node=ID) or the whole fleet
+// (?all=true). The overlap defaults to 10m; ?at=RFC3339 delays the start.
+func (api *APIServer) handleRotations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	switch r.Method {
+	case "GET":
+		status := q.Get("status")
+		switch status {
+		case "", storage.RotationPending, storage.RotationSent, storage.RotationConfirmed, storage.RotationFailed:
+		default:
+			writeJSONError(w, http.StatusBadRequest, "status must be pending, sent, confirmed or failed")
+			return
+		}
+
+		rotations, err := api.storage.ListRotations(q.Get("node"), status, 100)
+		if err != nil {
+			log.Printf("[-] Failed to list rotations: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rotations": rotations,
+			"count":     len(rotations),
+		})
+
+	case "POST":
+		overlap := defaultRotationOverlap
+		if raw := q.Get("overlap"); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 || parsed > maxRotationOverlap {
+				writeJSONError(w, http.StatusBadRequest, "overlap must be a duration between 0s and 24h")
+				return
+			}
+			overlap = parsed
+		}
+
+		notBefore := time.Now()
+		if raw := q.Get("at"); raw != "" {
+			parsed, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "at must be an RFC 3339 timestamp")
+				return
+			}
+			notBefore = parsed
+		}
+
+		requestedBy := ""
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			requestedBy = key.ID
+		}
+
+		nodeID := q.Get("node")
+		all, _ := strconv.ParseBool(q.Get("all"))
+		if (nodeID == "") == !all {
+			writeJSONError(w, http.StatusBadRequest, "pass either node=ID or all=true")
+			return
+		}
+
+		if all {
+			rotations, skipped, err := api.storage.ScheduleFleetRotation(requestedBy, overlap, notBefore)
+			if err != nil {
+				log.Printf("[-] Failed to schedule fleet rotation: %v", err)
+				writeJSONError(w, http.StatusInternalServerError, "storage error")
+				return
+			}
+
+			log.Printf("[+] Scheduled credential rotation for %d nodes (%d already rotating)", len(rotations), skipped)
+			auditNodes(r, rotationNodeIDs(rotations)...)
+			auditDetail(r, "scheduled fleet credential rotation")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"rotations": rotations,
+				"count":     len(rotations),
+				"skipped":   skipped,
+			})
+			return
+		}
+
+		// An exit's credentials are its host's, so the host rotates them
+		node, err := api.storage.GetNode(nodeID)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "node not found")
+			return
+		}
+		nodeID = hostOf(node)
+
+		rot, err := api.storage.ScheduleRotation(nodeID, requestedBy, overlap, notBefore)
+		if err == storage.ErrRotationInProgress {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("[-] Failed to schedule rotation: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "storage error")
+			return
+		}
+
+		log.Printf("[+] Scheduled credential rotation %s for %s", rot.ID, nodeID)
+		auditNodes(r, nodeID)
+		auditDetail(r, "scheduled credential rotation "+rot.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rot)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func rotationNodeIDs(rotations []storage.CredentialRotation) []string {
+	ids := make([]string, len(rotations))
+	for i, rot := range rotations {
+		ids[i] = rot.NodeID
+	}
+	return ids
+}
+
+type confirmRotationRequest struct {
+	RotationID string `json:"rotation_id"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Error      string `json:"error,omitempty"`
+	Seq        int64  `json:"seq"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// handleConfirmRotation is called by an agent once its new credentials work
+// on the SOCKS backend, or with an error if it could not apply them. Only
+// then does the controller hand out the new credentials.
+func (api *APIServer) handleConfirmRotation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req confirmRotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	// Sharing the heartbeat sequence keeps a captured confirmation from
+	// being replayed
+	nodeID := nodeIDFromContext(r.Context())
+	if !api.checkHeartbeatFreshness(w, r, nodeID, req.Seq, req.Timestamp) {
+		return
+	}
+	auditNodes(r, nodeID)
+
+	var err error
+	if req.Error != "" {
+		err = api.storage.FailRotation(req.RotationID, nodeID, req.Error)
+	} else if req.Username == "" || req.Password == "" {
+		writeJSONError(w, http.StatusBadRequest, "username and password are required")
+		return
+	} else {
+		err = api.storage.ConfirmRotation(req.RotationID, nodeID, req.Username, req.Password)
+	}
+	if err == storage.ErrRotationNotFound {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("[-] Failed to complete rotation %s: %v", req.RotationID, err)
+		writeJSONError(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+
+	status := storage.RotationConfirmed
+	if req.Error != "" {
+		status = storage.RotationFailed
+		log.Printf("[-] Node %s failed credential rotation %s: %s", nodeID, req.RotationID, req.Error)
+	} else {
+		log.Printf("[+] Node %s confirmed credential rotation %s", nodeID, req.RotationID)
+	}
+	auditDetail(r, "credential rotation "+req.RotationID+" "+status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status, "rotation_id": req.RotationID})
+}
@@ -0,0 +1,46 @@
+// cmd/api/selfcheck.go
+package main
+
+import (
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// selfCheckOK is the status of a node whose SOCKS service passed the agent's
+// own handshake, authentication and CONNECT check
+const selfCheckOK = "ok"
+
+// selfCheckResult is the agent's report of its last SOCKS self-check
+type selfCheckResult struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+// applySelfCheck copies a heartbeat's self-check onto the node. Agents that
+// predate the check send none and are left unknown rather than failed.
+func applySelfCheck(node *storage.ProxyNode, result *selfCheckResult) {
+	if result == nil {
+		return
+	}
+	node.SelfCheck = result.Status
+	node.SelfCheckError = result.Error
+	node.SelfCheckLatencyMs = result.LatencyMs
+}
+
+// selfCheckPassing reports whether the node's last self-check succeeded,
+// or it runs an agent without the check
+func selfCheckPassing(node *storage.ProxyNode) bool {
+	return node.SelfCheck == "" || node.SelfCheck == selfCheckOK
+}
+
+// excludeUnavailable drops nodes whose last self-check failed and nodes
+// that are draining
+func excludeUnavailable(nodes []storage.ProxyNode) []storage.ProxyNode {
+	var out []storage.ProxyNode
+	for _, node := range nodes {
+		if selfCheckPassing(&node) && !node.Draining {
+			out = append(out, node)
+		}
+	}
+	return out
+}
@@ -0,0 +1,163 @@
+// cmd/api/verify.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Skillz147/TrinityProxy/internal/mmdb"
+	"github.com/Skillz147/TrinityProxy/internal/storage"
+)
+
+// defaultTrustedProxies covers NGINX on the same host, as set up by
+// scripts/setup_api.sh
+const defaultTrustedProxies = "127.0.0.1,::1"
+
+// Mismatch reasons stored on a node
+const (
+	mismatchIP      = "ip"
+	mismatchCountry = "country"
+)
+
+// configureVerification loads the trusted proxy list and, if configured, the
+// geo database used to check what agents report
+func (api *APIServer) configureVerification(cfg *controllerConfig) error {
+	for _, entry := range cfg.TrustedProxies {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		api.trustedProxies = append(api.trustedProxies, network)
+	}
+
+	if cfg.GeoDatabase != "" {
+		db, err := mmdb.Open(cfg.GeoDatabase)
+		if err != nil {
+			return err
+		}
+		api.geo = db
+		log.Printf("[*] Verifying node locations with %s (%s)", cfg.GeoDatabase, db.Metadata.DatabaseType)
+	}
+	return nil
+}
+
+func (api *APIServer) isTrustedProxy(ip net.IP) bool {
+	for _, network := range api.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from. Connections from a
+// trusted proxy are attributed to the right-most X-Forwarded-For entry that
+// is not itself a trusted proxy; entries further left are client-supplied
+// and ignored.
+func (api *APIServer) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !api.isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !api.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+// verifyNode records the controller's own view of a node: the address the
+// heartbeat came from and, with a geo database, where that address is.
+// Heartbeats from private or loopback addresses cannot be checked, so they
+// are never flagged.
+func (api *APIServer) verifyNode(node *storage.ProxyNode, observed string) {
+	node.ObservedIP = observed
+
+	ip := net.ParseIP(observed)
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return
+	}
+
+	// The heartbeat may arrive over either of the node's reported addresses
+	var mismatch []string
+	reportedV4, reportedV6 := net.ParseIP(node.IP), net.ParseIP(node.IPv6)
+	if !ip.Equal(reportedV4) && !ip.Equal(reportedV6) {
+		mismatch = append(mismatch, mismatchIP)
+	}
+
+	if api.geo != nil {
+		city, found, err := api.geo.LookupCity(ip)
+		switch {
+		case err != nil:
+			log.Printf("[-] Geo lookup for %s failed: %v", observed, err)
+		case found:
+			node.VerifiedCountry = city.Country
+			if node.VerifiedCountry == "" {
+				node.VerifiedCountry = city.CountryCode
+			}
+			node.VerifiedRegion = city.Region
+			node.VerifiedCity = city.City
+
+			// Agents report a country name or an ISO code depending on
+			// their geo provider; either is accepted
+			if node.Country != "" && !strings.EqualFold(node.Country, city.Country) && !strings.EqualFold(node.Country, city.CountryCode) {
+				mismatch = append(mismatch, mismatchCountry)
+			}
+		}
+	}
+
+	node.Mismatch = strings.Join(mismatch, ",")
+}
+
+// filterByMismatch applies the mismatch query parameter: "false" keeps only
+// nodes whose reports were not contradicted, "true" only flagged nodes. The
+// second result is false when the parameter is invalid.
+func filterByMismatch(nodes []storage.ProxyNode, param string) ([]storage.ProxyNode, bool) {
+	if param == "" {
+		return nodes, true
+	}
+
+	var flagged bool
+	switch param {
+	case "true":
+		flagged = true
+	case "false":
+	default:
+		return nil, false
+	}
+
+	var out []storage.ProxyNode
+	for _, node := range nodes {
+		if (node.Mismatch != "") == flagged {
+			out = append(out, node)
+		}
+	}
+	return out, true
+}
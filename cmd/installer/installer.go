@@ -5,24 +5,36 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"math/big"
-	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
-	"text/template"
+
+	"github.com/Skillz147/TrinityProxy/internal/dante"
+	"github.com/Skillz147/TrinityProxy/internal/netinfo"
+	"github.com/Skillz147/TrinityProxy/internal/policy"
 )
 
 const (
-	serviceName  = "trinityproxy"
-	confPath     = "/etc/danted.conf"
+	serviceName  = dante.ServiceName
+	confPath     = dante.ConfPath
 	usernamePath = "/etc/trinityproxy-username"
 	passwordPath = "/etc/trinityproxy-password"
 	portPath     = "/etc/trinityproxy-port"
+	backendPath  = "/etc/trinityproxy-backend"
 	serviceFile  = "/etc/systemd/system/trinityproxy.service"
-	danteUser    = "nobody"
+	agentService = "trinityproxy-agent"
+	danteUser    = dante.User
+)
+
+// SOCKS backends: Dante as its own service, or the agent's built-in server
+const (
+	backendDante  = "dante"
+	backendNative = "native"
 )
 
 // Generate secure hex string
@@ -46,83 +58,6 @@ func getRandomPort() int {
 	return int(start + n.Int64())
 }
 
-// detectPrimaryInterface finds the primary network interface
-func detectPrimaryInterface() string {
-	// Method 1: Use ip route to find default gateway interface
-	cmd := exec.Command("ip", "route", "show", "default")
-	output, err := cmd.Output()
-	if err == nil {
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			if strings.Contains(line, "default via") {
-				fields := strings.Fields(line)
-				for i, field := range fields {
-					if field == "dev" && i+1 < len(fields) {
-						iface := fields[i+1]
-						fmt.Printf("[*] Detected primary interface: %s (via ip route)\n", iface)
-						return iface
-					}
-				}
-			}
-		}
-	}
-
-	// Method 2: Find interface with default route using route command
-	cmd = exec.Command("route", "-n")
-	output, err = cmd.Output()
-	if err == nil {
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			if strings.HasPrefix(line, "0.0.0.0") {
-				fields := strings.Fields(line)
-				if len(fields) >= 8 {
-					iface := fields[7]
-					fmt.Printf("[*] Detected primary interface: %s (via route)\n", iface)
-					return iface
-				}
-			}
-		}
-	}
-
-	// Method 3: Use Go's net package to find interface with global unicast address
-	interfaces, err := net.Interfaces()
-	if err == nil {
-		for _, iface := range interfaces {
-			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
-				addrs, err := iface.Addrs()
-				if err == nil {
-					for _, addr := range addrs {
-						if ipnet, ok := addr.(*net.IPNet); ok {
-							if ipnet.IP.IsGlobalUnicast() && ipnet.IP.To4() != nil {
-								fmt.Printf("[*] Detected primary interface: %s (via Go net)\n", iface.Name)
-								return iface.Name
-							}
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Method 4: Check common interface names
-	commonNames := []string{"ens5", "ens3", "enp0s3", "enp0s5", "eth0", "ens160"}
-	for _, name := range commonNames {
-		if _, err := os.Stat("/sys/class/net/" + name); err == nil {
-			// Check if interface is up
-			cmd := exec.Command("ip", "link", "show", name)
-			output, err := cmd.Output()
-			if err == nil && strings.Contains(string(output), "state UP") {
-				fmt.Printf("[*] Detected primary interface: %s (fallback check)\n", name)
-				return name
-			}
-		}
-	}
-
-	// Final fallback
-	fmt.Printf("[!] Could not detect interface, using fallback: eth0\n")
-	return "eth0"
-}
-
 func generateCredentials() (string, string, int) {
 	username := "u_" + GenerateRandomString(4)
 	password := GenerateRandomString(12)
@@ -135,60 +70,97 @@ func generateCredentials() (string, string, int) {
 	return username, password, port
 }
 
-func writeDanteConf(username, password string, port int) error {
-	danteInterface := detectPrimaryInterface()
-
-	conf := `# Dante SOCKS5 Server Configuration
+// writeProxyConf saves what the agent needs to reconfigure the SOCKS
+// service later and, for Dante, writes danted.conf
+func writeProxyConf(port int, p *policy.Policy, backend string) error {
+	danteInterface := netinfo.PrimaryInterface()
 
-logoutput: /var/log/danted.log
-internal: {{.Interface}} port = {{.Port}}
-external: {{.Interface}}
-
-# Support both username authentication and no authentication
-socksmethod: username none
-user.notprivileged: {{.User}}
+	// Saved so the agent can re-render the config when a new policy arrives
+	if err := os.WriteFile(dante.InterfacePath, []byte(danteInterface), 0644); err != nil {
+		return err
+	}
+	if err := p.Save(policy.DefaultPath); err != nil {
+		return err
+	}
 
-client pass {
-  from: 0.0.0.0/0 to: 0.0.0.0/0
-  log: connect disconnect
+	conf := &dante.Config{
+		Interface: danteInterface,
+		Port:      port,
+		User:      danteUser,
+		Policy:    p,
+		IPv6:      netinfo.HasPublicIPv6(danteInterface),
+	}
+	if conf.IPv6 {
+		fmt.Printf("[*] %s has a public IPv6 address, enabling IPv6 rules\n", danteInterface)
+	}
+	conf.Exits = netinfo.ExitAddrs(danteInterface, conf.IPv6)
+	if len(conf.Exits) > 0 {
+		fmt.Printf("[*] %s has %d public addresses, serving each as its own exit: %s\n",
+			danteInterface, len(conf.Exits), strings.Join(conf.Exits, ", "))
+	}
+	if err := dante.SaveExits(conf.Exits); err != nil {
+		return err
+	}
+	if backend == backendNative {
+		return nil
+	}
+	return conf.WriteFile(confPath)
 }
 
-# Allow authenticated connections
-socks pass {
-  from: 0.0.0.0/0 to: 0.0.0.0/0
-  protocol: tcp udp
-  command: connect
-  log: connect disconnect
-  socksmethod: username
+// installedBackend returns the backend set up by an earlier install, or
+// Dante if there was none
+func installedBackend() string {
+	if data, err := os.ReadFile(backendPath); err == nil && strings.TrimSpace(string(data)) == backendNative {
+		return backendNative
+	}
+	return backendDante
 }
 
-# Allow anonymous connections
-socks pass {
-  from: 0.0.0.0/0 to: 0.0.0.0/0
-  protocol: tcp udp
-  command: connect
-  log: connect disconnect
-  socksmethod: none
-}
-`
-	tmpl, err := template.New("danted").Parse(conf)
+// loadPolicy starts from the policy saved by a previous install (or the
+// default) and applies any command-line overrides
+func loadPolicy() (*policy.Policy, error) {
+	p, err := policy.Load(policy.DefaultPath)
 	if err != nil {
-		return err
+		p = policy.Default()
 	}
 
-	file, err := os.Create(confPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	allowClients := flag.String("allow-clients", "", "comma-separated client CIDRs allowed to connect (default: keep current or 0.0.0.0/0,::/0)")
+	blockPorts := flag.String("block-ports", "", "comma-separated destination ports to block (default: keep current or 25)")
+	blockCIDRs := flag.String("block-cidrs", "", "comma-separated extra destination CIDRs to block")
+	allowPrivate := flag.Bool("allow-private", !p.BlockPrivateDestinations, "allow connections to private and link-local destinations")
+	blockLocal := flag.Bool("block-local", p.BlockLocalClients, "apply the allowed client CIDRs to connections from this host too")
+	flag.Parse()
 
-	data := map[string]interface{}{
-		"Interface": danteInterface,
-		"Port":      port,
-		"User":      danteUser,
+	if *allowClients != "" {
+		p.AllowedClientCIDRs = splitList(*allowClients)
+	}
+	if *blockPorts != "" {
+		p.BlockedDestinationPorts = nil
+		for _, item := range splitList(*blockPorts) {
+			port, err := strconv.Atoi(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", item)
+			}
+			p.BlockedDestinationPorts = append(p.BlockedDestinationPorts, port)
+		}
 	}
+	if *blockCIDRs != "" {
+		p.BlockedDestinationCIDRs = splitList(*blockCIDRs)
+	}
+	p.BlockPrivateDestinations = !*allowPrivate
+	p.BlockLocalClients = *blockLocal
+
+	return p, p.Validate()
+}
 
-	return tmpl.Execute(file, data)
+func splitList(val string) []string {
+	var out []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
 }
 
 func findDanteBinary() string {
@@ -239,23 +211,25 @@ WantedBy=multi-user.target
 
 func createSystemUser(username, password string) error {
 	// Create system user for SOCKS authentication
-	cmd := exec.Command("useradd", "-r", "-s", "/bin/false", username)
-	if err := cmd.Run(); err != nil {
-		// User might already exist, that's okay
-		fmt.Printf("[*] User %s might already exist: %v\n", username, err)
-	}
-
-	// Set password for the user
-	cmd = exec.Command("chpasswd")
-	cmd.Stdin = strings.NewReader(username + ":" + password)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set password for user %s: %v", username, err)
+	if err := dante.CreateUser(username, password); err != nil {
+		return err
 	}
 
 	fmt.Printf("[+] Created system user: %s\n", username)
 	return nil
 }
 
+// stopDanteService disables a Dante service left by an earlier install, so
+// the agent can take over SOCKS
+func stopDanteService() {
+	if _, err := os.Stat(serviceFile); err != nil {
+		return
+	}
+	if err := exec.Command("systemctl", "disable", "--now", serviceName).Run(); err == nil {
+		fmt.Printf("[*] Stopped and disabled %s (Dante)\n", serviceName)
+	}
+}
+
 func reloadAndStartService() {
 	exec.Command("systemctl", "daemon-reexec").Run()
 	exec.Command("systemctl", "daemon-reload").Run()
@@ -266,22 +240,56 @@ func reloadAndStartService() {
 func main() {
 	fmt.Println("[+] Setting up TrinityProxy SOCKS5 service...")
 
-	username, password, port := generateCredentials()
-
-	if err := writeDanteConf(username, password, port); err != nil {
-		log.Fatalf("[-] Failed to write danted.conf: %v", err)
+	// Parsed along with the policy flags
+	backendFlag := flag.String("backend", "", "SOCKS server: dante, or native to serve from the agent process (default: keep current or dante)")
+	accessPolicy, err := loadPolicy()
+	if err != nil {
+		log.Fatalf("[-] Invalid access policy: %v", err)
 	}
 
-	if err := createSystemUser(username, password); err != nil {
-		log.Fatalf("[-] Failed to create system user: %v", err)
+	previousBackend := installedBackend()
+	backend := *backendFlag
+	if backend == "" {
+		backend = previousBackend
+	}
+	if backend != backendDante && backend != backendNative {
+		log.Fatalf("[-] Unknown backend %q, expected %s or %s", backend, backendDante, backendNative)
 	}
 
-	if err := writeSystemdService(); err != nil {
-		log.Fatalf("[-] Failed to write systemd service: %v", err)
+	username, password, port := generateCredentials()
+
+	if err := writeProxyConf(port, accessPolicy, backend); err != nil {
+		log.Fatalf("[-] Failed to write proxy configuration: %v", err)
+	}
+	if err := os.WriteFile(backendPath, []byte(backend), 0644); err != nil {
+		log.Fatalf("[-] Failed to record backend: %v", err)
 	}
 
-	reloadAndStartService()
-	fmt.Printf("[+] TrinityProxy SOCKS5 is live on port %d\n", port)
+	if backend == backendNative {
+		// The agent serves SOCKS itself with the credentials in memory, so
+		// neither Dante nor a system user is needed
+		stopDanteService()
+		exec.Command("systemctl", "try-restart", agentService).Run()
+		fmt.Printf("[+] TrinityProxy SOCKS5 will be served by the agent on port %d\n", port)
+	} else {
+		if err := createSystemUser(username, password); err != nil {
+			log.Fatalf("[-] Failed to create system user: %v", err)
+		}
+
+		if err := writeSystemdService(); err != nil {
+			log.Fatalf("[-] Failed to write systemd service: %v", err)
+		}
+
+		reloadAndStartService()
+		if previousBackend == backendNative {
+			// Stops the agent's built-in server from serving the old port
+			exec.Command("systemctl", "try-restart", agentService).Run()
+		}
+		fmt.Printf("[+] TrinityProxy SOCKS5 is live on port %d\n", port)
+	}
 	fmt.Printf("[+] Username: %s\n", username)
 	fmt.Printf("[+] Password: %s\n", password)
+	fmt.Printf("[+] Access policy %s: clients %v, blocked ports %v, private destinations blocked: %v\n",
+		accessPolicy.Version, accessPolicy.AllowedClientCIDRs, accessPolicy.BlockedDestinationPorts,
+		accessPolicy.BlockPrivateDestinations)
 }
@@ -0,0 +1,347 @@
+// internal/agent/commands.go
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/dante"
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+// Command types sent by the controller
+const (
+	commandRestartProxy      = "restart_proxy"
+	commandRotateCredentials = "rotate_credentials"
+	commandReloadPolicy      = "reload_policy"
+	commandDrain             = "drain"
+	commandRunDiagnostics    = "run_diagnostics"
+	commandSetInterval       = "set_heartbeat_interval"
+	commandUpdateAgent       = "update_agent"
+)
+
+// command is an instruction from a heartbeat response
+type command struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// commandAck reports a command's outcome on the next heartbeat
+type commandAck struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// commandState is kept in conf.CommandStatePath so a restarted agent still
+// delivers outcomes it had not sent and does not run a command again: the
+// controller resends a command until it is acknowledged.
+type commandState struct {
+	PendingAcks []commandAck         `json:"pending_acks"`
+	Executed    map[string]time.Time `json:"executed"`
+}
+
+// executedTTL is how long the ID of a command already run is remembered once
+// its outcome has been delivered
+const executedTTL = 7 * 24 * time.Hour
+
+// commands holds the state, loaded on first use. Guarded by acksMu.
+var (
+	acksMu   sync.Mutex
+	commands *commandState
+)
+
+// loadCommands reads the state file if it has not been read yet. Called
+// with acksMu held.
+func loadCommands() *commandState {
+	if commands != nil {
+		return commands
+	}
+	commands = &commandState{Executed: make(map[string]time.Time)}
+
+	data, err := os.ReadFile(conf.CommandStatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[-] Commands: %v", err)
+		}
+		return commands
+	}
+	if err := json.Unmarshal(data, commands); err != nil {
+		log.Printf("[-] Commands: corrupt state %s: %v", conf.CommandStatePath, err)
+	}
+	if commands.Executed == nil {
+		commands.Executed = make(map[string]time.Time)
+	}
+	return commands
+}
+
+// save writes the state through a temporary file, first forgetting commands
+// delivered more than executedTTL ago. Called with acksMu held.
+func (c *commandState) save() {
+	pending := make(map[string]bool, len(c.PendingAcks))
+	for _, ack := range c.PendingAcks {
+		pending[ack.ID] = true
+	}
+	for id, ran := range c.Executed {
+		if !pending[id] && time.Since(ran) > executedTTL {
+			delete(c.Executed, id)
+		}
+	}
+
+	if err := writeCommandState(c); err != nil {
+		log.Printf("[-] Commands: failed to save %s: %v", conf.CommandStatePath, err)
+	}
+}
+
+func writeCommandState(c *commandState) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(conf.CommandStatePath), ".trinityproxy-commands-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), conf.CommandStatePath)
+}
+
+// unsentAcks returns the acknowledgements to include in a heartbeat
+func unsentAcks() []commandAck {
+	acksMu.Lock()
+	defer acksMu.Unlock()
+	return append([]commandAck(nil), loadCommands().PendingAcks...)
+}
+
+// ackDelivered drops acknowledgements the controller has accepted
+func ackDelivered(delivered []commandAck) {
+	if len(delivered) == 0 {
+		return
+	}
+	acksMu.Lock()
+	defer acksMu.Unlock()
+
+	sent := make(map[string]bool, len(delivered))
+	for _, ack := range delivered {
+		sent[ack.ID] = true
+	}
+	c := loadCommands()
+	kept := c.PendingAcks[:0]
+	for _, ack := range c.PendingAcks {
+		if !sent[ack.ID] {
+			kept = append(kept, ack)
+		}
+	}
+	c.PendingAcks = kept
+	c.save()
+}
+
+// queueAck adds an outcome to send on the next heartbeat and records the
+// command as run
+func queueAck(ack commandAck) {
+	acksMu.Lock()
+	defer acksMu.Unlock()
+
+	c := loadCommands()
+	c.PendingAcks = append(c.PendingAcks, ack)
+	c.Executed[ack.ID] = time.Now()
+	c.save()
+}
+
+// alreadyRun reports whether a command has run, whether or not its outcome
+// has been delivered
+func alreadyRun(id string) bool {
+	acksMu.Lock()
+	defer acksMu.Unlock()
+	_, ok := loadCommands().Executed[id]
+	return ok
+}
+
+// runCommands executes commands in order and queues their outcomes
+func runCommands(id *Identity, commands []command) {
+	for _, cmd := range commands {
+		if alreadyRun(cmd.ID) {
+			continue
+		}
+
+		log.Printf("[*] Running command %s (%s)", cmd.ID, cmd.Type)
+		ack := commandAck{ID: cmd.ID, Status: "succeeded"}
+		result, err := runCommand(id, &cmd)
+		if err == errAckDeferred {
+			continue
+		}
+		if err != nil {
+			log.Printf("[-] Command %s (%s) failed: %v", cmd.ID, cmd.Type, err)
+			ack.Status = "failed"
+			ack.Error = err.Error()
+		}
+		if result != nil {
+			if ack.Result, err = json.Marshal(result); err != nil {
+				ack.Result = nil
+			}
+		}
+
+		queueAck(ack)
+	}
+}
+
+func runCommand(id *Identity, cmd *command) (interface{}, error) {
+	switch cmd.Type {
+	case commandRestartProxy:
+		return nil, restartProxy()
+
+	case commandRotateCredentials:
+		var instr rotationInstruction
+		if err := json.Unmarshal(cmd.Args, &instr); err != nil || instr.ID == "" {
+			return nil, fmt.Errorf("rotate_credentials needs a rotation ID")
+		}
+		return nil, startRotation(id, &instr)
+
+	case commandReloadPolicy:
+		p, err := policy.Load(conf.PolicyPath)
+		if err != nil {
+			p = policy.Default()
+		}
+		return nil, applyPolicy(p)
+
+	case commandDrain:
+		var args struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.Unmarshal(cmd.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid drain args: %w", err)
+		}
+		return nil, setDraining(args.Enabled)
+
+	case commandRunDiagnostics:
+		return runDiagnostics(), nil
+
+	case commandSetInterval:
+		var args struct {
+			Interval string `json:"interval"`
+		}
+		if err := json.Unmarshal(cmd.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid interval args: %w", err)
+		}
+		interval, err := time.ParseDuration(args.Interval)
+		if err != nil || interval < 10*time.Second {
+			return nil, fmt.Errorf("heartbeat interval must be at least 10s, got %q", args.Interval)
+		}
+		conf.HeartbeatInterval.Duration = interval
+		log.Printf("[+] Heartbeat interval set to %s until restart", interval)
+		return nil, nil
+
+	case commandUpdateAgent:
+		var instr updateInstruction
+		if err := json.Unmarshal(cmd.Args, &instr); err != nil || instr.Version == "" {
+			return nil, fmt.Errorf("update_agent needs a release version")
+		}
+		return installUpdate(id, cmd.ID, &instr)
+
+	default:
+		return nil, fmt.Errorf("unknown command type %q", cmd.Type)
+	}
+}
+
+func restartProxy() error {
+	if proxyBackend() == backendNative {
+		return restartNativeProxy()
+	}
+	if out, err := exec.Command("systemctl", "restart", dante.ServiceName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restart %s: %v: %s", dante.ServiceName, err, out)
+	}
+	log.Printf("[+] Restarted %s", dante.ServiceName)
+	return nil
+}
+
+// isDraining reports whether the node has been told to stop taking new
+// clients. The marker file keeps the state across agent restarts.
+func isDraining() bool {
+	_, err := os.Stat(conf.DrainPath)
+	return err == nil
+}
+
+func setDraining(enabled bool) error {
+	if !enabled {
+		if err := os.Remove(conf.DrainPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Println("[+] Drain ended, accepting new clients")
+		return nil
+	}
+	if err := os.WriteFile(conf.DrainPath, []byte(time.Now().Format(time.RFC3339)), 0600); err != nil {
+		return err
+	}
+	log.Println("[*] Draining: existing clients keep working, no new ones are assigned")
+	return nil
+}
+
+// diagnostics is the result of run_diagnostics
+type diagnostics struct {
+	ServiceState      string           `json:"service_state"`
+	SelfCheck         *SelfCheckResult `json:"self_check,omitempty"`
+	Metrics           *HostMetrics     `json:"metrics,omitempty"`
+	PolicyVersion     string           `json:"policy_version"`
+	HeartbeatInterval string           `json:"heartbeat_interval"`
+	Draining          bool             `json:"draining"`
+	Errors            []string         `json:"errors,omitempty"`
+}
+
+// runDiagnostics gathers what an operator would check first on a node that
+// is misbehaving
+func runDiagnostics() *diagnostics {
+	d := &diagnostics{
+		PolicyVersion:     currentPolicyVersion(),
+		HeartbeatInterval: conf.HeartbeatInterval.String(),
+		Draining:          isDraining(),
+	}
+
+	d.ServiceState = proxyServiceState()
+
+	username, userErr := readFile(conf.UsernamePath)
+	password, passErr := readFile(conf.PasswordPath)
+	var port int
+	portStr, portErr := readFile(conf.PortPath)
+	if portErr == nil {
+		port, portErr = strconv.Atoi(portStr)
+	}
+	for _, err := range []error{userErr, passErr, portErr} {
+		if err != nil {
+			d.Errors = append(d.Errors, err.Error())
+		}
+	}
+	if len(d.Errors) == 0 {
+		// The last known addresses pick the target, as in a heartbeat
+		var addrs publicAddrs
+		target := conf.SelfCheckTarget
+		if cache := loadGeoCache(); cache != nil && cache.IP != "" {
+			addrs = cachedAddrs(cache)
+			target = addrs.selfCheckTarget()
+		}
+		d.SelfCheck = runSelfCheck(port, username, password, target, checkAddr(dante.LoadExits(), addrs))
+		d.Metrics = collectMetrics(port)
+	}
+	return d
+}
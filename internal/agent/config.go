@@ -0,0 +1,497 @@
+// internal/agent/config.go
+
+package agent
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+	"github.com/Skillz147/TrinityProxy/internal/release"
+)
+
+// DefaultConfigPath is read if it exists. A missing file means defaults.
+const DefaultConfigPath = "/etc/trinityproxy-agent.json"
+
+// Duration is a time.Duration written as a string such as "60s" in the
+// config file
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("durations are strings such as \"60s\"")
+	}
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// Config holds the agent's settings. Values come from the config file, then
+// TRINITY_* environment variables, then command-line flags, each overriding
+// the one before. The credential, port and policy paths must match where
+// the installer wrote them.
+type Config struct {
+	// Overrides the controller URL saved at enrollment. With several, the
+	// agent fails over between them in order.
+	ControllerURLs []string `json:"controller_urls,omitempty"`
+
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	RequestTimeout    Duration `json:"request_timeout"`
+	LookupTimeout     Duration `json:"lookup_timeout"`
+
+	// Failed heartbeats are retried after a jittered delay that doubles from
+	// RetryMin up to RetryMax
+	RetryMin Duration `json:"retry_min"`
+	RetryMax Duration `json:"retry_max"`
+
+	IdentityPath      string `json:"identity_path"`
+	UsernamePath      string `json:"username_path"`
+	PasswordPath      string `json:"password_path"`
+	PortPath          string `json:"port_path"`
+	PolicyPath        string `json:"policy_path"`
+	SequencePath      string `json:"sequence_path"`
+	CommandStatePath  string `json:"command_state_path"`
+	RotationStatePath string `json:"rotation_state_path"`
+	DrainPath         string `json:"drain_path"`
+
+	// The installer records the SOCKS backend here: "dante", or "native"
+	// for the server built into the agent
+	BackendPath string `json:"backend_path"`
+
+	// Heartbeats that cannot reach any controller are spooled to SpoolPath
+	// and backfilled once one is reachable. SpoolLimit caps the spool at
+	// that many of the newest heartbeats; 0 disables it.
+	SpoolPath  string `json:"spool_path"`
+	SpoolLimit int    `json:"spool_limit"`
+
+	// The public IP is asked of every HTTP echo endpoint (which return the
+	// caller's address as text), every STUN server and the primary
+	// interface. PublicIPQuorum of them must agree. IPv6 is detected too
+	// unless DetectIPv6 is off.
+	PublicIPURLs   []string `json:"public_ip_urls"`
+	STUNServers    []string `json:"stun_servers"`
+	PublicIPQuorum int      `json:"public_ip_quorum"`
+	DetectIPv6     bool     `json:"detect_ipv6"`
+
+	// Deprecated: the single echo endpoint of older configs, added to
+	// PublicIPURLs when set
+	PublicIPURL string `json:"public_ip_url,omitempty"`
+
+	// Geo providers are tried in order: "mmdb" for the offline database at
+	// GeoDatabase, or one of the HTTP services "ipapi.co", "ip-api.com" and
+	// "ipinfo.io". GeoTokens holds API tokens keyed by HTTP provider name.
+	GeoProviders []string          `json:"geo_providers"`
+	GeoTokens    map[string]string `json:"geo_tokens,omitempty"`
+	GeoDatabase  string            `json:"geo_database,omitempty"`
+
+	// The resolved location is cached here and only looked up again when the
+	// public IP changes or the entry is older than GeoCacheTTL
+	GeoCachePath string   `json:"geo_cache_path"`
+	GeoCacheTTL  Duration `json:"geo_cache_ttl"`
+
+	// Each heartbeat first checks the local SOCKS service end to end with a
+	// CONNECT to SelfCheckTarget (host:port) through it. Nodes without IPv4
+	// egress connect to SelfCheckTargetIPv6 instead.
+	SelfCheckTarget     string   `json:"self_check_target"`
+	SelfCheckTargetIPv6 string   `json:"self_check_target_ipv6"`
+	SelfCheckTimeout    Duration `json:"self_check_timeout"`
+
+	// PEM bundle trusted for the controller in addition to the system roots,
+	// for controllers behind a proxy with a private CA. Not used once the
+	// agent holds a client certificate from the controller's embedded CA.
+	CAFile string `json:"ca_file,omitempty"`
+
+	// Agent releases must be signed with ReleasePublicKey (base64 Ed25519),
+	// which overrides the key received at enrollment. An installed release
+	// that has not sent a heartbeat within UpdateDeadline is rolled back.
+	ReleasePublicKey string   `json:"release_public_key,omitempty"`
+	UpdateStatePath  string   `json:"update_state_path"`
+	UpdateDeadline   Duration `json:"update_deadline"`
+
+	roots        *x509.CertPool
+	geoProviders []GeoProvider
+}
+
+// DefaultConfig returns the settings the agent uses without a config file
+func DefaultConfig() *Config {
+	return &Config{
+		HeartbeatInterval: Duration{60 * time.Second},
+		RequestTimeout:    Duration{10 * time.Second},
+		LookupTimeout:     Duration{10 * time.Second},
+		RetryMin:          Duration{2 * time.Second},
+		RetryMax:          Duration{60 * time.Second},
+
+		IdentityPath:      "/etc/trinityproxy-identity.json",
+		UsernamePath:      "/etc/trinityproxy-username",
+		PasswordPath:      "/etc/trinityproxy-password",
+		PortPath:          "/etc/trinityproxy-port",
+		PolicyPath:        policy.DefaultPath,
+		SequencePath:      "/etc/trinityproxy-heartbeat-seq",
+		CommandStatePath:  "/etc/trinityproxy-commands.json",
+		RotationStatePath: "/etc/trinityproxy-rotation.json",
+		DrainPath:         "/etc/trinityproxy-drain",
+		BackendPath:       "/etc/trinityproxy-backend",
+
+		SpoolPath:  "/etc/trinityproxy-spool.jsonl",
+		SpoolLimit: 1440,
+
+		PublicIPURLs:   []string{"https://api64.ipify.org", "https://icanhazip.com", "https://ifconfig.co/ip"},
+		STUNServers:    []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"},
+		PublicIPQuorum: 2,
+		DetectIPv6:     true,
+
+		GeoProviders: []string{"ipapi.co", "ip-api.com", "ipinfo.io"},
+		GeoCachePath: "/etc/trinityproxy-geo-cache.json",
+		GeoCacheTTL:  Duration{24 * time.Hour},
+
+		SelfCheckTarget:     "1.1.1.1:443",
+		SelfCheckTargetIPv6: "[2606:4700:4700::1111]:443",
+		SelfCheckTimeout:    Duration{10 * time.Second},
+
+		UpdateStatePath: "/etc/trinityproxy-update.json",
+		UpdateDeadline:  Duration{5 * time.Minute},
+	}
+}
+
+// conf is the configuration in effect, replaced by Configure
+var conf = DefaultConfig()
+
+// Configure makes c the configuration used by the agent
+func Configure(c *Config) {
+	conf = c
+}
+
+// setting is one value that can be overridden by environment variable and
+// flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(c *Config, val string) error
+}
+
+func durationSetting(dest func(c *Config) *Duration) func(c *Config, val string) error {
+	return func(c *Config, val string) error {
+		parsed, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		dest(c).Duration = parsed
+		return nil
+	}
+}
+
+func stringSetting(dest func(c *Config) *string) func(c *Config, val string) error {
+	return func(c *Config, val string) error {
+		*dest(c) = val
+		return nil
+	}
+}
+
+func intSetting(dest func(c *Config) *int) func(c *Config, val string) error {
+	return func(c *Config, val string) error {
+		parsed, err := strconv.Atoi(val)
+		if err != nil {
+			return err
+		}
+		*dest(c) = parsed
+		return nil
+	}
+}
+
+func boolSetting(dest func(c *Config) *bool) func(c *Config, val string) error {
+	return func(c *Config, val string) error {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		*dest(c) = parsed
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"controller", "TRINITY_CONTROLLER_URLS", "comma-separated controller URLs (default: the URL used to join)",
+		func(c *Config, val string) error { c.ControllerURLs = splitList(val); return nil }},
+	{"interval", "TRINITY_HEARTBEAT_INTERVAL", "time between heartbeats",
+		durationSetting(func(c *Config) *Duration { return &c.HeartbeatInterval })},
+	{"request-timeout", "TRINITY_REQUEST_TIMEOUT", "timeout for requests to the controller",
+		durationSetting(func(c *Config) *Duration { return &c.RequestTimeout })},
+	{"lookup-timeout", "TRINITY_LOOKUP_TIMEOUT", "timeout for public IP and geo lookups",
+		durationSetting(func(c *Config) *Duration { return &c.LookupTimeout })},
+	{"retry-min", "TRINITY_RETRY_MIN", "first retry delay after a failed heartbeat",
+		durationSetting(func(c *Config) *Duration { return &c.RetryMin })},
+	{"retry-max", "TRINITY_RETRY_MAX", "longest retry delay after repeated failures",
+		durationSetting(func(c *Config) *Duration { return &c.RetryMax })},
+	{"spool-limit", "TRINITY_SPOOL_LIMIT", "most undelivered heartbeats kept for backfill (0 disables)",
+		intSetting(func(c *Config) *int { return &c.SpoolLimit })},
+	{"identity", "TRINITY_IDENTITY_PATH", "enrollment identity file",
+		stringSetting(func(c *Config) *string { return &c.IdentityPath })},
+	{"username-file", "TRINITY_USERNAME_PATH", "SOCKS username file",
+		stringSetting(func(c *Config) *string { return &c.UsernamePath })},
+	{"password-file", "TRINITY_PASSWORD_PATH", "SOCKS password file",
+		stringSetting(func(c *Config) *string { return &c.PasswordPath })},
+	{"port-file", "TRINITY_PORT_PATH", "SOCKS port file",
+		stringSetting(func(c *Config) *string { return &c.PortPath })},
+	{"public-ip-urls", "TRINITY_PUBLIC_IP_URLS", "comma-separated URLs that return this host's public IP as text",
+		func(c *Config, val string) error { c.PublicIPURLs = splitList(val); return nil }},
+	{"public-ip-url", "TRINITY_PUBLIC_IP_URL", "deprecated, use -public-ip-urls; added to the public IP URLs",
+		stringSetting(func(c *Config) *string { return &c.PublicIPURL })},
+	{"stun-servers", "TRINITY_STUN_SERVERS", "comma-separated STUN servers (host:port) used to detect the public IP",
+		func(c *Config, val string) error { c.STUNServers = splitList(val); return nil }},
+	{"public-ip-quorum", "TRINITY_PUBLIC_IP_QUORUM", "number of public IP sources that must agree",
+		intSetting(func(c *Config) *int { return &c.PublicIPQuorum })},
+	{"detect-ipv6", "TRINITY_DETECT_IPV6", "also detect and report an IPv6 egress address",
+		boolSetting(func(c *Config) *bool { return &c.DetectIPv6 })},
+	{"geo-providers", "TRINITY_GEO_PROVIDERS", "comma-separated geo providers, tried in order",
+		func(c *Config, val string) error { c.GeoProviders = splitList(val); return nil }},
+	{"geo-tokens", "TRINITY_GEO_TOKENS", "comma-separated provider=token API tokens for HTTP geo providers",
+		func(c *Config, val string) error {
+			c.GeoTokens = make(map[string]string)
+			for _, pair := range splitList(val) {
+				name, token, ok := strings.Cut(pair, "=")
+				if !ok || name == "" || token == "" {
+					return fmt.Errorf("expected provider=token, got %q", pair)
+				}
+				c.GeoTokens[name] = token
+			}
+			return nil
+		}},
+	{"geo-database", "TRINITY_GEO_DATABASE", "MaxMind-format .mmdb file used by the mmdb geo provider",
+		stringSetting(func(c *Config) *string { return &c.GeoDatabase })},
+	{"geo-cache", "TRINITY_GEO_CACHE_PATH", "file caching the public IP and its location",
+		stringSetting(func(c *Config) *string { return &c.GeoCachePath })},
+	{"geo-cache-ttl", "TRINITY_GEO_CACHE_TTL", "how long a cached location is used for an unchanged IP",
+		durationSetting(func(c *Config) *Duration { return &c.GeoCacheTTL })},
+	{"self-check-target", "TRINITY_SELF_CHECK_TARGET", "host:port the SOCKS self-check connects to through the local proxy",
+		stringSetting(func(c *Config) *string { return &c.SelfCheckTarget })},
+	{"self-check-target-ipv6", "TRINITY_SELF_CHECK_TARGET_IPV6", "self-check target for nodes without IPv4 egress",
+		stringSetting(func(c *Config) *string { return &c.SelfCheckTargetIPv6 })},
+	{"self-check-timeout", "TRINITY_SELF_CHECK_TIMEOUT", "timeout for the SOCKS self-check",
+		durationSetting(func(c *Config) *Duration { return &c.SelfCheckTimeout })},
+	{"ca-file", "TRINITY_CA_FILE", "extra PEM CA bundle trusted for the controller",
+		stringSetting(func(c *Config) *string { return &c.CAFile })},
+	{"release-public-key", "TRINITY_RELEASE_PUBLIC_KEY", "base64 Ed25519 key agent releases must be signed with (default: the key from enrollment)",
+		stringSetting(func(c *Config) *string { return &c.ReleasePublicKey })},
+	{"update-deadline", "TRINITY_UPDATE_DEADLINE", "time a new release has to send a heartbeat before it is rolled back",
+		durationSetting(func(c *Config) *Duration { return &c.UpdateDeadline })},
+}
+
+// LoadConfig builds the configuration from the config file, environment and
+// args (flags such as -interval 30s), then validates it. The file is taken
+// from -config, then TRINITY_AGENT_CONFIG, then DefaultConfigPath.
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	configPath := fs.String("config", "", "agent config file (default "+DefaultConfigPath+")")
+	flagValues := make([]*string, len(settings))
+	for i, s := range settings {
+		flagValues[i] = fs.String(s.flag, "", s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("TRINITY_AGENT_CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		path = DefaultConfigPath
+	}
+
+	c := DefaultConfig()
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(c); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	case os.IsNotExist(err) && !explicit:
+		// No config file, defaults apply
+	default:
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	for i, s := range settings {
+		if val := os.Getenv(s.env); val != "" {
+			if err := s.apply(c, val); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+		if val := *flagValues[i]; val != "" {
+			if err := s.apply(c, val); err != nil {
+				return nil, fmt.Errorf("-%s: %w", s.flag, err)
+			}
+		}
+	}
+
+	if c.PublicIPURL != "" {
+		log.Println("[!] public_ip_url (TRINITY_PUBLIC_IP_URL) is deprecated, use public_ip_urls (TRINITY_PUBLIC_IP_URLS)")
+		if !slices.Contains(c.PublicIPURLs, c.PublicIPURL) {
+			c.PublicIPURLs = append(c.PublicIPURLs, c.PublicIPURL)
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid agent config: %w", err)
+	}
+	return c, nil
+}
+
+// Validate checks every setting and loads the CA file, if any
+func (c *Config) Validate() error {
+	for _, raw := range c.ControllerURLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("controller URL %q must be an http(s) URL", raw)
+		}
+	}
+
+	if c.HeartbeatInterval.Duration < 10*time.Second {
+		return fmt.Errorf("heartbeat_interval must be at least 10s, got %s", c.HeartbeatInterval)
+	}
+	if c.RequestTimeout.Duration <= 0 {
+		return fmt.Errorf("request_timeout must be positive")
+	}
+	if c.LookupTimeout.Duration <= 0 {
+		return fmt.Errorf("lookup_timeout must be positive")
+	}
+	if c.RetryMin.Duration <= 0 || c.RetryMax.Duration < c.RetryMin.Duration {
+		return fmt.Errorf("retry_min must be positive and no larger than retry_max (%s, %s)", c.RetryMin, c.RetryMax)
+	}
+
+	paths := map[string]string{
+		"identity_path":       c.IdentityPath,
+		"username_path":       c.UsernamePath,
+		"password_path":       c.PasswordPath,
+		"port_path":           c.PortPath,
+		"policy_path":         c.PolicyPath,
+		"sequence_path":       c.SequencePath,
+		"command_state_path":  c.CommandStatePath,
+		"rotation_state_path": c.RotationStatePath,
+		"drain_path":          c.DrainPath,
+		"backend_path":        c.BackendPath,
+		"spool_path":          c.SpoolPath,
+		"geo_cache_path":      c.GeoCachePath,
+		"update_state_path":   c.UpdateStatePath,
+	}
+	for name, path := range paths {
+		if path == "" {
+			return fmt.Errorf("%s must not be empty", name)
+		}
+	}
+
+	for _, raw := range c.PublicIPURLs {
+		if u, err := url.Parse(raw); err != nil || u.Host == "" {
+			return fmt.Errorf("public_ip_urls: %q is not a valid URL", raw)
+		}
+	}
+	for _, server := range c.STUNServers {
+		if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+			return fmt.Errorf("stun_servers: %q must be host:port", server)
+		}
+	}
+	if c.SpoolLimit < 0 {
+		return fmt.Errorf("spool_limit must not be negative")
+	}
+
+	// Each URL and STUN server is one source, plus the interface addresses
+	sources := len(c.PublicIPURLs) + len(c.STUNServers) + 1
+	if c.PublicIPQuorum < 1 || c.PublicIPQuorum > sources {
+		return fmt.Errorf("public_ip_quorum must be between 1 and the number of sources (%d)", sources)
+	}
+
+	if c.GeoCacheTTL.Duration <= 0 {
+		return fmt.Errorf("geo_cache_ttl must be positive")
+	}
+
+	if _, err := connectRequest(c.SelfCheckTarget); err != nil {
+		return fmt.Errorf("self_check_target: %w", err)
+	}
+	if _, err := connectRequest(c.SelfCheckTargetIPv6); err != nil {
+		return fmt.Errorf("self_check_target_ipv6: %w", err)
+	}
+	if c.SelfCheckTimeout.Duration <= 0 {
+		return fmt.Errorf("self_check_timeout must be positive")
+	}
+
+	if c.ReleasePublicKey != "" {
+		if _, err := release.ParsePublicKey(c.ReleasePublicKey); err != nil {
+			return fmt.Errorf("release_public_key: %w", err)
+		}
+	}
+	if c.UpdateDeadline.Duration < time.Minute {
+		return fmt.Errorf("update_deadline must be at least 1m, got %s", c.UpdateDeadline)
+	}
+
+	providers, err := newGeoProviders(c)
+	if err != nil {
+		return err
+	}
+	c.geoProviders = providers
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("ca_file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("ca_file %s contains no PEM certificates", c.CAFile)
+		}
+		c.roots = roots
+	}
+
+	return nil
+}
+
+// controllerURLs returns the controllers to talk to, in failover order: the
+// configured ones if set, otherwise the one the agent enrolled with
+func (c *Config) controllerURLs(id *Identity) []string {
+	if len(c.ControllerURLs) == 0 {
+		return []string{id.ControllerURL}
+	}
+	urls := make([]string, len(c.ControllerURLs))
+	for i, u := range c.ControllerURLs {
+		urls[i] = strings.TrimRight(u, "/")
+	}
+	return urls
+}
+
+// splitList parses a comma-separated list, dropping empty entries
+func splitList(val string) []string {
+	var out []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
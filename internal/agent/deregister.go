@@ -0,0 +1,77 @@
+// internal/agent/deregister.go
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const deregisterPath = "/api/nodes/deregister"
+
+// deregisterRequest is signed like a heartbeat and shares its sequence, so
+// a heartbeat still in flight when the agent stops cannot bring the node
+// back online after it
+type deregisterRequest struct {
+	Reason    string `json:"reason"`
+	Seq       int64  `json:"seq"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Deregister tells the controller the node is going away, so it stops
+// handing the node out immediately instead of when its heartbeats time out.
+// The next heartbeat registers the node again.
+func Deregister(ctx context.Context, reason string) error {
+	id, err := LoadIdentity()
+	if err != nil {
+		return fmt.Errorf("identity error: %w", err)
+	}
+
+	// A rejected sequence is resynced and sent once more, since there is no
+	// next heartbeat to recover with
+	for attempt := 0; ; attempt++ {
+		err = sendDeregister(ctx, id, reason)
+		if _, stale := err.(*staleSequenceError); !stale || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// staleSequenceError is returned when the controller rejected the sequence
+// number; the local sequence has already been resynced
+type staleSequenceError struct {
+	err error
+}
+
+func (e *staleSequenceError) Error() string { return e.err.Error() }
+
+func sendDeregister(ctx context.Context, id *Identity, reason string) error {
+	req := deregisterRequest{Reason: reason, Timestamp: time.Now().Unix()}
+	var err error
+	req.Seq, err = nextSequence()
+	if err != nil {
+		return fmt.Errorf("sequence error: %w", err)
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+
+	resp, err := id.signedPostContext(ctx, deregisterPath, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return &staleSequenceError{resyncSequence(resp.Body)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("API returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// internal/agent/enrollment.go
+
+package agent
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Identity is the agent's enrollment state: the node ID assigned by the
+// controller and the Ed25519 key used to sign every request to it. When the
+// controller serves TLS itself, it also holds the client certificate issued
+// at enrollment and the controller CA to pin.
+type Identity struct {
+	NodeID        string `json:"node_id"`
+	ControllerURL string `json:"controller_url"`
+	PrivateKey    string `json:"private_key"`
+	Certificate   string `json:"certificate,omitempty"`
+	CACertificate string `json:"ca_certificate,omitempty"`
+
+	// Key agent releases are checked against, unless configured locally
+	ReleasePublicKey string `json:"release_public_key,omitempty"`
+
+	key ed25519.PrivateKey
+}
+
+// Sign returns the base64 Ed25519 signature of a request: its method, path
+// and body, each on its own line, so a signed body is only accepted by the
+// route it was sent to. The controller rebuilds the same string to verify.
+func (id *Identity) Sign(method, path string, body []byte) string {
+	message := append([]byte(method+"\n"+path+"\n"), body...)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(id.key, message))
+}
+
+// LoadIdentity reads the identity written by Enroll
+func LoadIdentity() (*Identity, error) {
+	data, err := os.ReadFile(conf.IdentityPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("agent is not enrolled, run: trinityproxy join <controller-url> <token>")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, fmt.Errorf("corrupt identity file %s: %w", conf.IdentityPath, err)
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(id.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("corrupt private key in %s", conf.IdentityPath)
+	}
+	id.key = ed25519.NewKeyFromSeed(seed)
+
+	return &id, nil
+}
+
+// Enroll generates a fresh keypair, redeems the join token with the
+// controller and persists the resulting identity. caFingerprint optionally
+// pins the controller's embedded CA for the join request itself.
+func Enroll(controllerURL, token, caFingerprint string) (*Identity, error) {
+	controllerURL = strings.TrimRight(controllerURL, "/")
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("key generation error: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	csr, err := createCSR(privateKey, hostname)
+	if err != nil {
+		return nil, fmt.Errorf("csr error: %w", err)
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"token":      token,
+		"hostname":   hostname,
+		"public_key": base64.StdEncoding.EncodeToString(publicKey),
+		"csr":        csr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal error: %w", err)
+	}
+
+	client := enrollmentClient(caFingerprint)
+	resp, err := client.Post(controllerURL+"/api/enroll", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, fmt.Errorf("post error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("enrollment rejected (status %d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		NodeID        string `json:"node_id"`
+		Certificate   string `json:"certificate"`
+		CACertificate string `json:"ca_certificate"`
+		ReleaseKey    string `json:"release_public_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.NodeID == "" {
+		return nil, fmt.Errorf("invalid enrollment response")
+	}
+
+	id := &Identity{
+		NodeID:        result.NodeID,
+		ControllerURL: controllerURL,
+		PrivateKey:    base64.StdEncoding.EncodeToString(privateKey.Seed()),
+		Certificate:   result.Certificate,
+		CACertificate: result.CACertificate,
+		key:           privateKey,
+
+		ReleasePublicKey: result.ReleaseKey,
+	}
+
+	out, err := json.MarshalIndent(id, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(conf.IdentityPath, out, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+
+	return id, nil
+}
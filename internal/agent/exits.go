@@ -0,0 +1,101 @@
+// internal/agent/exits.go
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Exit is an additional public address the node's SOCKS service listens on
+// and sends traffic from. The controller lists each as its own endpoint
+// under this host.
+type Exit struct {
+	IP        string           `json:"ip"`
+	SelfCheck *SelfCheckResult `json:"self_check,omitempty"`
+}
+
+// checkAddr picks the exit the primary self-check goes through: the
+// reported address when Dante serves it, otherwise the first exit. It
+// returns "" for a host without exits.
+func checkAddr(exits []string, addrs publicAddrs) string {
+	if len(exits) == 0 {
+		return ""
+	}
+	for _, exit := range exits {
+		if exit == addrs.primary() {
+			return exit
+		}
+	}
+	return exits[0]
+}
+
+// exitCheckWorkers is how many exits are self-checked at once
+const exitCheckWorkers = 8
+
+// checkExits self-checks every exit other than the node's own addresses,
+// connecting through that exit so the traffic leaves from it. The checks run
+// in parallel and together take at most twice SelfCheckTimeout, the most a
+// single check can take; exits not checked by then are reported unreachable.
+func checkExits(exits []string, addrs publicAddrs, port int, username, password string) []Exit {
+	var out []Exit
+	for _, exit := range exits {
+		if exit != addrs.IPv4 && exit != addrs.IPv6 {
+			out = append(out, Exit{IP: exit})
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+
+	budget := 2 * conf.SelfCheckTimeout.Duration
+	deadline := time.Now().Add(budget)
+	type result struct {
+		index int
+		check *SelfCheckResult
+	}
+	jobs := make(chan int, len(out))
+	results := make(chan result, len(out))
+	for i := range out {
+		jobs <- i
+	}
+	close(jobs)
+
+	for w := 0; w < min(exitCheckWorkers, len(out)); w++ {
+		go func() {
+			for i := range jobs {
+				if time.Now().After(deadline) {
+					return
+				}
+				target := conf.SelfCheckTarget
+				if ip := net.ParseIP(out[i].IP); ip != nil && ip.To4() == nil {
+					target = conf.SelfCheckTargetIPv6
+				}
+				results <- result{i, runSelfCheck(port, username, password, target, out[i].IP)}
+			}
+		}()
+	}
+
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+collect:
+	for received := 0; received < len(out); received++ {
+		select {
+		case r := <-results:
+			out[r.index].SelfCheck = r.check
+		case <-timeout.C:
+			break collect
+		}
+	}
+
+	for i := range out {
+		if out[i].SelfCheck == nil {
+			out[i].SelfCheck = &SelfCheckResult{
+				Status: SelfCheckUnreachable,
+				Error:  fmt.Sprintf("not checked within %s", budget),
+			}
+		}
+	}
+	return out
+}
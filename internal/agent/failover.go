@@ -0,0 +1,92 @@
+// internal/agent/failover.go
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// activeController is the index into the controller list that last
+// answered. Requests start there and only move on when it fails.
+var (
+	activeMu         sync.Mutex
+	activeController int
+)
+
+// signedPost sends a JSON body, signed with the node key, to the active
+// controller. If it cannot be reached or answers with a server error, the
+// remaining controllers are tried in order and the first to answer becomes
+// the active one.
+func (id *Identity) signedPost(path string, data []byte) (*http.Response, error) {
+	return id.signedPostContext(context.Background(), path, data)
+}
+
+// signedPostContext is signedPost with a context that can abort the request
+func (id *Identity) signedPostContext(ctx context.Context, path string, data []byte) (*http.Response, error) {
+	return id.signedPostTimeout(ctx, path, data, conf.RequestTimeout.Duration)
+}
+
+// signedPostTimeout is signedPostContext with its own timeout, for requests
+// such as release downloads that take longer than the usual request timeout
+func (id *Identity) signedPostTimeout(ctx context.Context, path string, data []byte, timeout time.Duration) (*http.Response, error) {
+	client, err := id.HTTPClient(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("tls error: %w", err)
+	}
+
+	urls := conf.controllerURLs(id)
+	activeMu.Lock()
+	start := activeController % len(urls)
+	activeMu.Unlock()
+
+	var lastErr error
+	for i := range urls {
+		idx := (start + i) % len(urls)
+
+		resp, err := postSigned(ctx, client, id, urls[idx], path, data)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("%s: %w", urls[idx], err)
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s returned status %d", urls[idx], resp.StatusCode)
+			continue
+		}
+
+		if idx != start {
+			log.Printf("[!] Failed over to controller %s", urls[idx])
+		}
+		activeMu.Lock()
+		activeController = idx
+		activeMu.Unlock()
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+func postSigned(ctx context.Context, client *http.Client, id *Identity, baseURL, path string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Trinity-Node-ID", id.NodeID)
+	req.Header.Set("X-Trinity-Signature", id.Sign("POST", path, data))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("post error: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,295 @@
+// internal/agent/geo.go
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Skillz147/TrinityProxy/internal/mmdb"
+)
+
+// Location is where the node's public IP resolves to
+type Location struct {
+	Country string `json:"country"`
+	Region  string `json:"region"`
+	City    string `json:"city"`
+	Zip     string `json:"zip"`
+}
+
+// GeoProvider resolves a public IP to a location
+type GeoProvider interface {
+	Name() string
+	Lookup(ip string) (Location, error)
+}
+
+// mmdbProviderName selects the offline provider reading conf.GeoDatabase
+const mmdbProviderName = "mmdb"
+
+// httpGeoProvider queries a JSON geolocation API. parse maps the service's
+// response body to a Location, so each mapping can be checked against a
+// saved response.
+type httpGeoProvider struct {
+	name  string
+	token string
+	url   func(ip, token string) string
+	parse func(body []byte) (Location, error)
+}
+
+// httpGeoProviders are the supported HTTP services. A token switches to the
+// service's authenticated endpoint where it has one.
+var httpGeoProviders = map[string]func(token string) *httpGeoProvider{
+	"ipapi.co": func(token string) *httpGeoProvider {
+		return &httpGeoProvider{name: "ipapi.co", token: token, parse: parseIPAPICo,
+			url: func(ip, token string) string {
+				return "https://ipapi.co/" + url.PathEscape(ip) + "/json/" + tokenQuery("key", token)
+			}}
+	},
+	"ip-api.com": func(token string) *httpGeoProvider {
+		return &httpGeoProvider{name: "ip-api.com", token: token, parse: parseIPAPICom,
+			url: func(ip, token string) string {
+				if token != "" {
+					return "https://pro.ip-api.com/json/" + url.PathEscape(ip) + tokenQuery("key", token)
+				}
+				return "http://ip-api.com/json/" + url.PathEscape(ip)
+			}}
+	},
+	"ipinfo.io": func(token string) *httpGeoProvider {
+		return &httpGeoProvider{name: "ipinfo.io", token: token, parse: parseIPInfo,
+			url: func(ip, token string) string {
+				return "https://ipinfo.io/" + url.PathEscape(ip) + "/json" + tokenQuery("token", token)
+			}}
+	},
+}
+
+func tokenQuery(param, token string) string {
+	if token == "" {
+		return ""
+	}
+	return "?" + param + "=" + url.QueryEscape(token)
+}
+
+func knownGeoProviders() []string {
+	names := []string{mmdbProviderName}
+	for name := range httpGeoProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *httpGeoProvider) Name() string {
+	return p.name
+}
+
+func (p *httpGeoProvider) Lookup(ip string) (Location, error) {
+	resp, err := lookupClient().Get(p.url(ip, p.token))
+	if err != nil {
+		return Location{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Location{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Location{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return p.parse(body)
+}
+
+// parseIPAPICo maps an ipapi.co response
+func parseIPAPICo(body []byte) (Location, error) {
+	var r struct {
+		Error       bool   `json:"error"`
+		Reason      string `json:"reason"`
+		CountryName string `json:"country_name"`
+		CountryCode string `json:"country_code"`
+		Region      string `json:"region"`
+		RegionCode  string `json:"region_code"`
+		City        string `json:"city"`
+		Postal      string `json:"postal"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return Location{}, fmt.Errorf("decode error: %v", err)
+	}
+	if r.Error {
+		return Location{}, fmt.Errorf("error: %s", r.Reason)
+	}
+	return Location{
+		Country: firstNonEmpty(r.CountryName, r.CountryCode),
+		Region:  firstNonEmpty(r.Region, r.RegionCode),
+		City:    r.City,
+		Zip:     r.Postal,
+	}, nil
+}
+
+// parseIPAPICom maps an ip-api.com response
+func parseIPAPICom(body []byte) (Location, error) {
+	var r struct {
+		Status      string `json:"status"`
+		Message     string `json:"message"`
+		Country     string `json:"country"`
+		CountryCode string `json:"countryCode"`
+		Region      string `json:"region"`
+		RegionName  string `json:"regionName"`
+		City        string `json:"city"`
+		Zip         string `json:"zip"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return Location{}, fmt.Errorf("decode error: %v", err)
+	}
+	if r.Status != "success" {
+		return Location{}, fmt.Errorf("error: %s", r.Message)
+	}
+	return Location{
+		Country: firstNonEmpty(r.Country, r.CountryCode),
+		Region:  firstNonEmpty(r.RegionName, r.Region),
+		City:    r.City,
+		Zip:     r.Zip,
+	}, nil
+}
+
+// parseIPInfo maps an ipinfo.io response. ipinfo.io only reports the
+// two-letter country code.
+func parseIPInfo(body []byte) (Location, error) {
+	var r struct {
+		Error *struct {
+			Title   string `json:"title"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Bogon   bool   `json:"bogon"`
+		Country string `json:"country"`
+		Region  string `json:"region"`
+		City    string `json:"city"`
+		Postal  string `json:"postal"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return Location{}, fmt.Errorf("decode error: %v", err)
+	}
+	if r.Error != nil {
+		return Location{}, fmt.Errorf("error: %s: %s", r.Error.Title, r.Error.Message)
+	}
+	if r.Bogon {
+		return Location{}, fmt.Errorf("error: not a public address")
+	}
+	return Location{Country: r.Country, Region: r.Region, City: r.City, Zip: r.Postal}, nil
+}
+
+// mmdbGeoProvider resolves locations offline from a MaxMind-format city or
+// country database such as GeoLite2-City.mmdb. The file is read on each
+// lookup rather than kept in memory, since the geo cache makes lookups rare.
+type mmdbGeoProvider struct {
+	path string
+}
+
+func (p *mmdbGeoProvider) Name() string {
+	return mmdbProviderName
+}
+
+func (p *mmdbGeoProvider) Lookup(ip string) (Location, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return Location{}, fmt.Errorf("invalid IP %q", ip)
+	}
+
+	db, err := mmdb.Open(p.path)
+	if err != nil {
+		return Location{}, err
+	}
+	city, found, err := db.LookupCity(addr)
+	if err != nil {
+		return Location{}, err
+	}
+	if !found {
+		return Location{}, fmt.Errorf("%s not in %s", ip, p.path)
+	}
+	return Location{
+		Country: firstNonEmpty(city.Country, city.CountryCode),
+		Region:  firstNonEmpty(city.Region, city.RegionCode),
+		City:    city.City,
+		Zip:     city.PostalCode,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// newGeoProviders builds the providers named in c.GeoProviders, in order
+func newGeoProviders(c *Config) ([]GeoProvider, error) {
+	if len(c.GeoProviders) == 0 {
+		return nil, fmt.Errorf("at least one geo provider is required")
+	}
+
+	for name := range c.GeoTokens {
+		if _, ok := httpGeoProviders[name]; !ok {
+			return nil, fmt.Errorf("geo token given for %q, which is not an HTTP geo provider", name)
+		}
+	}
+
+	providers := make([]GeoProvider, 0, len(c.GeoProviders))
+	for _, name := range c.GeoProviders {
+		if name == mmdbProviderName {
+			if c.GeoDatabase == "" {
+				return nil, fmt.Errorf("geo provider %q needs geo_database", name)
+			}
+			if _, err := mmdb.Open(c.GeoDatabase); err != nil {
+				return nil, fmt.Errorf("geo_database: %w", err)
+			}
+			providers = append(providers, &mmdbGeoProvider{path: c.GeoDatabase})
+			continue
+		}
+
+		build, ok := httpGeoProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown geo provider %q (known: %s)", name, strings.Join(knownGeoProviders(), ", "))
+		}
+		providers = append(providers, build(c.GeoTokens[name]))
+	}
+	return providers, nil
+}
+
+// lookupLocation tries each configured geo provider in order until one
+// returns a country
+func lookupLocation(ip string) (Location, error) {
+	providers := conf.geoProviders
+	if providers == nil {
+		var err error
+		if providers, err = newGeoProviders(conf); err != nil {
+			return Location{}, err
+		}
+	}
+
+	var lastError error
+	for _, p := range providers {
+		fmt.Printf("[*] Trying geo service: %s\n", p.Name())
+
+		loc, err := p.Lookup(ip)
+		if err != nil {
+			lastError = fmt.Errorf("%s failed: %v", p.Name(), err)
+			continue
+		}
+		if loc.Country == "" {
+			lastError = fmt.Errorf("%s returned no country data", p.Name())
+			continue
+		}
+
+		fmt.Printf("[+] Geo data retrieved from %s\n", p.Name())
+		return loc, nil
+	}
+
+	return Location{}, fmt.Errorf("all geo services failed, last error: %v", lastError)
+}
@@ -0,0 +1,92 @@
+// internal/agent/geo_test.go
+
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each provider's parser is checked against sample responses in
+// testdata/geo, named after the provider
+func TestParseGeoResponses(t *testing.T) {
+	tests := []struct {
+		file    string
+		parse   func([]byte) (Location, error)
+		want    Location
+		wantErr string
+	}{
+		{"ipapi.co.json", parseIPAPICo,
+			Location{Country: "United States", Region: "California", City: "Mountain View", Zip: "94043"}, ""},
+		{"ipapi.co-reserved.json", parseIPAPICo, Location{}, "Reserved IP Address"},
+		{"ipapi.co-ratelimited.json", parseIPAPICo, Location{}, "RateLimited"},
+
+		{"ip-api.com.json", parseIPAPICom,
+			Location{Country: "United States", Region: "Virginia", City: "Ashburn", Zip: "20149"}, ""},
+		{"ip-api.com-ipv6.json", parseIPAPICom,
+			Location{Country: "Germany", Region: "Hesse", City: "Frankfurt am Main", Zip: "60313"}, ""},
+		{"ip-api.com-private.json", parseIPAPICom, Location{}, "private range"},
+
+		{"ipinfo.io.json", parseIPInfo,
+			Location{Country: "US", Region: "California", City: "Mountain View", Zip: "94043"}, ""},
+		{"ipinfo.io-bogon.json", parseIPInfo, Location{}, "not a public address"},
+		{"ipinfo.io-error.json", parseIPInfo, Location{}, "Unknown token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", "geo", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tt.parse(body)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGeoMalformed(t *testing.T) {
+	for name, parse := range map[string]func([]byte) (Location, error){
+		"ipapi.co":   parseIPAPICo,
+		"ip-api.com": parseIPAPICom,
+		"ipinfo.io":  parseIPInfo,
+	} {
+		if _, err := parse([]byte("<html>Too Many Requests</html>")); err == nil {
+			t.Errorf("%s: parsed an HTML body without error", name)
+		}
+	}
+}
+
+func TestMMDBGeoProvider(t *testing.T) {
+	p := &mmdbGeoProvider{path: filepath.Join("..", "mmdb", "testdata", "test-ipv6-24.mmdb")}
+
+	got, err := p.Lookup("1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Location{Country: "United States", Region: "California", City: "Mountain View", Zip: "94043"}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := p.Lookup("9.9.9.9"); err == nil {
+		t.Error("address missing from the database did not fail")
+	}
+	if _, err := p.Lookup("not-an-ip"); err == nil {
+		t.Error("invalid IP did not fail")
+	}
+}
@@ -0,0 +1,128 @@
+// internal/agent/geocache.go
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// geoRetryDelay is how long to wait after a failed geo lookup before trying
+// the providers again, so a rate-limited provider is not hit every heartbeat
+const geoRetryDelay = 5 * time.Minute
+
+// geoCache is persisted at conf.GeoCachePath so restarts do not trigger a
+// fresh lookup either
+type geoCache struct {
+	IP             string    `json:"ip"`
+	IPv6           string    `json:"ipv6,omitempty"`
+	Location       Location  `json:"location"`
+	ResolvedAt     time.Time `json:"resolved_at"`
+	LookupFailedAt time.Time `json:"lookup_failed_at,omitempty"`
+}
+
+func loadGeoCache() *geoCache {
+	data, err := os.ReadFile(conf.GeoCachePath)
+	if err != nil {
+		return nil
+	}
+
+	var cache geoCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("[!] Ignoring corrupt geo cache %s: %v", conf.GeoCachePath, err)
+		return nil
+	}
+	return &cache
+}
+
+func (c *geoCache) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(conf.GeoCachePath, data, 0600)
+}
+
+// resolveLocation returns the public addresses and the location of the
+// primary one. The addresses are checked every call; geo providers are only
+// queried when the primary IP has changed or the cached location is older
+// than the TTL. When lookups fail the cached values are used, so a provider
+// outage does not stop heartbeats.
+func resolveLocation() (publicAddrs, Location, error) {
+	cache := loadGeoCache()
+
+	addrs, err := detectPublicAddrs()
+	if err != nil {
+		if cache == nil || cache.IP == "" {
+			return addrs, Location{}, fmt.Errorf("public IP lookup failed and nothing is cached: %w", err)
+		}
+		log.Printf("[!] Public IP lookup failed, using cached %s: %v", cache.IP, err)
+		return cachedAddrs(cache), cache.Location, nil
+	}
+	ip := addrs.primary()
+
+	if cache == nil {
+		cache = &geoCache{}
+	}
+	sameIP := cache.IP == ip
+
+	if sameIP && time.Since(cache.ResolvedAt) < conf.GeoCacheTTL.Duration {
+		if cache.IPv6 != addrs.IPv6 {
+			cache.IPv6 = addrs.IPv6
+			if err := cache.save(); err != nil {
+				log.Printf("[-] Failed to save geo cache: %v", err)
+			}
+		}
+		return addrs, cache.Location, nil
+	}
+	if time.Since(cache.LookupFailedAt) < geoRetryDelay {
+		return addrs, fallbackLocation(cache, sameIP), nil
+	}
+
+	loc, err := lookupLocation(ip)
+	if err != nil {
+		log.Printf("[!] Geo lookup failed, retrying in %s: %v", geoRetryDelay, err)
+		cache.LookupFailedAt = time.Now()
+		if saveErr := cache.save(); saveErr != nil {
+			log.Printf("[-] Failed to save geo cache: %v", saveErr)
+		}
+		return addrs, fallbackLocation(cache, sameIP), nil
+	}
+
+	if !sameIP && cache.IP != "" {
+		log.Printf("[*] Public IP changed from %s to %s", cache.IP, ip)
+	}
+	cache = &geoCache{
+		IP:         ip,
+		IPv6:       addrs.IPv6,
+		Location:   loc,
+		ResolvedAt: time.Now(),
+	}
+	if err := cache.save(); err != nil {
+		log.Printf("[-] Failed to save geo cache: %v", err)
+	}
+	return addrs, cache.Location, nil
+}
+
+// fallbackLocation is the cached location when it belongs to the current IP.
+// A location cached for a different IP would misreport the node's country,
+// so in that case the node is reported without one until a lookup succeeds.
+func fallbackLocation(cache *geoCache, sameIP bool) Location {
+	if sameIP {
+		return cache.Location
+	}
+	return Location{}
+}
+
+// cachedAddrs rebuilds the addresses saved in the cache. The cached IP is
+// the primary one, so it is IPv6 only on hosts without IPv4.
+func cachedAddrs(cache *geoCache) publicAddrs {
+	if net.ParseIP(cache.IP).To4() != nil {
+		return publicAddrs{IPv4: cache.IP, IPv6: cache.IPv6}
+	}
+	return publicAddrs{IPv6: cache.IP}
+}
@@ -3,58 +3,178 @@
 package agent
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"time"
-)
 
-const (
-	heartbeatInterval = 60 * time.Second
-	controlAPIURL     = "https://api.sauronstore.com/api/heartbeat" // central HTTPS API endpoint
+	"github.com/Skillz147/TrinityProxy/internal/policy"
 )
 
-func StartHeartbeatLoop() {
+const heartbeatPath = "/api/heartbeat"
+
+// StartHeartbeatLoop sends a heartbeat every interval until ctx is
+// cancelled. After a failure it retries with jittered exponential backoff, so
+// a recovered controller hears from the agent within seconds instead of a
+// full interval later.
+func StartHeartbeatLoop(ctx context.Context) {
+	var failures int
+	var failingSince time.Time
+	started := false
+	resumeUpdate(ctx)
+
 	for {
-		err := sendHeartbeat()
-		if err != nil {
-			log.Printf("[-] Heartbeat failed: %v", err)
-		} else {
+		err := sendHeartbeat(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		wait := conf.HeartbeatInterval.Duration
+
+		switch {
+		case err != nil:
+			failures++
+			if failures == 1 {
+				failingSince = time.Now()
+				log.Printf("[-] Heartbeat failed, retrying with backoff: %v", err)
+			}
+			wait = retryDelay(failures)
+		case failures > 0:
+			log.Printf("[+] Heartbeat recovered after %d failed attempts (%s)",
+				failures, time.Since(failingSince).Round(time.Second))
+			failures = 0
+		case !started:
 			log.Println("[+] Heartbeat sent successfully")
 		}
-		time.Sleep(heartbeatInterval)
+		started = true
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retryDelay returns the wait before retry n (from 1): RetryMin doubled per
+// failure up to RetryMax, with the upper half randomized so a fleet that
+// lost its controller at the same moment does not retry in lockstep
+func retryDelay(n int) time.Duration {
+	delay := conf.RetryMax.Duration
+	if n < 32 {
+		if d := conf.RetryMin.Duration << (n - 1); d > 0 && d < delay {
+			delay = d
+		}
 	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
 }
 
-func sendHeartbeat() error {
+// sendHeartbeat reports the node to the controller. Cancelling ctx aborts it
+// before a sequence number is reserved or while the request is in flight.
+func sendHeartbeat(ctx context.Context) error {
+	id, err := LoadIdentity()
+	if err != nil {
+		return fmt.Errorf("identity error: %w", err)
+	}
+
+	// Finish a rotation left over from an earlier heartbeat before reporting
+	// credentials, so the controller never sees unconfirmed ones
+	if err := resumeRotation(id); err != nil {
+		log.Printf("[-] Credential rotation: %v", err)
+	}
+
 	meta, err := GatherMetadata()
 	if err != nil {
 		return fmt.Errorf("metadata error: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	data, err := json.Marshal(meta)
+	meta.Seq, err = nextSequence()
 	if err != nil {
-		return fmt.Errorf("marshal error: %w", err)
+		return fmt.Errorf("sequence error: %w", err)
 	}
+	meta.Timestamp = time.Now().Unix()
+	meta.CommandAcks = unsentAcks()
 
-	req, err := http.NewRequest("POST", controlAPIURL, bytes.NewBuffer(data))
+	data, err := json.Marshal(meta)
 	if err != nil {
-		return fmt.Errorf("request error: %w", err)
+		return fmt.Errorf("marshal error: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := id.signedPostContext(ctx, heartbeatPath, data)
 	if err != nil {
-		return fmt.Errorf("post error: %w", err)
+		// No controller could be reached; keep the snapshot for backfill
+		if ctx.Err() == nil {
+			spoolHeartbeat(meta)
+		}
+		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusConflict {
+		return resyncSequence(resp.Body)
+	}
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("API returned status %d", resp.StatusCode)
 	}
+	ackDelivered(meta.CommandAcks)
+	confirmUpdate()
+
+	// Older controllers reply with a plain "ok"
+	var result heartbeatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err == nil {
+		handleHeartbeatResponse(id, &result)
+	}
 
+	// The controller is reachable again, so backfill the outage
+	if err := flushSpool(ctx, id); err != nil && ctx.Err() == nil {
+		log.Printf("[-] Failed to deliver spooled heartbeats: %v", err)
+	}
 	return nil
 }
+
+// heartbeatResponse carries instructions from the controller
+type heartbeatResponse struct {
+	Status   string               `json:"status"`
+	Policy   *policy.Policy       `json:"policy,omitempty"`
+	Rotation *rotationInstruction `json:"rotation,omitempty"`
+	Commands []command            `json:"commands,omitempty"`
+}
+
+// resyncSequence handles a rejected sequence number, which happens when the
+// sequence file was lost or restored from an old backup. The controller
+// reports the last number it accepted and the next heartbeat continues past it.
+func resyncSequence(body io.Reader) error {
+	var conflict struct {
+		Error   string `json:"error"`
+		LastSeq int64  `json:"last_seq"`
+	}
+	if err := json.NewDecoder(body).Decode(&conflict); err != nil {
+		return fmt.Errorf("API returned status %d", http.StatusConflict)
+	}
+
+	if err := skipSequence(conflict.LastSeq); err != nil {
+		return fmt.Errorf("sequence error: %w", err)
+	}
+	return fmt.Errorf("heartbeat sequence rejected (%s), resuming after %d", conflict.Error, conflict.LastSeq)
+}
+
+func handleHeartbeatResponse(id *Identity, result *heartbeatResponse) {
+	if result.Policy != nil {
+		if err := applyPolicy(result.Policy); err != nil {
+			log.Printf("[-] Failed to apply access policy %s: %v", result.Policy.Version, err)
+		}
+	}
+	if result.Rotation != nil {
+		if err := startRotation(id, result.Rotation); err != nil {
+			log.Printf("[-] Credential rotation %s failed: %v", result.Rotation.ID, err)
+		}
+	}
+	runCommands(id, result.Commands)
+}
@@ -0,0 +1,224 @@
+// internal/agent/metrics.go
+
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostMetrics is a snapshot of the node's load and traffic sent with each
+// heartbeat. Interface counters are totals since boot; the controller
+// derives rates from consecutive samples.
+type HostMetrics struct {
+	CPUPercent        float64             `json:"cpu_percent"`
+	MemTotalBytes     uint64              `json:"mem_total_bytes"`
+	MemAvailableBytes uint64              `json:"mem_available_bytes"`
+	Load1             float64             `json:"load1"`
+	Load5             float64             `json:"load5"`
+	Load15            float64             `json:"load15"`
+	UptimeSeconds     float64             `json:"uptime_seconds"`
+	Interfaces        []InterfaceCounters `json:"interfaces"`
+	SOCKSConnections  int                 `json:"socks_connections"`
+}
+
+// InterfaceCounters are one interface's totals from /proc/net/dev
+type InterfaceCounters struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+// cpuTimes is the aggregate line of /proc/stat
+type cpuTimes struct {
+	idle, total uint64
+}
+
+var (
+	cpuMu   sync.Mutex
+	lastCPU *cpuTimes
+)
+
+// cpuSampleWindow is how long the first CPU sample waits for a second one,
+// since usage is only meaningful as a difference between two readings
+const cpuSampleWindow = 250 * time.Millisecond
+
+// collectMetrics gathers host metrics. Each metric is best effort: one that
+// cannot be read is left zero rather than failing the heartbeat.
+func collectMetrics(socksPort int) *HostMetrics {
+	m := &HostMetrics{}
+
+	if pct, err := cpuPercent(); err == nil {
+		m.CPUPercent = pct
+	}
+	if f, err := os.Open("/proc/meminfo"); err == nil {
+		m.MemTotalBytes, m.MemAvailableBytes, _ = parseMeminfo(f)
+		f.Close()
+	}
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		fmt.Sscanf(string(data), "%f %f %f", &m.Load1, &m.Load5, &m.Load15)
+	}
+	if data, err := os.ReadFile("/proc/uptime"); err == nil {
+		fmt.Sscanf(string(data), "%f", &m.UptimeSeconds)
+	}
+	if f, err := os.Open("/proc/net/dev"); err == nil {
+		m.Interfaces, _ = parseNetDev(f)
+		f.Close()
+	}
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if f, err := os.Open(path); err == nil {
+			n, _ := countEstablished(f, socksPort)
+			m.SOCKSConnections += n
+			f.Close()
+		}
+	}
+
+	return m
+}
+
+// cpuPercent returns CPU usage since the previous call
+func cpuPercent() (float64, error) {
+	cpuMu.Lock()
+	defer cpuMu.Unlock()
+
+	now, err := readCPUTimes()
+	if err != nil {
+		return 0, err
+	}
+	prev := lastCPU
+	if prev == nil {
+		time.Sleep(cpuSampleWindow)
+		prev = now
+		if now, err = readCPUTimes(); err != nil {
+			return 0, err
+		}
+	}
+	lastCPU = now
+
+	total := now.total - prev.total
+	if total == 0 || now.total < prev.total {
+		return 0, nil
+	}
+	busy := total - (now.idle - prev.idle)
+	return float64(busy) / float64(total) * 100, nil
+}
+
+func readCPUTimes() (*cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCPUTimes(f)
+}
+
+// parseCPUTimes reads the "cpu" line of /proc/stat. Idle includes iowait.
+func parseCPUTimes(r io.Reader) (*cpuTimes, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var t cpuTimes
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad /proc/stat value %q", field)
+			}
+			// guest and guest_nice are already counted in user and nice
+			if i < 8 {
+				t.total += v
+			}
+			if i == 3 || i == 4 {
+				t.idle += v
+			}
+		}
+		return &t, nil
+	}
+	return nil, fmt.Errorf("no cpu line in /proc/stat")
+}
+
+// parseMeminfo returns MemTotal and MemAvailable in bytes
+func parseMeminfo(r io.Reader) (total, available uint64, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = v * 1024
+		case "MemAvailable:":
+			available = v * 1024
+		}
+	}
+	return total, available, scanner.Err()
+}
+
+// parseNetDev reads /proc/net/dev, skipping the loopback interface
+func parseNetDev(r io.Reader) ([]InterfaceCounters, error) {
+	var counters []InterfaceCounters
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue // header lines
+		}
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(rest)
+		if name == "lo" || len(fields) < 10 {
+			continue
+		}
+
+		var values [10]uint64
+		for i := range values {
+			values[i], _ = strconv.ParseUint(fields[i], 10, 64)
+		}
+		counters = append(counters, InterfaceCounters{
+			Name:      name,
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			TxBytes:   values[8],
+			TxPackets: values[9],
+		})
+	}
+	return counters, scanner.Err()
+}
+
+// tcpEstablished is the ESTABLISHED state in /proc/net/tcp
+const tcpEstablished = "01"
+
+// countEstablished counts established connections to a local port in
+// /proc/net/tcp or /proc/net/tcp6
+func countEstablished(r io.Reader, port int) (int, error) {
+	want := fmt.Sprintf("%04X", port)
+	count := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpEstablished {
+			continue
+		}
+		// local_address is hex address:port
+		if _, localPort, ok := strings.Cut(fields[1], ":"); ok && localPort == want {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
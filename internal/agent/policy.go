@@ -0,0 +1,82 @@
+// internal/agent/policy.go
+
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+
+	"github.com/Skillz147/TrinityProxy/internal/dante"
+	"github.com/Skillz147/TrinityProxy/internal/netinfo"
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+// currentPolicyVersion returns the version of the locally applied policy,
+// or "" if the agent has none saved
+func currentPolicyVersion() string {
+	p, err := policy.Load(conf.PolicyPath)
+	if err != nil {
+		return ""
+	}
+	return p.Version
+}
+
+// applyPolicy applies a policy pushed by the controller: Dante's
+// configuration is re-rendered and the service restarted, while the native
+// server takes it in place. The policy file is only saved once the SOCKS
+// service has been reconfigured, so a failure is retried next heartbeat.
+func applyPolicy(p *policy.Policy) error {
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+
+	iface, err := readFile(dante.InterfacePath)
+	if err != nil {
+		return fmt.Errorf("interface unknown, rerun installer: %w", err)
+	}
+
+	port, err := proxyPort()
+	if err != nil {
+		return err
+	}
+
+	ipv6 := netinfo.HasPublicIPv6(iface)
+	// Addresses added to the host since the last render are picked up here
+	exits := netinfo.ExitAddrs(iface, ipv6)
+
+	if proxyBackend() == backendNative {
+		if err := reconfigureNativeProxy(p, exits); err != nil {
+			return err
+		}
+		if err := dante.SaveExits(exits); err != nil {
+			return err
+		}
+	} else {
+		danteConf := &dante.Config{
+			Interface: iface,
+			Port:      port,
+			User:      dante.User,
+			Policy:    p,
+			IPv6:      ipv6,
+			Exits:     exits,
+		}
+		if err := danteConf.WriteFile(dante.ConfPath); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dante.ConfPath, err)
+		}
+		if err := dante.SaveExits(exits); err != nil {
+			return err
+		}
+
+		if out, err := exec.Command("systemctl", "restart", dante.ServiceName).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restart %s: %v: %s", dante.ServiceName, err, out)
+		}
+	}
+
+	if err := p.Save(conf.PolicyPath); err != nil {
+		return err
+	}
+
+	log.Printf("[+] Applied access policy %s", p.Version)
+	return nil
+}
@@ -0,0 +1,202 @@
+// internal/agent/proxy.go
+
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/dante"
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+	"github.com/Skillz147/TrinityProxy/internal/socks5"
+)
+
+// SOCKS backends the installer can set up. Dante runs as its own service
+// and checks logins against system users; the native server runs inside the
+// agent with logins held in memory.
+const (
+	backendDante  = "dante"
+	backendNative = "native"
+)
+
+// logins are the SOCKS logins the native server accepts
+var logins = socks5.NewCredentials()
+
+var (
+	proxyMu     sync.Mutex
+	nativeProxy *socks5.Server
+	proxyExits  []string
+)
+
+// proxyBackend returns the backend chosen by the installer, Dante unless
+// it chose the native server
+func proxyBackend() string {
+	if backend, err := readFile(conf.BackendPath); err == nil && backend == backendNative {
+		return backendNative
+	}
+	return backendDante
+}
+
+// StartProxy starts the native SOCKS5 server when the installer chose it.
+// Dante runs as its own service, so there is nothing to start for it.
+func StartProxy() error {
+	if proxyBackend() != backendNative {
+		return nil
+	}
+	if err := restoreLogins(); err != nil {
+		return err
+	}
+
+	p, err := policy.Load(conf.PolicyPath)
+	if err != nil {
+		p = policy.Default()
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	return startNativeProxy(p, dante.LoadExits())
+}
+
+// StopProxy closes the native server and every connection through it
+func StopProxy() {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	stopNativeProxy()
+}
+
+// startNativeProxy listens on the configured port. Called with proxyMu held.
+func startNativeProxy(p *policy.Policy, exits []string) error {
+	port, err := proxyPort()
+	if err != nil {
+		return err
+	}
+	server, err := socks5.NewServer(logins, p)
+	if err != nil {
+		return err
+	}
+	if err := server.Listen(port, exits); err != nil {
+		return fmt.Errorf("native SOCKS5 server: %w", err)
+	}
+
+	nativeProxy, proxyExits = server, exits
+	if len(exits) > 0 {
+		log.Printf("[+] Native SOCKS5 server listening on port %d of %s", port, strings.Join(exits, ", "))
+	} else {
+		log.Printf("[+] Native SOCKS5 server listening on port %d", port)
+	}
+	return nil
+}
+
+func stopNativeProxy() {
+	if nativeProxy == nil {
+		return
+	}
+	nativeProxy.Close()
+	nativeProxy, proxyExits = nil, nil
+}
+
+func proxyPort() (int, error) {
+	portStr, err := readFile(conf.PortPath)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(portStr)
+}
+
+// restartNativeProxy stops the native server and starts it again, picking
+// up the policy and exits on disk
+func restartNativeProxy() error {
+	p, err := policy.Load(conf.PolicyPath)
+	if err != nil {
+		p = policy.Default()
+	}
+
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	stopNativeProxy()
+	return startNativeProxy(p, dante.LoadExits())
+}
+
+// reconfigureNativeProxy applies a policy. Open connections are kept unless
+// the exits changed, which needs new listeners.
+func reconfigureNativeProxy(p *policy.Policy, exits []string) error {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+
+	if nativeProxy != nil && slices.Equal(exits, proxyExits) {
+		return nativeProxy.SetPolicy(p)
+	}
+	stopNativeProxy()
+	return startNativeProxy(p, exits)
+}
+
+// proxyServiceState reports whether the SOCKS service is running, in the
+// terms of systemctl is-active
+func proxyServiceState() string {
+	if proxyBackend() == backendNative {
+		proxyMu.Lock()
+		defer proxyMu.Unlock()
+		if nativeProxy == nil {
+			return "inactive"
+		}
+		return "active"
+	}
+
+	out, _ := exec.Command("systemctl", "is-active", dante.ServiceName).Output()
+	if state := strings.TrimSpace(string(out)); state != "" {
+		return state
+	}
+	return "unknown"
+}
+
+// restoreLogins loads the logins valid now into the native server: the
+// current credentials, plus the other login of a rotation in progress
+func restoreLogins() error {
+	username, err := readFile(conf.UsernamePath)
+	if err != nil {
+		return err
+	}
+	password, err := readFile(conf.PasswordPath)
+	if err != nil {
+		return err
+	}
+	logins.Set(username, password)
+
+	state, err := loadRotationState()
+	if err != nil {
+		log.Printf("[-] Rotation: %v", err)
+		return nil
+	}
+	switch {
+	case state == nil:
+	case !state.Confirmed:
+		logins.Set(state.Username, state.Password)
+	case state.PreviousUsername != "" && state.PreviousPassword != "" && time.Now().Before(state.RetireAt):
+		logins.Set(state.PreviousUsername, state.PreviousPassword)
+	}
+	return nil
+}
+
+// addLogin makes a SOCKS login valid alongside the current one
+func addLogin(username, password string) error {
+	if proxyBackend() == backendNative {
+		logins.Set(username, password)
+		return nil
+	}
+	return dante.CreateUser(username, password)
+}
+
+// removeLogin makes a SOCKS login invalid
+func removeLogin(username string) error {
+	if proxyBackend() == backendNative {
+		logins.Delete(username)
+		return nil
+	}
+	return dante.DeleteUser(username)
+}
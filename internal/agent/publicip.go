@@ -0,0 +1,383 @@
+// internal/agent/publicip.go
+
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/dante"
+	"github.com/Skillz147/TrinityProxy/internal/netinfo"
+)
+
+// publicAddrs are the node's egress addresses. Either may be empty, but not
+// both.
+type publicAddrs struct {
+	IPv4 string
+	IPv6 string
+}
+
+// primary is the address reported as the node's IP: IPv4 when there is one
+func (a publicAddrs) primary() string {
+	if a.IPv4 != "" {
+		return a.IPv4
+	}
+	return a.IPv6
+}
+
+// selfCheckTarget is where the SOCKS self-check connects. An IPv6-only node
+// cannot reach an IPv4 target, which would fail the check every time.
+func (a publicAddrs) selfCheckTarget() string {
+	if a.IPv4 == "" && a.IPv6 != "" {
+		return conf.SelfCheckTargetIPv6
+	}
+	return conf.SelfCheckTarget
+}
+
+// ipFamily selects IPv4 ("4") or IPv6 ("6"), used as a suffix on network
+// names such as "tcp4" and "udp6"
+type ipFamily string
+
+const (
+	familyIPv4 ipFamily = "4"
+	familyIPv6 ipFamily = "6"
+)
+
+func (f ipFamily) matches(ip net.IP) bool {
+	return (ip.To4() != nil) == (f == familyIPv4)
+}
+
+// ipSource is one way of learning the public address
+type ipSource struct {
+	name   string
+	detect func(ctx context.Context, family ipFamily) ([]net.IP, error)
+}
+
+// ipSources returns every configured source: the HTTP echo endpoints, the
+// STUN servers and the addresses on the node's primary interface
+func ipSources() []ipSource {
+	var sources []ipSource
+	for _, u := range conf.PublicIPURLs {
+		u := u
+		sources = append(sources, ipSource{name: u, detect: func(ctx context.Context, family ipFamily) ([]net.IP, error) {
+			ip, err := echoPublicIP(ctx, u, family)
+			return []net.IP{ip}, err
+		}})
+	}
+	for _, server := range conf.STUNServers {
+		server := server
+		sources = append(sources, ipSource{name: "stun:" + server, detect: func(ctx context.Context, family ipFamily) ([]net.IP, error) {
+			ip, err := stunPublicIP(ctx, server, family)
+			return []net.IP{ip}, err
+		}})
+	}
+	sources = append(sources, ipSource{name: "interface", detect: interfacePublicIPs})
+	return sources
+}
+
+// detectPublicAddrs asks every source for the node's IPv4 and, if enabled,
+// IPv6 address. A family's address is only accepted when at least
+// conf.PublicIPQuorum sources agree on it and no other address has as many
+// votes. It fails only when no family reaches agreement.
+func detectPublicAddrs() (publicAddrs, error) {
+	families := []ipFamily{familyIPv4}
+	if conf.DetectIPv6 {
+		families = append(families, familyIPv6)
+	}
+
+	var addrs publicAddrs
+	var errs []string
+	for _, family := range families {
+		ip, err := detectFamily(family)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("IPv%s: %v", family, err))
+			continue
+		}
+		if family == familyIPv4 {
+			addrs.IPv4 = ip
+		} else {
+			addrs.IPv6 = ip
+		}
+	}
+
+	if addrs.primary() == "" {
+		return addrs, fmt.Errorf("public IP detection failed: %s", strings.Join(errs, "; "))
+	}
+	return addrs, nil
+}
+
+// detectFamily queries all sources concurrently and returns the address
+// they agree on
+func detectFamily(family ipFamily) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.LookupTimeout.Duration)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	votes := make(map[string][]string)
+	for _, source := range ipSources() {
+		wg.Add(1)
+		go func(source ipSource) {
+			defer wg.Done()
+			ips, err := source.detect(ctx, family)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ip := range ips {
+				if validPublicIP(ip, family) {
+					votes[ip.String()] = append(votes[ip.String()], source.name)
+				}
+			}
+		}(source)
+	}
+	wg.Wait()
+
+	return tallyVotes(votes, conf.PublicIPQuorum)
+}
+
+// tallyVotes picks the address with the most sources behind it
+func tallyVotes(votes map[string][]string, quorum int) (string, error) {
+	if len(votes) == 0 {
+		return "", errors.New("no source returned an address")
+	}
+
+	candidates := make([]string, 0, len(votes))
+	for ip := range votes {
+		candidates = append(candidates, ip)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return len(votes[candidates[i]]) > len(votes[candidates[j]])
+	})
+
+	best := candidates[0]
+	if len(candidates) > 1 {
+		var seen []string
+		for _, ip := range candidates {
+			seen = append(seen, fmt.Sprintf("%s from %s", ip, strings.Join(votes[ip], ", ")))
+		}
+		log.Printf("[!] Public IP sources disagree: %s", strings.Join(seen, "; "))
+
+		if len(votes[candidates[1]]) == len(votes[best]) {
+			return "", fmt.Errorf("no majority among %d candidate addresses", len(candidates))
+		}
+	}
+	if len(votes[best]) < quorum {
+		return "", fmt.Errorf("only %d of %d required sources returned %s", len(votes[best]), quorum, best)
+	}
+	return best, nil
+}
+
+// validPublicIP rejects addresses that cannot be the node's egress address
+func validPublicIP(ip net.IP, family ipFamily) bool {
+	return ip != nil && family.matches(ip) && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// echoPublicIP fetches an endpoint that returns the caller's address as
+// text, connecting over the given family only
+func echoPublicIP(ctx context.Context, url string, family ipFamily) (net.IP, error) {
+	dialer := &net.Dialer{}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp"+string(family), addr)
+		},
+	}}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("response is not an IP address")
+	}
+	return ip, nil
+}
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+)
+
+// stunPublicIP sends a STUN binding request (RFC 5389) and returns the
+// mapped address the server saw. The request is resent a few times since
+// UDP may drop it.
+func stunPublicIP(ctx context.Context, server string, family ipFamily) (net.IP, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp"+string(family), server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 1500)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(time.Second << attempt)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+
+		n, err := conn.Read(resp)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		return parseSTUNResponse(resp[:n], req[8:20])
+	}
+	return nil, fmt.Errorf("no response from %s", server)
+}
+
+// parseSTUNResponse extracts the (XOR-)MAPPED-ADDRESS from a binding
+// response to the request with transaction ID txID
+func parseSTUNResponse(msg, txID []byte) (net.IP, error) {
+	if len(msg) < 20 {
+		return nil, fmt.Errorf("short STUN response")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingResponse {
+		return nil, fmt.Errorf("unexpected STUN message type %#04x", binary.BigEndian.Uint16(msg[0:2]))
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || string(msg[8:20]) != string(txID) {
+		return nil, fmt.Errorf("STUN response does not match the request")
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if 20+length > len(msg) {
+		return nil, fmt.Errorf("truncated STUN response")
+	}
+	attrs := msg[20 : 20+length]
+
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+size > len(attrs) {
+			return nil, fmt.Errorf("truncated STUN attribute")
+		}
+		value := attrs[4 : 4+size]
+
+		switch typ {
+		case stunAttrXORMappedAddress:
+			ip, err := stunAddress(value)
+			if err != nil {
+				return nil, err
+			}
+			// The address is XORed with the magic cookie and, for IPv6,
+			// the transaction ID
+			key := msg[4:20]
+			for i := range ip {
+				ip[i] ^= key[i]
+			}
+			return ip, nil
+		case stunAttrMappedAddress:
+			ip, err := stunAddress(value)
+			if err != nil {
+				return nil, err
+			}
+			mapped = ip
+		}
+
+		// Attributes are padded to a multiple of four bytes
+		next := 4 + (size+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	if mapped == nil {
+		return nil, fmt.Errorf("STUN response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// stunAddress decodes the address part of a (XOR-)MAPPED-ADDRESS value
+func stunAddress(value []byte) (net.IP, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("short STUN address")
+	}
+	size := 4
+	if value[1] == 0x02 {
+		size = 16
+	} else if value[1] != 0x01 {
+		return nil, fmt.Errorf("unknown STUN address family %d", value[1])
+	}
+	if len(value) < 4+size {
+		return nil, fmt.Errorf("short STUN address")
+	}
+	return append(net.IP(nil), value[4:4+size]...), nil
+}
+
+var (
+	primaryInterfaceOnce sync.Once
+	primaryInterface     string
+)
+
+// interfacePublicIPs returns public addresses assigned directly to the
+// interface Dante listens on. Hosts behind NAT have none, and only the
+// other sources count.
+func interfacePublicIPs(ctx context.Context, family ipFamily) ([]net.IP, error) {
+	primaryInterfaceOnce.Do(func() {
+		if iface, err := readFile(dante.InterfacePath); err == nil && iface != "" {
+			primaryInterface = iface
+			return
+		}
+		primaryInterface = netinfo.PrimaryInterface()
+	})
+
+	addrs, err := netinfo.PublicAddrs(primaryInterface)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, ip := range addrs {
+		if family.matches(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
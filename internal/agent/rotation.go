@@ -0,0 +1,239 @@
+// internal/agent/rotation.go
+
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const rotationConfirmPath = "/api/rotations/confirm"
+
+// rotationInstruction is sent by the controller in a heartbeat response
+type rotationInstruction struct {
+	ID             string `json:"id"`
+	OverlapSeconds int64  `json:"overlap_seconds"`
+}
+
+// rotationState tracks a rotation across heartbeats and restarts. New
+// credentials are staged as a second SOCKS login, confirmed to the
+// controller, and only then written to the credential files. The previous
+// login is deleted once the overlap has passed. Its password is kept for
+// the native SOCKS server, which holds logins in memory and restores them
+// after a restart.
+type rotationState struct {
+	ID               string    `json:"id"`
+	Username         string    `json:"username"`
+	Password         string    `json:"password"`
+	PreviousUsername string    `json:"previous_username"`
+	PreviousPassword string    `json:"previous_password,omitempty"`
+	OverlapSeconds   int64     `json:"overlap_seconds"`
+	Confirmed        bool      `json:"confirmed"`
+	RetireAt         time.Time `json:"retire_at,omitempty"`
+}
+
+type confirmRotationRequest struct {
+	RotationID string `json:"rotation_id"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Seq        int64  `json:"seq"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+func loadRotationState() (*rotationState, error) {
+	data, err := os.ReadFile(conf.RotationStatePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state rotationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("corrupt rotation state %s: %w", conf.RotationStatePath, err)
+	}
+	return &state, nil
+}
+
+func (s *rotationState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(conf.RotationStatePath, data, 0600)
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// startRotation stages new credentials for a rotation instruction and
+// confirms them to the controller
+func startRotation(id *Identity, instr *rotationInstruction) error {
+	state, err := loadRotationState()
+	if err != nil {
+		return err
+	}
+
+	if state != nil {
+		if state.ID == instr.ID {
+			// Already staged on an earlier heartbeat
+			return resumeRotation(id)
+		}
+		if !state.Confirmed {
+			// The controller moved on without confirming the staged login
+			removeLogin(state.Username)
+		} else if state.PreviousUsername != "" {
+			// A new rotation cuts the previous overlap short
+			retireLogin(state.PreviousUsername)
+		}
+	}
+
+	previous, _ := readFile(conf.UsernamePath)
+	previousPassword, _ := readFile(conf.PasswordPath)
+	suffix, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+	password, err := randomHex(12)
+	if err != nil {
+		return err
+	}
+
+	state = &rotationState{
+		ID:               instr.ID,
+		Username:         "u_" + suffix,
+		Password:         password,
+		PreviousUsername: previous,
+		PreviousPassword: previousPassword,
+		OverlapSeconds:   instr.OverlapSeconds,
+	}
+
+	if err := addLogin(state.Username, state.Password); err != nil {
+		os.Remove(conf.RotationStatePath)
+		if reportErr := reportRotationFailure(id, instr.ID, err); reportErr != nil {
+			log.Printf("[-] Failed to report rotation failure: %v", reportErr)
+		}
+		return err
+	}
+	if err := state.save(); err != nil {
+		removeLogin(state.Username)
+		return err
+	}
+
+	log.Printf("[*] Staged new SOCKS login %s for rotation %s", state.Username, state.ID)
+	return confirmRotation(id, state)
+}
+
+// resumeRotation retries confirming staged credentials and deletes the
+// previous login once its overlap has passed
+func resumeRotation(id *Identity) error {
+	state, err := loadRotationState()
+	if err != nil || state == nil {
+		return err
+	}
+
+	if !state.Confirmed {
+		return confirmRotation(id, state)
+	}
+
+	if time.Now().After(state.RetireAt) {
+		if state.PreviousUsername != "" && state.PreviousUsername != state.Username {
+			retireLogin(state.PreviousUsername)
+		}
+		return os.Remove(conf.RotationStatePath)
+	}
+	return nil
+}
+
+// confirmRotation reports the staged credentials. Once the controller has
+// recorded them the agent switches its credential files over and starts the
+// overlap countdown.
+func confirmRotation(id *Identity, state *rotationState) error {
+	resp, err := postRotationConfirm(id, confirmRotationRequest{
+		RotationID: state.ID,
+		Username:   state.Username,
+		Password:   state.Password,
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return resyncSequence(resp.Body)
+	case http.StatusNotFound:
+		// Cancelled or failed on the controller; drop the staged login
+		removeLogin(state.Username)
+		os.Remove(conf.RotationStatePath)
+		return fmt.Errorf("controller no longer expects rotation %s", state.ID)
+	default:
+		return fmt.Errorf("confirm returned status %d, will retry", resp.StatusCode)
+	}
+
+	if err := os.WriteFile(conf.UsernamePath, []byte(state.Username), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(conf.PasswordPath, []byte(state.Password), 0600); err != nil {
+		return err
+	}
+
+	overlap := time.Duration(state.OverlapSeconds) * time.Second
+	state.Confirmed = true
+	state.RetireAt = time.Now().Add(overlap)
+	if err := state.save(); err != nil {
+		return err
+	}
+
+	log.Printf("[+] Rotated SOCKS credentials to %s; %s stays valid until %s",
+		state.Username, state.PreviousUsername, state.RetireAt.Format(time.RFC3339))
+	return nil
+}
+
+func reportRotationFailure(id *Identity, rotationID string, cause error) error {
+	resp, err := postRotationConfirm(id, confirmRotationRequest{RotationID: rotationID, Error: cause.Error()})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// postRotationConfirm sends a confirmation or failure report. It carries the
+// heartbeat sequence, so a captured one cannot be replayed.
+func postRotationConfirm(id *Identity, req confirmRotationRequest) (*http.Response, error) {
+	var err error
+	req.Seq, err = nextSequence()
+	if err != nil {
+		return nil, fmt.Errorf("sequence error: %w", err)
+	}
+	req.Timestamp = time.Now().Unix()
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return id.signedPost(rotationConfirmPath, data)
+}
+
+func retireLogin(username string) {
+	if err := removeLogin(username); err != nil {
+		log.Printf("[-] Failed to retire SOCKS login: %v", err)
+		return
+	}
+	log.Printf("[+] Retired previous SOCKS login %s", username)
+}
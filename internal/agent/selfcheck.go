@@ -0,0 +1,226 @@
+// internal/agent/selfcheck.go
+
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/dante"
+)
+
+// Self-check outcomes reported to the controller. Anything other than
+// SelfCheckOK names the step that failed.
+const (
+	SelfCheckOK              = "ok"
+	SelfCheckUnreachable     = "unreachable"
+	SelfCheckHandshakeFailed = "handshake_failed"
+	SelfCheckAuthFailed      = "auth_failed"
+	SelfCheckConnectFailed   = "connect_failed"
+)
+
+// SelfCheckResult is the outcome of one check of the local SOCKS5 service
+type SelfCheckResult struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+// selfCheckError carries the status for the step that failed
+type selfCheckError struct {
+	status string
+	err    error
+}
+
+func (e *selfCheckError) Error() string { return e.err.Error() }
+
+func stepFailed(status string, format string, args ...interface{}) error {
+	return &selfCheckError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// socksReplies are the CONNECT reply codes of RFC 1928 section 6
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// lastSelfCheck is the previous status per address checked, so only
+// changes are logged. Exits are checked in parallel, hence the lock.
+var (
+	lastSelfCheckMu sync.Mutex
+	lastSelfCheck   = map[string]string{}
+)
+
+// runSelfCheck connects to the local SOCKS service as a client would:
+// username/password authentication with the node's credentials, then a
+// CONNECT to target. Latency covers the whole exchange. via is the address
+// to reach the service on, or "" for the usual local addresses.
+func runSelfCheck(port int, username, password, target, via string) *SelfCheckResult {
+	start := time.Now()
+	err := socksSelfCheck(port, username, password, target, via)
+	result := &SelfCheckResult{
+		Status:    SelfCheckOK,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = SelfCheckUnreachable
+		var stepErr *selfCheckError
+		if errors.As(err, &stepErr) {
+			result.Status = stepErr.status
+		}
+		result.Error = err.Error()
+	}
+
+	lastSelfCheckMu.Lock()
+	defer lastSelfCheckMu.Unlock()
+	last, seen := lastSelfCheck[via]
+	if !seen {
+		last = SelfCheckOK
+	}
+	if result.Status != last {
+		name := "SOCKS self-check"
+		if via != "" {
+			name += " via " + via
+		}
+		if result.Status == SelfCheckOK {
+			log.Printf("[+] %s passing again", name)
+		} else {
+			log.Printf("[!] %s failed (%s): %s", name, result.Status, result.Error)
+		}
+	}
+	lastSelfCheck[via] = result.Status
+	return result
+}
+
+func socksSelfCheck(port int, username, password, target, via string) error {
+	conn, err := dialLocalSOCKS(port, via)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(conf.SelfCheckTimeout.Duration))
+
+	// Offer only username/password authentication (RFC 1929)
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x02}); err != nil {
+		return stepFailed(SelfCheckHandshakeFailed, "greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return stepFailed(SelfCheckHandshakeFailed, "greeting reply: %v", err)
+	}
+	if reply[0] != 0x05 || reply[1] != 0x02 {
+		return stepFailed(SelfCheckHandshakeFailed, "server did not accept username authentication (%#x %#x)", reply[0], reply[1])
+	}
+
+	if len(username) > 255 || len(password) > 255 {
+		return stepFailed(SelfCheckAuthFailed, "credentials longer than 255 bytes")
+	}
+	auth := []byte{0x01, byte(len(username))}
+	auth = append(auth, username...)
+	auth = append(auth, byte(len(password)))
+	auth = append(auth, password...)
+	if _, err := conn.Write(auth); err != nil {
+		return stepFailed(SelfCheckAuthFailed, "authentication: %v", err)
+	}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return stepFailed(SelfCheckAuthFailed, "authentication reply: %v", err)
+	}
+	if reply[1] != 0x00 {
+		return stepFailed(SelfCheckAuthFailed, "credentials rejected (status %d)", reply[1])
+	}
+
+	request, err := connectRequest(target)
+	if err != nil {
+		return stepFailed(SelfCheckConnectFailed, "%v", err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return stepFailed(SelfCheckConnectFailed, "connect request: %v", err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return stepFailed(SelfCheckConnectFailed, "connect reply: %v", err)
+	}
+	if header[1] != 0x00 {
+		reason, ok := socksReplies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("reply code %d", header[1])
+		}
+		return stepFailed(SelfCheckConnectFailed, "connect to %s: %s", target, reason)
+	}
+	return nil
+}
+
+// dialLocalSOCKS connects over loopback, where Dante also listens for the
+// agent's own checks. Configurations written by older versions only listen
+// on the primary interface, so its addresses are tried next. A host with
+// several exits is only reached through via.
+func dialLocalSOCKS(port int, via string) (net.Conn, error) {
+	if via != "" {
+		return net.DialTimeout("tcp", net.JoinHostPort(via, strconv.Itoa(port)), conf.SelfCheckTimeout.Duration)
+	}
+
+	addrs := []string{"127.0.0.1"}
+	if name, err := readFile(dante.InterfacePath); err == nil {
+		if iface, err := net.InterfaceByName(name); err == nil {
+			ifaceAddrs, _ := iface.Addrs()
+			for _, addr := range ifaceAddrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+					addrs = append(addrs, ipnet.IP.String())
+				}
+			}
+		}
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), conf.SelfCheckTimeout.Duration)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// connectRequest encodes a CONNECT for host:port, sending IP addresses as
+// such and anything else as a domain name for the server to resolve
+func connectRequest(target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid self-check target %q", target)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid self-check target port %q", portStr)
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	switch ip := net.ParseIP(host); {
+	case ip != nil && ip.To4() != nil:
+		request = append(request, 0x01)
+		request = append(request, ip.To4()...)
+	case ip != nil:
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("self-check target host too long")
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
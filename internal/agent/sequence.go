@@ -0,0 +1,88 @@
+// internal/agent/sequence.go
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// The sequence file (conf.SequencePath) holds the last heartbeat sequence
+// number used, so a restarted agent keeps counting up and the controller can
+// reject replayed heartbeats
+
+// sequenceMu makes reserving a number one step for the heartbeat loop,
+// deregistration and backfill, which can run at the same time
+var sequenceMu sync.Mutex
+
+func loadSequence() (int64, error) {
+	raw, err := readFile(conf.SequencePath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	seq, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt sequence file %s: %w", conf.SequencePath, err)
+	}
+	return seq, nil
+}
+
+// saveSequence writes seq through a temporary file so a crash never leaves a
+// truncated counter behind
+func saveSequence(seq int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(conf.SequencePath), ".trinityproxy-seq-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatInt(seq, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), conf.SequencePath)
+}
+
+// nextSequence reserves the next sequence number. It is persisted before the
+// heartbeat is sent, so a number is never reused even if sending fails.
+func nextSequence() (int64, error) {
+	sequenceMu.Lock()
+	defer sequenceMu.Unlock()
+
+	seq, err := loadSequence()
+	if err != nil {
+		return 0, err
+	}
+	seq++
+	if err := saveSequence(seq); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// skipSequence moves the counter past last, the highest number the
+// controller has accepted. It never moves it back.
+func skipSequence(last int64) error {
+	sequenceMu.Lock()
+	defer sequenceMu.Unlock()
+
+	seq, err := loadSequence()
+	if err != nil || seq >= last {
+		return err
+	}
+	return saveSequence(last)
+}
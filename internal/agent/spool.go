@@ -0,0 +1,176 @@
+// internal/agent/spool.go
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	batchPath = "/api/heartbeat/batch"
+
+	// spoolBatchSize is how many spooled heartbeats are sent per request
+	spoolBatchSize = 100
+)
+
+// spooledHeartbeat is the health snapshot of a heartbeat that could not be
+// delivered, kept with the sequence number reserved for it so the
+// controller can tell a batch it already stored from a new one
+type spooledHeartbeat struct {
+	Seq       int64            `json:"seq"`
+	Timestamp int64            `json:"timestamp"`
+	Metrics   *HostMetrics     `json:"metrics,omitempty"`
+	SelfCheck *SelfCheckResult `json:"self_check,omitempty"`
+}
+
+// heartbeatBatch is the body of a backfill request. Seq and Timestamp are
+// the request's own, checked like a heartbeat's.
+type heartbeatBatch struct {
+	Heartbeats []spooledHeartbeat `json:"heartbeats"`
+	Seq        int64              `json:"seq"`
+	Timestamp  int64              `json:"timestamp"`
+}
+
+// spoolHeartbeat queues a heartbeat that failed to reach any controller.
+// The spool keeps the newest conf.SpoolLimit entries.
+func spoolHeartbeat(meta *NodeMetadata) {
+	if conf.SpoolLimit <= 0 {
+		return
+	}
+
+	entries, err := loadSpool()
+	if err != nil {
+		log.Printf("[-] Failed to read heartbeat spool: %v", err)
+	}
+	entries = append(entries, spooledHeartbeat{
+		Seq:       meta.Seq,
+		Timestamp: meta.Timestamp,
+		Metrics:   meta.Metrics,
+		SelfCheck: meta.SelfCheck,
+	})
+	if len(entries) > conf.SpoolLimit {
+		entries = entries[len(entries)-conf.SpoolLimit:]
+	}
+
+	if err := saveSpool(entries); err != nil {
+		log.Printf("[-] Failed to write heartbeat spool: %v", err)
+	}
+}
+
+// flushSpool delivers spooled heartbeats oldest first, removing each batch
+// from the spool once the controller has accepted it
+func flushSpool(ctx context.Context, id *Identity) error {
+	entries, err := loadSpool()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	total := len(entries)
+	for len(entries) > 0 {
+		n := min(len(entries), spoolBatchSize)
+		if err := sendBatch(ctx, id, entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+		if err := saveSpool(entries); err != nil {
+			return fmt.Errorf("failed to update heartbeat spool: %w", err)
+		}
+	}
+
+	log.Printf("[+] Delivered %d heartbeats spooled during the outage", total)
+	return nil
+}
+
+func sendBatch(ctx context.Context, id *Identity, entries []spooledHeartbeat) error {
+	batch := heartbeatBatch{Heartbeats: entries}
+	var err error
+	if batch.Seq, err = nextSequence(); err != nil {
+		return fmt.Errorf("sequence error: %w", err)
+	}
+	batch.Timestamp = time.Now().Unix()
+
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+
+	resp, err := id.signedPostContext(ctx, batchPath, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return resyncSequence(resp.Body)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("API returned status %d for spooled heartbeats", resp.StatusCode)
+	}
+	return nil
+}
+
+// loadSpool reads the spool, one JSON entry per line. Lines that cannot be
+// parsed, such as one cut short by a crash, are skipped.
+func loadSpool() ([]spooledHeartbeat, error) {
+	data, err := os.ReadFile(conf.SpoolPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []spooledHeartbeat
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry spooledHeartbeat
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Seq > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// saveSpool replaces the spool through a temporary file so a crash never
+// leaves it half written. An empty spool is removed.
+func saveSpool(entries []spooledHeartbeat) error {
+	if len(entries) == 0 {
+		if err := os.Remove(conf.SpoolPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(conf.SpoolPath), ".trinityproxy-spool-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), conf.SpoolPath)
+}
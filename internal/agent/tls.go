@@ -0,0 +1,116 @@
+// internal/agent/tls.go
+
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// createCSR builds a PEM certificate request for the node's Ed25519 key so
+// the controller's CA can issue a client certificate bound to the same key
+func createCSR(key ed25519.PrivateKey, hostname string) (string, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: hostname},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// enrollmentClient returns the HTTP client used for the join request. When a
+// CA fingerprint is given, the controller's chain must contain a CA with that
+// SHA-256 fingerprint and the server certificate must verify against it;
+// otherwise the system trust store (plus the configured CA file) is used.
+func enrollmentClient(caFingerprint string) *http.Client {
+	client := &http.Client{Timeout: conf.RequestTimeout.Duration}
+	if caFingerprint == "" {
+		client.Transport = configuredTransport()
+		return client
+	}
+
+	want := strings.ToLower(strings.ReplaceAll(caFingerprint, ":", ""))
+	client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			// Standard verification is replaced by the pinned check below
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				for _, cert := range cs.PeerCertificates {
+					sum := sha256.Sum256(cert.Raw)
+					if hex.EncodeToString(sum[:]) != want {
+						continue
+					}
+					pool := x509.NewCertPool()
+					pool.AddCert(cert)
+					_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+						DNSName: cs.ServerName,
+						Roots:   pool,
+					})
+					return err
+				}
+				return fmt.Errorf("controller CA does not match pinned fingerprint")
+			},
+		},
+	}
+	return client
+}
+
+// HTTPClient returns a client for talking to the controller. If enrollment
+// produced a client certificate, the client presents it and trusts only the
+// controller's CA; otherwise it uses the system trust store plus the
+// configured CA file.
+func (id *Identity) HTTPClient(timeout time.Duration) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if id.Certificate == "" || id.CACertificate == "" {
+		client.Transport = configuredTransport()
+		return client, nil
+	}
+
+	certBlock, _ := pem.Decode([]byte(id.Certificate))
+	if certBlock == nil {
+		return nil, fmt.Errorf("corrupt client certificate in %s", conf.IdentityPath)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(id.CACertificate)) {
+		return nil, fmt.Errorf("corrupt CA certificate in %s", conf.IdentityPath)
+	}
+
+	client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{certBlock.Bytes},
+				PrivateKey:  id.key,
+			}},
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	return client, nil
+}
+
+// configuredTransport trusts the CA file from the agent config, if any, on
+// top of the system roots. It returns nil, the default transport, otherwise.
+func configuredTransport() http.RoundTripper {
+	if conf.roots == nil {
+		return nil
+	}
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    conf.roots,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+}
@@ -0,0 +1,384 @@
+// internal/agent/update.go
+
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/release"
+)
+
+const (
+	releaseDownloadPath = "/api/releases/download"
+
+	// AgentServiceName is the systemd unit the agent runs under
+	AgentServiceName = "trinityproxy-agent"
+
+	// downloadTimeout bounds fetching a release binary
+	downloadTimeout = 10 * time.Minute
+)
+
+// Version is the running agent's version, reported in heartbeats. main sets
+// it from the version stamped in at build time.
+var Version = "dev"
+
+// Update states. An installed release is pending until it sends its first
+// heartbeat; one that misses the deadline is rolled back.
+const (
+	updatePending    = "pending"
+	updateRolledBack = "rolled_back"
+)
+
+// updateInstruction is the argument of an update_agent command
+type updateInstruction struct {
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	Signature string `json:"signature"`
+}
+
+// updateState tracks an update across the restart into the new binary.
+// Backup is the previous binary, kept so the update can be undone.
+type updateState struct {
+	CommandID       string    `json:"command_id"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version"`
+	Binary          string    `json:"binary"`
+	Backup          string    `json:"backup"`
+	Deadline        time.Time `json:"deadline"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// errAckDeferred means the agent is restarting into a new release, which
+// reports the command's outcome once it is running
+var errAckDeferred = errors.New("outcome reported after restart")
+
+// updateMu serializes the heartbeat confirming an update and the deadline
+// rolling it back
+var updateMu sync.Mutex
+
+func loadUpdateState() (*updateState, error) {
+	data, err := os.ReadFile(conf.UpdateStatePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state updateState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("corrupt update state %s: %w", conf.UpdateStatePath, err)
+	}
+	return &state, nil
+}
+
+func (s *updateState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(conf.UpdateStatePath, data, 0600)
+}
+
+func clearUpdateState() {
+	if err := os.Remove(conf.UpdateStatePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("[-] Failed to remove update state: %v", err)
+	}
+}
+
+// releaseKey returns the key releases must be signed with: the configured
+// one, otherwise the one received at enrollment
+func releaseKey(id *Identity) (ed25519.PublicKey, error) {
+	encoded := conf.ReleasePublicKey
+	if encoded == "" {
+		encoded = id.ReleasePublicKey
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no release public key: set release_public_key or re-enroll with a controller that has one")
+	}
+	return release.ParsePublicKey(encoded)
+}
+
+// installUpdate downloads and verifies a release, swaps it in for the
+// running binary and restarts the service into it. The previous binary is
+// kept next to it until the new one has sent a heartbeat.
+func installUpdate(id *Identity, commandID string, instr *updateInstruction) (interface{}, error) {
+	if instr.Version == Version {
+		return map[string]string{"version": Version}, nil
+	}
+	if !release.ValidVersion(instr.Version) || instr.Size <= 0 || instr.Size > release.MaxSize {
+		return nil, fmt.Errorf("invalid update instruction")
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	if state, err := loadUpdateState(); err != nil || state != nil {
+		// The controller resends the command until the restarted agent
+		// reports on it
+		if state != nil && state.CommandID == commandID {
+			return nil, errAckDeferred
+		}
+		return nil, fmt.Errorf("an earlier update is still in progress")
+	}
+
+	// The signature covers the version and digest, so check it before
+	// fetching anything
+	key, err := releaseKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := release.Verify(key, instr.Version, instr.SHA256, instr.Signature); err != nil {
+		return nil, err
+	}
+
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot locate the agent binary: %w", err)
+	}
+
+	log.Printf("[*] Downloading agent release %s (%d bytes)", instr.Version, instr.Size)
+	staged, err := downloadRelease(id, instr, filepath.Dir(binary))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(staged)
+
+	// The backup is a second link to the running binary, so the rename
+	// below replaces the binary in one step and the old one stays whole
+	backup := binary + ".previous"
+	os.Remove(backup)
+	if err := os.Link(binary, backup); err != nil {
+		return nil, fmt.Errorf("failed to keep the current binary: %w", err)
+	}
+	if err := os.Rename(staged, binary); err != nil {
+		os.Remove(backup)
+		return nil, fmt.Errorf("failed to install release: %w", err)
+	}
+
+	state := &updateState{
+		CommandID:       commandID,
+		Version:         instr.Version,
+		PreviousVersion: Version,
+		Binary:          binary,
+		Backup:          backup,
+		Deadline:        time.Now().Add(conf.UpdateDeadline.Duration),
+		Status:          updatePending,
+	}
+	undo := func(err error) error {
+		if renameErr := os.Rename(backup, binary); renameErr != nil {
+			log.Printf("[-] Failed to restore %s from %s: %v", binary, backup, renameErr)
+		}
+		clearUpdateState()
+		return err
+	}
+	if err := state.save(); err != nil {
+		return nil, undo(fmt.Errorf("failed to save update state: %w", err))
+	}
+
+	scheduleUpdateCheck(backup)
+	if err := restartAgent(); err != nil {
+		return nil, undo(err)
+	}
+
+	log.Printf("[+] Installed agent %s, restarting into it (rolled back unless it sends a heartbeat by %s)",
+		instr.Version, state.Deadline.Format(time.RFC3339))
+	return nil, errAckDeferred
+}
+
+// downloadRelease fetches a release into a temporary file in dir, checking
+// its size and SHA256 against the instruction
+func downloadRelease(id *Identity, instr *updateInstruction, dir string) (string, error) {
+	data, err := json.Marshal(map[string]string{"version": instr.Version})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := id.signedPostTimeout(context.Background(), releaseDownloadPath, data, downloadTimeout)
+	if err != nil {
+		return "", fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: API returned status %d", resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".trinityproxy-update-*")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, instr.Size+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != instr.Size {
+		err = fmt.Errorf("downloaded %d bytes, expected %d", written, instr.Size)
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != instr.SHA256 {
+		err = fmt.Errorf("downloaded binary does not match the signed SHA256")
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0755)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// restartAgent asks systemd to restart the agent without waiting, since the
+// restart stops this process
+func restartAgent() error {
+	exec.Command("systemctl", "reset-failed", AgentServiceName).Run()
+	if out, err := exec.Command("systemctl", "restart", "--no-block", AgentServiceName).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restart %s: %v: %s", AgentServiceName, err, out)
+	}
+	return nil
+}
+
+// scheduleUpdateCheck has systemd run the previous binary's update-check
+// once the deadline has passed. It rolls back a release that crashes before
+// it can watch its own deadline.
+func scheduleUpdateCheck(backup string) {
+	delay := conf.UpdateDeadline.Duration + time.Minute
+	args := []string{
+		"--on-active=" + strconv.Itoa(int(delay.Seconds())) + "s",
+		"--unit=trinityproxy-update-check-" + strconv.FormatInt(time.Now().Unix(), 10),
+		backup, "update-check",
+	}
+	if path := os.Getenv("TRINITY_AGENT_CONFIG"); path != "" {
+		args = append(args, "-config", path)
+	}
+	if out, err := exec.Command("systemd-run", args...).CombinedOutput(); err != nil {
+		log.Printf("[!] Could not schedule an independent update check, relying on the new release: %v: %s", err, out)
+	}
+}
+
+// resumeUpdate runs when the agent starts. An update that was rolled back is
+// reported as failed. A release waiting for its first heartbeat is rolled
+// back once its deadline passes, at once if it already has or if the binary
+// running is neither the release nor the version it replaced.
+func resumeUpdate(ctx context.Context) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	state, err := loadUpdateState()
+	if err != nil || state == nil {
+		if err != nil {
+			log.Printf("[-] Update: %v", err)
+		}
+		return
+	}
+
+	switch {
+	case state.Status == updateRolledBack:
+		log.Printf("[-] Update to agent %s failed: %s", state.Version, state.Error)
+		queueAck(commandAck{ID: state.CommandID, Status: "failed", Error: state.Error})
+		clearUpdateState()
+
+	case Version == state.PreviousVersion:
+		// Still the old binary, so the swap or restart did not take
+		state.Error = fmt.Sprintf("agent restarted as %s instead of %s", Version, state.Version)
+		log.Printf("[-] Update to agent %s failed: %s", state.Version, state.Error)
+		queueAck(commandAck{ID: state.CommandID, Status: "failed", Error: state.Error})
+		os.Remove(state.Backup)
+		clearUpdateState()
+
+	case Version != state.Version:
+		// Some other binary is running in the release's place; it was never
+		// confirmed, so go back to the one that was
+		rollbackUpdate(state, "started as version "+Version)
+
+	case time.Now().After(state.Deadline):
+		rollbackUpdate(state, "was not confirmed before its deadline")
+
+	default:
+		log.Printf("[*] Running agent %s on trial until %s", Version, state.Deadline.Format(time.RFC3339))
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(state.Deadline)):
+				updateMu.Lock()
+				defer updateMu.Unlock()
+				if current, err := loadUpdateState(); err == nil && current != nil && current.Status == updatePending {
+					rollbackUpdate(current, "did not send a heartbeat before its deadline")
+				}
+			}
+		}()
+	}
+}
+
+// CheckUpdate rolls back a pending update whose deadline has passed. It is
+// run by the previous binary through systemd, independently of the new one.
+func CheckUpdate() {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	state, err := loadUpdateState()
+	if err != nil {
+		log.Printf("[-] Update: %v", err)
+		return
+	}
+	if state != nil && state.Status == updatePending && time.Now().After(state.Deadline) {
+		rollbackUpdate(state, "did not send a heartbeat before its deadline")
+	}
+}
+
+// confirmUpdate marks a pending update as done after the new release's
+// first accepted heartbeat. Called with the heartbeat's response in hand.
+func confirmUpdate() {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	state, err := loadUpdateState()
+	if err != nil || state == nil || state.Status != updatePending || state.Version != Version {
+		return
+	}
+
+	result, _ := json.Marshal(map[string]string{"version": Version, "previous_version": state.PreviousVersion})
+	queueAck(commandAck{ID: state.CommandID, Status: "succeeded", Result: result})
+	clearUpdateState()
+	log.Printf("[+] Update from agent %s to %s confirmed", state.PreviousVersion, Version)
+}
+
+// rollbackUpdate restores the previous binary and restarts into it. The
+// previous version reports the failure when it starts.
+func rollbackUpdate(state *updateState, reason string) {
+	log.Printf("[!] Agent %s %s, rolling back to %s", state.Version, reason, state.PreviousVersion)
+	if err := os.Rename(state.Backup, state.Binary); err != nil {
+		log.Printf("[-] Rollback failed, restore %s by hand: %v", state.Backup, err)
+		return
+	}
+
+	state.Status = updateRolledBack
+	state.Error = fmt.Sprintf("agent %s %s, rolled back to %s", state.Version, reason, state.PreviousVersion)
+	if err := state.save(); err != nil {
+		log.Printf("[-] Failed to save update state: %v", err)
+	}
+	if err := restartAgent(); err != nil {
+		log.Printf("[-] %v, exiting so the service manager restarts the agent", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,201 @@
+// internal/dante/config.go
+package dante
+
+import (
+	"net"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+const (
+	ConfPath      = "/etc/danted.conf"
+	InterfacePath = "/etc/trinityproxy-interface"
+	ExitsPath     = "/etc/trinityproxy-exits"
+	User          = "nobody"
+	ServiceName   = "trinityproxy"
+)
+
+// Config is everything needed to render /etc/danted.conf
+type Config struct {
+	Interface string
+	Port      int
+	User      string
+	Policy    *policy.Policy
+
+	// IPv6 adds rules for IPv6 clients and destinations. Set it only when
+	// the interface has an IPv6 address; otherwise IPv6 entries in the
+	// policy are left out.
+	IPv6 bool
+
+	// Exits, when set, are the public addresses to serve instead of the
+	// interface as a whole: one listener per address, with traffic sent out
+	// from the address the client connected to
+	Exits []string
+}
+
+// Only username authentication is offered. Dante also listens on loopback,
+// where clients are admitted so the agent's self-check works under any
+// client policy. That admits every local process, so a policy with
+// BlockLocalClients leaves the loopback rule out and local clients must be
+// covered by the allowed CIDRs like any other. Client rules admit the
+// allowed CIDRs; socks rules block the configured destinations before
+// passing authenticated traffic, since Dante applies the first matching
+// rule. Dante's 0.0.0.0/0 only matches IPv4, so rules that apply to any
+// address are repeated with ::/0.
+//
+// With several exits, same-same rotation sends each connection out from the
+// address it arrived on. Loopback has no matching external address then, so
+// the agent checks each exit directly and connections from the host's own
+// addresses are admitted instead, unless BlockLocalClients is set.
+const confTemplate = `# Dante SOCKS5 Server Configuration
+# Generated by TrinityProxy (policy {{.Policy.Version}}), do not edit by hand
+
+logoutput: /var/log/danted.log
+{{- if .Exits}}
+{{range .Exits}}internal: {{.}} port = {{$.Port}}
+{{end}}{{range .Exits}}external: {{.}}
+{{end}}external.rotation: same-same
+{{- else}}
+internal: {{.Interface}} port = {{.Port}}
+internal: 127.0.0.1 port = {{.Port}}
+external: {{.Interface}}
+{{- end}}
+
+socksmethod: username
+user.notprivileged: {{.User}}
+{{if .Policy.BlockLocalClients}}{{else if .Exits}}{{range .Exits}}
+client pass {
+  from: {{host .}} to: {{wildcard (host .)}}
+  log: error
+}
+{{end}}{{else}}
+client pass {
+  from: 127.0.0.0/8 to: 0.0.0.0/0
+  log: error
+}
+{{end}}{{range .ClientCIDRs}}
+client pass {
+  from: {{.}} to: {{wildcard .}}
+  log: error
+}
+{{end}}{{range .Wildcards}}
+client block {
+  from: {{.}} to: {{.}}
+  log: connect error
+}
+{{end}}{{range $dest := .BlockedDestinations}}{{range $.Wildcards}}
+socks block {
+  from: {{.}} to: {{$dest}}
+  log: connect error
+}
+{{end}}{{end}}{{range $port := .Policy.BlockedDestinationPorts}}{{range $from := $.Wildcards}}{{range $to := $.Wildcards}}
+socks block {
+  from: {{$from}} to: {{$to}} port = {{$port}}
+  log: connect error
+}
+{{end}}{{end}}{{end}}
+# Allow authenticated connections
+{{- range $from := .Wildcards}}{{range $to := $.Wildcards}}
+socks pass {
+  from: {{$from}} to: {{$to}}
+  protocol: tcp udp
+  command: connect
+  log: connect disconnect
+  socksmethod: username
+}
+{{end}}{{end}}`
+
+var tmpl = template.Must(template.New("danted").Funcs(template.FuncMap{"wildcard": wildcard, "host": host}).Parse(confTemplate))
+
+// Wildcards are the networks matching any address of each enabled family
+func (c *Config) Wildcards() []string {
+	if c.IPv6 {
+		return []string{"0.0.0.0/0", "::/0"}
+	}
+	return []string{"0.0.0.0/0"}
+}
+
+// ClientCIDRs are the policy's allowed client networks for enabled families
+func (c *Config) ClientCIDRs() []string {
+	return c.enabled(c.Policy.AllowedClientCIDRs)
+}
+
+// BlockedDestinations are the policy's blocked networks for enabled families
+func (c *Config) BlockedDestinations() []string {
+	return c.enabled(c.Policy.BlockedDestinations())
+}
+
+func (c *Config) enabled(cidrs []string) []string {
+	var out []string
+	for _, cidr := range cidrs {
+		if c.IPv6 || !isIPv6(cidr) {
+			out = append(out, cidr)
+		}
+	}
+	return out
+}
+
+// wildcard returns the any-address network of cidr's family
+func wildcard(cidr string) string {
+	if isIPv6(cidr) {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+// host returns the single-address network of ip
+func host(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+func isIPv6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// WriteFile renders the configuration to path
+func (c *Config) WriteFile(path string) error {
+	if c.Policy == nil {
+		c.Policy = policy.Default()
+	}
+	if err := c.Policy.Validate(); err != nil {
+		return err
+	}
+	c.Policy.Version = c.Policy.ComputeVersion()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return tmpl.Execute(file, c)
+}
+
+// SaveExits records the exits being served, one per line, so the agent
+// reports exactly the addresses the SOCKS service listens on. A host
+// without exits has no file.
+func SaveExits(exits []string) error {
+	if len(exits) == 0 {
+		if err := os.Remove(ExitsPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(ExitsPath, []byte(strings.Join(exits, "\n")+"\n"), 0644)
+}
+
+// LoadExits returns the exits saved by SaveExits
+func LoadExits() []string {
+	data, err := os.ReadFile(ExitsPath)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
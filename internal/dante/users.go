@@ -0,0 +1,33 @@
+// internal/dante/users.go
+package dante
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Dante's username method checks credentials against system accounts, so
+// every SOCKS login is a system user without a shell. Several can exist at
+// once, which is what lets credential rotation keep the old login working.
+
+// CreateUser adds a SOCKS login, or resets the password of an existing one
+func CreateUser(username, password string) error {
+	// useradd fails if the user already exists; chpasswd below still applies
+	exec.Command("useradd", "-r", "-s", "/bin/false", username).Run()
+
+	cmd := exec.Command("chpasswd")
+	cmd.Stdin = strings.NewReader(username + ":" + password)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to set password for user %s: %v: %s", username, err, out)
+	}
+	return nil
+}
+
+// DeleteUser removes a SOCKS login
+func DeleteUser(username string) error {
+	if out, err := exec.Command("userdel", username).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete user %s: %v: %s", username, err, out)
+	}
+	return nil
+}
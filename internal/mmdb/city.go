@@ -0,0 +1,55 @@
+// internal/mmdb/city.go
+package mmdb
+
+import "net"
+
+// City is the location fields of a GeoIP2/GeoLite2 City or Country record,
+// with English names. Country databases leave Region, City and PostalCode
+// empty.
+type City struct {
+	Country     string
+	CountryCode string
+	Region      string
+	RegionCode  string
+	City        string
+	PostalCode  string
+}
+
+// LookupCity looks up ip and maps the record to a City. found is false when
+// the database has no entry covering ip.
+func (r *Reader) LookupCity(ip net.IP) (City, bool, error) {
+	record, found, err := r.Lookup(ip)
+	if err != nil || !found {
+		return City{}, found, err
+	}
+
+	var subdivision interface{}
+	if subs, ok := field(record, "subdivisions").([]interface{}); ok && len(subs) > 0 {
+		subdivision = subs[0]
+	}
+	return City{
+		Country:     stringField(record, "country", "names", "en"),
+		CountryCode: stringField(record, "country", "iso_code"),
+		Region:      stringField(subdivision, "names", "en"),
+		RegionCode:  stringField(subdivision, "iso_code"),
+		City:        stringField(record, "city", "names", "en"),
+		PostalCode:  stringField(record, "postal", "code"),
+	}, true, nil
+}
+
+// field walks nested maps by key, returning nil when any step is missing
+func field(record interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = m[key]
+	}
+	return record
+}
+
+func stringField(record interface{}, keys ...string) string {
+	s, _ := field(record, keys...).(string)
+	return s
+}
@@ -0,0 +1,215 @@
+// internal/mmdb/decoder.go
+package mmdb
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Data section field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth bounds nesting so a corrupt file cannot recurse forever
+const maxDepth = 64
+
+// decoder reads values from a data section. Pointers are offsets from the
+// start of buf.
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at offset and the offset just past it
+func (d *decoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("data nested more than %d levels", maxDepth)
+	}
+	ctrl, offset, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	typ := int(ctrl >> 5)
+	if typ == typePointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		val, _, err := d.decode(target, depth+1)
+		return val, next, err
+	}
+	if typ == typeExtended {
+		var ext byte
+		if ext, offset, err = d.byteAt(offset); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + int(ext)
+	}
+
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, val interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is %T, not a string", key)
+			}
+			if val, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[name] = val
+		}
+		return m, offset, nil
+
+	case typeArray:
+		arr := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			var val interface{}
+			if val, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, val)
+		}
+		return arr, offset, nil
+
+	case typeBool:
+		if size > 1 {
+			return nil, 0, fmt.Errorf("invalid boolean size %d", size)
+		}
+		return size == 1, offset, nil
+	}
+
+	raw, next, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes:
+		return append([]byte(nil), raw...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(uint64(unsigned(raw))), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(uint32(unsigned(raw)))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		return unsigned(raw), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size %d", size)
+		}
+		return int32(uint32(unsigned(raw))), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("invalid uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(raw), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// size reads the payload size from the control byte and any extra bytes
+func (d *decoder) size(ctrl byte, offset int) (int, int, error) {
+	size := int(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	extra, next, err := d.bytes(offset, size-28)
+	if err != nil {
+		return 0, 0, err
+	}
+	n := int(unsigned(extra))
+	switch size {
+	case 29:
+		return 29 + n, next, nil
+	case 30:
+		return 285 + n, next, nil
+	default:
+		return 65821 + n, next, nil
+	}
+}
+
+// pointer returns the offset a pointer refers to and the offset past it
+func (d *decoder) pointer(ctrl byte, offset int) (int, int, error) {
+	ss := int(ctrl>>3) & 0x3
+	raw, next, err := d.bytes(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	vvv := uint64(ctrl & 0x7)
+	val := unsigned(raw)
+	switch ss {
+	case 0:
+		val |= vvv << 8
+	case 1:
+		val = (val | vvv<<16) + 2048
+	case 2:
+		val = (val | vvv<<24) + 526336
+	}
+	if val >= uint64(len(d.buf)) {
+		return 0, 0, fmt.Errorf("pointer %d beyond data section", val)
+	}
+	return int(val), next, nil
+}
+
+func (d *decoder) byteAt(offset int) (byte, int, error) {
+	if offset < 0 || offset >= len(d.buf) {
+		return 0, 0, fmt.Errorf("unexpected end of data at offset %d", offset)
+	}
+	return d.buf[offset], offset + 1, nil
+}
+
+func (d *decoder) bytes(offset, n int) ([]byte, int, error) {
+	if offset < 0 || n < 0 || offset+n > len(d.buf) {
+		return nil, 0, fmt.Errorf("unexpected end of data at offset %d", offset)
+	}
+	return d.buf[offset : offset+n], offset + n, nil
+}
+
+// unsigned decodes a big-endian integer of up to eight bytes
+func unsigned(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
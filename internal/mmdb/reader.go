@@ -0,0 +1,178 @@
+// internal/mmdb/reader.go
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata map at the end of every MaxMind DB file
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSectionSeparator is the run of zero bytes between the search tree and
+// the data section
+const dataSectionSeparator = 16
+
+// ErrInvalidDatabase is returned for files that are not valid MaxMind DBs
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB file")
+
+// Metadata describes a database
+type Metadata struct {
+	DatabaseType string
+	IPVersion    uint64
+	NodeCount    uint64
+	RecordSize   uint64
+	BuildEpoch   uint64
+	Languages    []string
+}
+
+// Reader looks up addresses in a MaxMind DB (.mmdb) file, such as the
+// GeoLite2 and GeoIP2 databases, following version 2.0 of the format
+// specification. The whole file is held in memory.
+type Reader struct {
+	Metadata Metadata
+
+	buf       []byte
+	data      decoder
+	ipv4Start uint64
+}
+
+// Open reads the database at path
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// FromBytes parses a database already in memory
+func FromBytes(buf []byte) (*Reader, error) {
+	markerAt := bytes.LastIndex(buf, metadataMarker)
+	if markerAt < 0 {
+		return nil, fmt.Errorf("%w: metadata marker not found", ErrInvalidDatabase)
+	}
+
+	meta := decoder{buf: buf[markerAt+len(metadataMarker):]}
+	raw, _, err := meta.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %v", ErrInvalidDatabase, err)
+	}
+	fields, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	r := &Reader{buf: buf}
+	r.Metadata.DatabaseType, _ = fields["database_type"].(string)
+	r.Metadata.IPVersion, _ = fields["ip_version"].(uint64)
+	r.Metadata.NodeCount, _ = fields["node_count"].(uint64)
+	r.Metadata.RecordSize, _ = fields["record_size"].(uint64)
+	r.Metadata.BuildEpoch, _ = fields["build_epoch"].(uint64)
+	if langs, ok := fields["languages"].([]interface{}); ok {
+		for _, lang := range langs {
+			if s, ok := lang.(string); ok {
+				r.Metadata.Languages = append(r.Metadata.Languages, s)
+			}
+		}
+	}
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrInvalidDatabase, r.Metadata.IPVersion)
+	}
+
+	// Each node holds two records; check the count against the file size
+	// before multiplying so a huge node_count cannot wrap around
+	nodeSize := r.Metadata.RecordSize / 4
+	if r.Metadata.NodeCount > uint64(markerAt)/nodeSize {
+		return nil, fmt.Errorf("%w: search tree larger than file", ErrInvalidDatabase)
+	}
+	treeSize := r.Metadata.NodeCount * nodeSize
+	if treeSize+dataSectionSeparator > uint64(markerAt) {
+		return nil, fmt.Errorf("%w: search tree larger than file", ErrInvalidDatabase)
+	}
+	r.data = decoder{buf: buf[treeSize+dataSectionSeparator : markerAt]}
+
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if r.Metadata.IPVersion == 6 {
+		node := uint64(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record for ip, decoded into maps, slices, strings,
+// uint64, int32, *big.Int (uint128), float64, bool and []byte. found is false
+// when the database has no entry covering ip.
+func (r *Reader) Lookup(ip net.IP) (record interface{}, found bool, err error) {
+	addr := ip.To4()
+	node := r.ipv4Start
+	if addr == nil {
+		addr = ip.To16()
+		if addr == nil {
+			return nil, false, fmt.Errorf("invalid IP address %q", ip)
+		}
+		if r.Metadata.IPVersion == 4 {
+			return nil, false, fmt.Errorf("IPv6 address %s in an IPv4-only database", ip)
+		}
+		node = 0
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < len(addr)*8 && node < nodeCount; i++ {
+		bit := (addr[i/8] >> (7 - uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+
+	switch {
+	case node == nodeCount:
+		return nil, false, nil
+	case node > nodeCount:
+		offset := node - nodeCount - dataSectionSeparator
+		if offset >= uint64(len(r.data.buf)) {
+			return nil, false, fmt.Errorf("%w: record pointer out of range", ErrInvalidDatabase)
+		}
+		record, _, err := r.data.decode(int(offset), 0)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+		}
+		return record, true, nil
+	default:
+		return nil, false, fmt.Errorf("%w: search tree deeper than the address", ErrInvalidDatabase)
+	}
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a tree node
+func (r *Reader) readNode(node uint64, bit byte) uint64 {
+	b := r.buf
+	switch r.Metadata.RecordSize {
+	case 24:
+		off := node*6 + uint64(bit)*3
+		return uint64(b[off])<<16 | uint64(b[off+1])<<8 | uint64(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint64(b[off+3]&0xF0)<<20 | uint64(b[off])<<16 | uint64(b[off+1])<<8 | uint64(b[off+2])
+		}
+		return uint64(b[off+3]&0x0F)<<24 | uint64(b[off+4])<<16 | uint64(b[off+5])<<8 | uint64(b[off+6])
+	default:
+		off := node*8 + uint64(bit)*4
+		return uint64(b[off])<<24 | uint64(b[off+1])<<16 | uint64(b[off+2])<<8 | uint64(b[off+3])
+	}
+}
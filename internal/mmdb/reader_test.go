@@ -0,0 +1,187 @@
+// internal/mmdb/reader_test.go
+package mmdb
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//go:generate go run testdata/generate.go
+
+var (
+	mountainView = City{
+		Country:     "United States",
+		CountryCode: "US",
+		Region:      "California",
+		RegionCode:  "CA",
+		City:        "Mountain View",
+		PostalCode:  "94043",
+	}
+	berlin = City{Country: "Germany", CountryCode: "DE", City: "Berlin"}
+	munich = City{Country: "Germany", CountryCode: "DE", City: "Munich"}
+	tokyo  = City{Country: "Japan", CountryCode: "JP", City: "Tokyo"}
+)
+
+func openFixture(t *testing.T, name string) *Reader {
+	t.Helper()
+	r, err := Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Open(%s): %v", name, err)
+	}
+	return r
+}
+
+func TestLookupCityIPv6Tree(t *testing.T) {
+	tests := []struct {
+		ip    string
+		want  City
+		found bool
+	}{
+		{"1.2.3.4", mountainView, true},
+		{"::ffff:1.2.3.4", mountainView, true}, // IPv4-mapped
+		{"::1.2.3.4", mountainView, true},      // walks ::/96 from the root
+		{"5.6.7.8", berlin, true},              // country behind a one-byte pointer
+		{"5.6.9.200", munich, true},            // same pointer target, /23
+		{"2001:db8::1", tokyo, true},           // country behind a two-byte pointer
+		{"2001:db8:ffff::1", tokyo, true},
+		{"5.6.10.1", City{}, false},
+		{"9.9.9.9", City{}, false},
+		{"2001:db9::1", City{}, false},
+	}
+
+	for _, name := range []string{"test-ipv6-24.mmdb", "test-ipv6-28.mmdb", "test-ipv6-32.mmdb"} {
+		t.Run(name, func(t *testing.T) {
+			r := openFixture(t, name)
+			for _, tt := range tests {
+				got, found, err := r.LookupCity(net.ParseIP(tt.ip))
+				if err != nil {
+					t.Errorf("LookupCity(%s): %v", tt.ip, err)
+					continue
+				}
+				if found != tt.found || got != tt.want {
+					t.Errorf("LookupCity(%s) = %+v, %v; want %+v, %v", tt.ip, got, found, tt.want, tt.found)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupCityIPv4Tree(t *testing.T) {
+	r := openFixture(t, "test-ipv4-24.mmdb")
+
+	for ip, want := range map[string]City{"1.2.3.4": mountainView, "::ffff:5.6.7.8": berlin} {
+		got, found, err := r.LookupCity(net.ParseIP(ip))
+		if err != nil || !found || got != want {
+			t.Errorf("LookupCity(%s) = %+v, %v, %v; want %+v", ip, got, found, err, want)
+		}
+	}
+
+	if _, _, err := r.LookupCity(net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("IPv6 lookup in an IPv4 database did not fail")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		ipVersion  uint64
+		recordSize uint64
+	}{
+		{"test-ipv6-24.mmdb", 6, 24},
+		{"test-ipv6-28.mmdb", 6, 28},
+		{"test-ipv6-32.mmdb", 6, 32},
+		{"test-ipv4-24.mmdb", 4, 24},
+	} {
+		m := openFixture(t, tt.name).Metadata
+		if m.IPVersion != tt.ipVersion || m.RecordSize != tt.recordSize {
+			t.Errorf("%s: ip_version %d, record_size %d; want %d, %d",
+				tt.name, m.IPVersion, m.RecordSize, tt.ipVersion, tt.recordSize)
+		}
+		if m.DatabaseType != "TrinityProxy-Test-City" || m.BuildEpoch != 1700000000 ||
+			len(m.Languages) != 1 || m.Languages[0] != "en" || m.NodeCount == 0 {
+			t.Errorf("%s: unexpected metadata %+v", tt.name, m)
+		}
+	}
+}
+
+func TestLookupDecodesValues(t *testing.T) {
+	r := openFixture(t, "test-ipv6-24.mmdb")
+
+	record, found, err := r.Lookup(net.ParseIP("1.2.3.4"))
+	if err != nil || !found {
+		t.Fatalf("Lookup: %v, %v", found, err)
+	}
+	if got := field(record, "location", "accuracy_radius"); got != uint64(1000) {
+		t.Errorf("accuracy_radius = %#v, want 1000", got)
+	}
+	if got := field(record, "location", "latitude"); got != 37.386 {
+		t.Errorf("latitude = %#v, want 37.386", got)
+	}
+
+	record, _, err = r.Lookup(net.ParseIP("5.6.7.8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := field(record, "city", "geoname_id"); got != uint64(2950159) {
+		t.Errorf("geoname_id = %#v, want 2950159", got)
+	}
+
+	// A 3000 byte string uses the two-byte size form
+	record, found, err = r.Lookup(net.ParseIP("203.0.113.9"))
+	if err != nil || !found {
+		t.Fatalf("Lookup: %v, %v", found, err)
+	}
+	if got := stringField(record, "filler"); got != strings.Repeat("x", 3000) {
+		t.Errorf("filler has %d bytes, want 3000", len(got))
+	}
+}
+
+// TestReadNode covers the high bits of each record size, which the small
+// fixtures never set
+func TestReadNode(t *testing.T) {
+	tests := []struct {
+		size        uint64
+		node        []byte
+		left, right uint64
+	}{
+		{24, []byte{0xAB, 0xCD, 0xEF, 0x12, 0x34, 0x56}, 0xABCDEF, 0x123456},
+		{28, []byte{0x12, 0x34, 0x56, 0xAB, 0xCD, 0xEF, 0x01}, 0xA123456, 0xBCDEF01},
+		{32, []byte{0xFE, 0xDC, 0xBA, 0x98, 0x76, 0x54, 0x32, 0x10}, 0xFEDCBA98, 0x76543210},
+	}
+	for _, tt := range tests {
+		r := &Reader{buf: tt.node, Metadata: Metadata{RecordSize: tt.size}}
+		if left, right := r.readNode(0, 0), r.readNode(0, 1); left != tt.left || right != tt.right {
+			t.Errorf("%d-bit: left %#x right %#x, want %#x %#x", tt.size, left, right, tt.left, tt.right)
+		}
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := FromBytes([]byte("not a database")); !errors.Is(err, ErrInvalidDatabase) {
+		t.Errorf("FromBytes(garbage) = %v, want ErrInvalidDatabase", err)
+	}
+}
+
+// TestHugeNodeCount uses a node count that wraps the tree size around to
+// zero when multiplied by the record size
+func TestHugeNodeCount(t *testing.T) {
+	buf := make([]byte, 64)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, 0xE3) // map, 3 entries
+	buf = append(buf, 0x4A)
+	buf = append(buf, "ip_version"...)
+	buf = append(buf, 0xA1, 4) // uint16
+	buf = append(buf, 0x4B)
+	buf = append(buf, "record_size"...)
+	buf = append(buf, 0xA1, 32)
+	buf = append(buf, 0x4A)
+	buf = append(buf, "node_count"...)
+	buf = append(buf, 0x08, 0x02, 0x40, 0, 0, 0, 0, 0, 0, 0) // uint64 1<<62
+
+	if _, err := FromBytes(buf); !errors.Is(err, ErrInvalidDatabase) {
+		t.Errorf("FromBytes(node_count 1<<62) = %v, want ErrInvalidDatabase", err)
+	}
+}
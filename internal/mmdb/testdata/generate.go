@@ -0,0 +1,330 @@
+// internal/mmdb/testdata/generate.go
+
+//go:build ignore
+
+// generate writes the MaxMind DB fixtures for reader_test.go: the same
+// networks in an IPv6 tree at each record size, and in an IPv4 tree. It is
+// written from the format specification rather than from the reader, so the
+// two check each other. Run it with go generate ./internal/mmdb.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Data section types used by the fixtures
+const (
+	typePointer = 1
+	typeString  = 2
+	typeDouble  = 3
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+	typeUint64  = 9
+	typeArray   = 11
+)
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+// control writes a control byte, the extended type byte for types above 7,
+// then any extra size bytes
+func (e *encoder) control(typ, size int) {
+	var first byte
+	if typ <= 7 {
+		first = byte(typ) << 5
+	}
+
+	var extra []byte
+	switch {
+	case size < 29:
+		first |= byte(size)
+	case size < 285:
+		first |= 29
+		extra = []byte{byte(size - 29)}
+	case size < 65821:
+		first |= 30
+		n := size - 285
+		extra = []byte{byte(n >> 8), byte(n)}
+	default:
+		first |= 31
+		n := size - 65821
+		extra = []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+
+	e.buf.WriteByte(first)
+	if typ > 7 {
+		e.buf.WriteByte(byte(typ - 7))
+	}
+	e.buf.Write(extra)
+}
+
+func (e *encoder) str(s string) {
+	e.control(typeString, len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) uint(typ int, v uint64) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	e.control(typ, len(b))
+	e.buf.Write(b)
+}
+
+func (e *encoder) double(v float64) {
+	e.control(typeDouble, 8)
+	bits := math.Float64bits(v)
+	for shift := 56; shift >= 0; shift -= 8 {
+		e.buf.WriteByte(byte(bits >> shift))
+	}
+}
+
+// pointer writes a pointer to offset in the smallest of the four sizes
+func (e *encoder) pointer(offset int) {
+	ctrl := byte(typePointer << 5)
+	switch {
+	case offset < 2048:
+		e.buf.Write([]byte{ctrl | byte(offset>>8), byte(offset)})
+	case offset < 526336:
+		n := offset - 2048
+		e.buf.Write([]byte{ctrl | 1<<3 | byte(n>>16), byte(n >> 8), byte(n)})
+	case offset < 134744064:
+		n := offset - 526336
+		e.buf.Write([]byte{ctrl | 2<<3 | byte(n>>24), byte(n >> 16), byte(n >> 8), byte(n)})
+	default:
+		e.buf.Write([]byte{ctrl | 3<<3, byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset)})
+	}
+}
+
+// names writes {"en": name}
+func (e *encoder) names(name string) {
+	e.control(typeMap, 1)
+	e.str("en")
+	e.str(name)
+}
+
+// cityRecord writes a GeoIP2 City style record. country is written by the
+// caller, inline or as a pointer.
+func (e *encoder) cityRecord(city string, geonameID uint64, country func()) int {
+	offset := e.buf.Len()
+	e.control(typeMap, 2)
+	e.str("city")
+	e.control(typeMap, 2)
+	e.str("geoname_id")
+	e.uint(typeUint32, geonameID)
+	e.str("names")
+	e.names(city)
+	e.str("country")
+	country()
+	return offset
+}
+
+func (e *encoder) country(code, name string) int {
+	offset := e.buf.Len()
+	e.control(typeMap, 2)
+	e.str("iso_code")
+	e.str(code)
+	e.str("names")
+	e.names(name)
+	return offset
+}
+
+// fixture is the data section and the record each network maps to
+type fixture struct {
+	data     []byte
+	networks map[string]int
+}
+
+func buildData() fixture {
+	var e encoder
+	f := fixture{networks: make(map[string]int)}
+
+	// At offset 0, so records point to it with the smallest pointer size
+	germany := e.country("DE", "Germany")
+
+	// A string long enough for the two-byte size form, which also pushes
+	// what follows past offset 2048
+	f.networks["203.0.113.0/24"] = e.buf.Len()
+	e.control(typeMap, 1)
+	e.str("filler")
+	e.str(strings.Repeat("x", 3000))
+
+	f.networks["1.2.3.0/24"] = e.buf.Len()
+	e.control(typeMap, 5)
+	e.str("city")
+	e.control(typeMap, 1)
+	e.str("names")
+	e.names("Mountain View")
+	e.str("country")
+	e.country("US", "United States")
+	e.str("location")
+	e.control(typeMap, 2)
+	e.str("accuracy_radius")
+	e.uint(typeUint16, 1000)
+	e.str("latitude")
+	e.double(37.386)
+	e.str("postal")
+	e.control(typeMap, 1)
+	e.str("code")
+	e.str("94043")
+	e.str("subdivisions")
+	e.control(typeArray, 1)
+	e.control(typeMap, 2)
+	e.str("iso_code")
+	e.str("CA")
+	e.str("names")
+	e.names("California")
+
+	f.networks["5.6.7.0/24"] = e.cityRecord("Berlin", 2950159, func() { e.pointer(germany) })
+	f.networks["5.6.8.0/23"] = e.cityRecord("Munich", 2867714, func() { e.pointer(germany) })
+
+	// Past offset 2048, so it is reached with the two-byte form of pointer
+	japan := e.country("JP", "Japan")
+	f.networks["2001:db8::/32"] = e.cityRecord("Tokyo", 1850147, func() { e.pointer(japan) })
+
+	f.data = e.buf.Bytes()
+	return f
+}
+
+// tree is a binary trie over address bits. Each node has a left and right
+// record: another node, empty (-1) or a data offset (-2 - offset).
+type tree struct {
+	nodes [][2]int
+}
+
+func (t *tree) insert(bits []byte, depth, record int) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, [2]int{-1, -1})
+	}
+	node := 0
+	for i := 0; i < depth; i++ {
+		bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+		if i == depth-1 {
+			t.nodes[node][bit] = -2 - record
+			return
+		}
+		if t.nodes[node][bit] < 0 {
+			t.nodes = append(t.nodes, [2]int{-1, -1})
+			t.nodes[node][bit] = len(t.nodes) - 1
+		}
+		node = t.nodes[node][bit]
+	}
+}
+
+// value is what a record holds in the file
+func (t *tree) value(record int) uint64 {
+	count := uint64(len(t.nodes))
+	switch {
+	case record == -1:
+		return count
+	case record >= 0:
+		return uint64(record)
+	default:
+		return count + 16 + uint64(-2-record)
+	}
+}
+
+func (t *tree) encode(recordSize int) []byte {
+	var out []byte
+	for _, node := range t.nodes {
+		left, right := t.value(node[0]), t.value(node[1])
+		switch recordSize {
+		case 24:
+			out = append(out, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			out = append(out, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>24&0x0F)<<4|byte(right>>24&0x0F),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			out = append(out, byte(left>>24), byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>24), byte(right>>16), byte(right>>8), byte(right))
+		}
+	}
+	return out
+}
+
+func metadata(ipVersion, nodeCount, recordSize int) []byte {
+	var e encoder
+	e.buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	e.control(typeMap, 9)
+	e.str("binary_format_major_version")
+	e.uint(typeUint16, 2)
+	e.str("binary_format_minor_version")
+	e.uint(typeUint16, 0)
+	e.str("build_epoch")
+	e.uint(typeUint64, 1700000000)
+	e.str("database_type")
+	e.str("TrinityProxy-Test-City")
+	e.str("description")
+	e.names("Test fixture for internal/mmdb")
+	e.str("ip_version")
+	e.uint(typeUint16, uint64(ipVersion))
+	e.str("languages")
+	e.control(typeArray, 1)
+	e.str("en")
+	e.str("node_count")
+	e.uint(typeUint32, uint64(nodeCount))
+	e.str("record_size")
+	e.uint(typeUint16, uint64(recordSize))
+	return e.buf.Bytes()
+}
+
+func write(path string, f fixture, ipVersion, recordSize int) {
+	cidrs := make([]string, 0, len(f.networks))
+	for cidr := range f.networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	var t tree
+	for _, cidr := range cidrs {
+		record := f.networks[cidr]
+		prefix := netip.MustParsePrefix(cidr)
+		switch {
+		case ipVersion == 4 && prefix.Addr().Is4():
+			bits := prefix.Addr().As4()
+			t.insert(bits[:], prefix.Bits(), record)
+		case ipVersion == 6 && prefix.Addr().Is4():
+			// IPv4 networks live under ::/96
+			var bits [16]byte
+			v4 := prefix.Addr().As4()
+			copy(bits[12:], v4[:])
+			t.insert(bits[:], 96+prefix.Bits(), record)
+		case ipVersion == 6:
+			bits := prefix.Addr().As16()
+			t.insert(bits[:], prefix.Bits(), record)
+		}
+	}
+
+	var out []byte
+	out = append(out, t.encode(recordSize)...)
+	out = append(out, make([]byte, 16)...)
+	out = append(out, f.data...)
+	out = append(out, metadata(ipVersion, len(t.nodes), recordSize)...)
+
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s (%d nodes, %d bytes)\n", path, len(t.nodes), len(out))
+}
+
+func main() {
+	f := buildData()
+	dir := "testdata"
+	for _, size := range []int{24, 28, 32} {
+		write(filepath.Join(dir, fmt.Sprintf("test-ipv6-%d.mmdb", size)), f, 6, size)
+	}
+	write(filepath.Join(dir, "test-ipv4-24.mmdb"), f, 4, 24)
+}
@@ -0,0 +1,156 @@
+// internal/netinfo/interface.go
+package netinfo
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// PrimaryInterface finds the primary network interface
+func PrimaryInterface() string {
+	// Method 1: Use ip route to find default gateway interface, falling back
+	// to the IPv6 default route on IPv6-only hosts
+	for _, args := range [][]string{{"route", "show", "default"}, {"-6", "route", "show", "default"}} {
+		output, err := exec.Command("ip", args...).Output()
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(string(output), "\n")
+		for _, line := range lines {
+			if strings.Contains(line, "default via") {
+				fields := strings.Fields(line)
+				for i, field := range fields {
+					if field == "dev" && i+1 < len(fields) {
+						iface := fields[i+1]
+						fmt.Printf("[*] Detected primary interface: %s (via ip route)\n", iface)
+						return iface
+					}
+				}
+			}
+		}
+	}
+
+	// Method 2: Find interface with default route using route command
+	cmd := exec.Command("route", "-n")
+	output, err := cmd.Output()
+	if err == nil {
+		lines := strings.Split(string(output), "\n")
+		for _, line := range lines {
+			if strings.HasPrefix(line, "0.0.0.0") {
+				fields := strings.Fields(line)
+				if len(fields) >= 8 {
+					iface := fields[7]
+					fmt.Printf("[*] Detected primary interface: %s (via route)\n", iface)
+					return iface
+				}
+			}
+		}
+	}
+
+	// Method 3: Use Go's net package to find interface with a global unicast
+	// address of either family
+	interfaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+				addrs, err := iface.Addrs()
+				if err == nil {
+					for _, addr := range addrs {
+						if ipnet, ok := addr.(*net.IPNet); ok {
+							if ipnet.IP.IsGlobalUnicast() {
+								fmt.Printf("[*] Detected primary interface: %s (via Go net)\n", iface.Name)
+								return iface.Name
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Method 4: Check common interface names
+	commonNames := []string{"ens5", "ens3", "enp0s3", "enp0s5", "eth0", "ens160"}
+	for _, name := range commonNames {
+		if _, err := os.Stat("/sys/class/net/" + name); err == nil {
+			// Check if interface is up
+			cmd := exec.Command("ip", "link", "show", name)
+			output, err := cmd.Output()
+			if err == nil && strings.Contains(string(output), "state UP") {
+				fmt.Printf("[*] Detected primary interface: %s (fallback check)\n", name)
+				return name
+			}
+		}
+	}
+
+	// Final fallback
+	fmt.Printf("[!] Could not detect interface, using fallback: eth0\n")
+	return "eth0"
+}
+
+// PublicAddrs returns the public (global unicast, non-private) addresses
+// assigned to an interface. Hosts behind NAT have none.
+func PublicAddrs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var public []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.IsGlobalUnicast() && !ipnet.IP.IsPrivate() {
+			public = append(public, ipnet.IP)
+		}
+	}
+	return public, nil
+}
+
+// HasPublicIPv6 reports whether the interface has a public IPv6 address, so
+// the SOCKS service can accept and make IPv6 connections on it
+func HasPublicIPv6(name string) bool {
+	addrs, err := PublicAddrs(name)
+	if err != nil {
+		return false
+	}
+	for _, ip := range addrs {
+		if ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitAddrs returns the addresses the SOCKS service listens on and sends
+// from when the interface has more than one public IPv4 address: each of
+// them and, with ipv6, the first public IPv6 address. It returns nil for a
+// host with a single address, which is served through the interface as a
+// whole.
+func ExitAddrs(name string, ipv6 bool) []string {
+	addrs, err := PublicAddrs(name)
+	if err != nil {
+		return nil
+	}
+
+	var v4, v6 []string
+	for _, ip := range addrs {
+		if ip.To4() != nil {
+			v4 = append(v4, ip.String())
+		} else if ipv6 && len(v6) == 0 {
+			v6 = append(v6, ip.String())
+		}
+	}
+	if len(v4) < 2 {
+		return nil
+	}
+	return append(v4, v6...)
+}
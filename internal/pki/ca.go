@@ -0,0 +1,248 @@
+// internal/pki/ca.go
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	caCertFile     = "ca.pem"
+	caKeyFile      = "ca-key.pem"
+	serverCertFile = "server.pem"
+	serverKeyFile  = "server-key.pem"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 2 * 365 * 24 * time.Hour
+	clientValidity = 2 * 365 * 24 * time.Hour
+)
+
+// Authority is the controller's embedded certificate authority. It signs the
+// controller's own server certificate and agent client certificates.
+type Authority struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+
+	key crypto.Signer
+}
+
+// LoadOrCreateAuthority loads the CA from dir, generating a new one on first use
+func LoadOrCreateAuthority(dir string) (*Authority, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := createAuthority(certPath, keyPath); err != nil {
+			return nil, fmt.Errorf("failed to create CA: %w", err)
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA: %w", err)
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA key in %s cannot sign", keyPath)
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{Cert: cert, CertPEM: certPEM, key: signer}, nil
+}
+
+func createAuthority(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "TrinityProxy Controller CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyPair(certPath, keyPath, der, key)
+}
+
+// Fingerprint returns the hex SHA-256 of the CA certificate, which agents
+// can use to pin the CA before they have enrolled
+func (a *Authority) Fingerprint() string {
+	return Fingerprint(a.Cert)
+}
+
+// Fingerprint returns the hex SHA-256 of a certificate's DER encoding
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertPool returns a pool containing only this CA
+func (a *Authority) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.Cert)
+	return pool
+}
+
+// ServerCertificate loads the controller's server certificate from dir,
+// issuing a new one for hosts if none exists yet
+func (a *Authority) ServerCertificate(dir string, hosts []string) (tls.Certificate, error) {
+	certPath := filepath.Join(dir, serverCertFile)
+	keyPath := filepath.Join(dir, serverKeyFile)
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := a.createServerCertificate(certPath, keyPath, hosts); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to create server certificate: %w", err)
+		}
+	}
+
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func (a *Authority) createServerCertificate(certPath, keyPath string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "TrinityProxy Controller"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.Cert, &key.PublicKey, a.key)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyPair(certPath, keyPath, der, key)
+}
+
+// ParseClientCSR decodes and verifies a PEM certificate request. The CSR's
+// public key must match publicKey so the issued certificate is bound to the
+// node's enrollment key.
+func ParseClientCSR(csrPEM []byte, publicKey crypto.PublicKey) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("csr is not a PEM certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("csr signature invalid: %w", err)
+	}
+
+	type equaler interface {
+		Equal(crypto.PublicKey) bool
+	}
+	if pub, ok := csr.PublicKey.(equaler); !ok || !pub.Equal(publicKey) {
+		return nil, fmt.Errorf("csr public key does not match enrollment key")
+	}
+
+	return csr, nil
+}
+
+// SignClientCSR issues a PEM client certificate whose common name is the node ID
+func (a *Authority) SignClientCSR(csr *x509.CertificateRequest, nodeID string) ([]byte, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(clientValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.Cert, csr.PublicKey, a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, 0644)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
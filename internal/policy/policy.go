@@ -0,0 +1,138 @@
+// internal/policy/policy.go
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// DefaultPath is where agents keep the policy currently applied to Dante
+const DefaultPath = "/etc/trinityproxy-policy.json"
+
+// PrivateRanges are destination ranges blocked when BlockPrivateDestinations
+// is set: RFC 1918, loopback, link-local, CGNAT and "this network", then the
+// IPv6 unspecified, loopback, IPv4-mapped, unique local and link-local ranges
+var PrivateRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"::ffff:0:0/96",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// Policy controls which clients may use a node's SOCKS service and which
+// destinations they may reach through it
+type Policy struct {
+	Version                  string   `json:"version,omitempty"`
+	AllowedClientCIDRs       []string `json:"allowed_client_cidrs"`
+	BlockedDestinationPorts  []int    `json:"blocked_destination_ports"`
+	BlockedDestinationCIDRs  []string `json:"blocked_destination_cidrs"`
+	BlockPrivateDestinations bool     `json:"block_private_destinations"`
+
+	// BlockLocalClients stops admitting the node's own addresses regardless
+	// of AllowedClientCIDRs. They are admitted by default for the agent's
+	// self-check, which lets any local process through as well. Left out of
+	// the JSON when unset, so existing policies keep their version.
+	BlockLocalClients bool `json:"block_local_clients,omitempty"`
+}
+
+// Default allows clients from anywhere, blocks SMTP and blocks private and
+// link-local destinations
+func Default() *Policy {
+	p := &Policy{
+		AllowedClientCIDRs:       []string{"0.0.0.0/0", "::/0"},
+		BlockedDestinationPorts:  []int{25},
+		BlockedDestinationCIDRs:  []string{},
+		BlockPrivateDestinations: true,
+	}
+	p.Version = p.ComputeVersion()
+	return p
+}
+
+// Validate checks every CIDR and port in the policy
+func (p *Policy) Validate() error {
+	if len(p.AllowedClientCIDRs) == 0 {
+		return fmt.Errorf("at least one allowed client CIDR is required")
+	}
+	for _, cidr := range p.AllowedClientCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid client CIDR %q", cidr)
+		}
+	}
+	for _, cidr := range p.BlockedDestinationCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid destination CIDR %q", cidr)
+		}
+	}
+	for _, port := range p.BlockedDestinationPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid destination port %d", port)
+		}
+	}
+	return nil
+}
+
+// BlockedDestinations returns the explicit blocked CIDRs plus the private
+// ranges when those are blocked
+func (p *Policy) BlockedDestinations() []string {
+	blocked := append([]string{}, p.BlockedDestinationCIDRs...)
+	if p.BlockPrivateDestinations {
+		blocked = append(blocked, PrivateRanges...)
+	}
+	return blocked
+}
+
+// ComputeVersion returns a short content hash of the policy rules, used by
+// agents and the controller to tell whether a policy has changed
+func (p *Policy) ComputeVersion() string {
+	rules := *p
+	rules.Version = ""
+	if rules.BlockedDestinationPorts == nil {
+		rules.BlockedDestinationPorts = []int{}
+	}
+	if rules.BlockedDestinationCIDRs == nil {
+		rules.BlockedDestinationCIDRs = []string{}
+	}
+	data, _ := json.Marshal(rules)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// Load reads a policy file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("corrupt policy file %s: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	p.Version = p.ComputeVersion()
+	return &p, nil
+}
+
+// Save writes the policy, stamping its version
+func (p *Policy) Save(path string) error {
+	p.Version = p.ComputeVersion()
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
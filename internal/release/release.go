@@ -0,0 +1,126 @@
+// internal/release/release.go
+package release
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// MaxSize is the largest agent binary accepted for a release
+const MaxSize = 256 << 20
+
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+
+var ErrBadSignature = errors.New("release signature does not match the release key")
+
+// ValidVersion reports whether version can name a release
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+// Digest returns the hex SHA-256 of a release binary
+func Digest(binary []byte) string {
+	sum := sha256.Sum256(binary)
+	return hex.EncodeToString(sum[:])
+}
+
+// StampedVersion returns the version stamped into an agent binary by
+// -ldflags "-X main.Version=...", as make build does
+func StampedVersion(binaryPath string) (string, error) {
+	info, err := buildinfo.ReadFile(binaryPath)
+	if err != nil {
+		return "", err
+	}
+
+	version := ""
+	for _, setting := range info.Settings {
+		if setting.Key != "-ldflags" {
+			continue
+		}
+		// The linker applies the last -X for a symbol
+		for _, field := range strings.Fields(setting.Value) {
+			field = strings.Trim(strings.TrimPrefix(field, "-X="), `"'`)
+			if v, ok := strings.CutPrefix(field, "main.Version="); ok {
+				version = v
+			}
+		}
+	}
+	if version == "" {
+		return "", fmt.Errorf("%s has no version stamped in, build it with make build", binaryPath)
+	}
+	return version, nil
+}
+
+// message is what a release signature covers. Binding the version means a
+// signed binary cannot be offered as a different release.
+func message(version, digest string) []byte {
+	return []byte("trinityproxy-agent\n" + version + "\n" + digest + "\n")
+}
+
+// Sign returns the base64 signature of a release
+func Sign(key ed25519.PrivateKey, version, digest string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message(version, digest)))
+}
+
+// Verify checks a release signature made by Sign
+func Verify(key ed25519.PublicKey, version, digest, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, message(version, digest), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 release public key
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("release public key must be %d bytes encoded as base64", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// GenerateKey writes a new release signing key to path with 0600
+// permissions and returns its base64 public key. An existing file is never
+// overwritten.
+func GenerateKey(path string) (string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(base64.StdEncoding.EncodeToString(private.Seed()) + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(public), nil
+}
+
+// LoadKey reads a signing key written by GenerateKey
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a release signing key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,42 @@
+// internal/socks5/credentials.go
+package socks5
+
+import (
+	"crypto/subtle"
+	"sync"
+)
+
+// Credentials are the username/password logins the server accepts, held in
+// memory. Several can be valid at once, which is what lets credential
+// rotation keep the old login working.
+type Credentials struct {
+	mu     sync.RWMutex
+	logins map[string]string
+}
+
+// NewCredentials returns an empty set of logins
+func NewCredentials() *Credentials {
+	return &Credentials{logins: make(map[string]string)}
+}
+
+// Set adds a login, or changes the password of an existing one
+func (c *Credentials) Set(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logins[username] = password
+}
+
+// Delete removes a login. Connections already opened with it stay up.
+func (c *Credentials) Delete(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.logins, username)
+}
+
+// Valid reports whether username and password match a login
+func (c *Credentials) Valid(username, password string) bool {
+	c.mu.RLock()
+	want, ok := c.logins[username]
+	c.mu.RUnlock()
+	return ok && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
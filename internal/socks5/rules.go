@@ -0,0 +1,70 @@
+// internal/socks5/rules.go
+package socks5
+
+import (
+	"net/netip"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+// rules is an access policy compiled for matching connections
+type rules struct {
+	clients      []netip.Prefix
+	blocked      []netip.Prefix
+	blockedPorts map[uint16]bool
+
+	// admitLocal admits the node's own addresses whatever the client CIDRs
+	admitLocal bool
+}
+
+func compileRules(p *policy.Policy) (*rules, error) {
+	if p == nil {
+		p = policy.Default()
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &rules{blockedPorts: make(map[uint16]bool), admitLocal: !p.BlockLocalClients}
+	for _, cidr := range p.AllowedClientCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r.clients = append(r.clients, prefix.Masked())
+	}
+	for _, cidr := range p.BlockedDestinations() {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r.blocked = append(r.blocked, prefix.Masked())
+	}
+	for _, port := range p.BlockedDestinationPorts {
+		r.blockedPorts[uint16(port)] = true
+	}
+	return r, nil
+}
+
+func (r *rules) allowsClient(addr netip.Addr) bool {
+	for _, prefix := range r.clients {
+		if prefix.Contains(addr) || prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsDestination checks both forms of an IPv4-mapped address, so
+// ::ffff:10.0.0.1 is blocked along with 10.0.0.1
+func (r *rules) allowsDestination(addr netip.Addr, port uint16) bool {
+	if r.blockedPorts[port] {
+		return false
+	}
+	for _, prefix := range r.blocked {
+		if prefix.Contains(addr) || prefix.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,541 @@
+// internal/socks5/server.go
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+const (
+	// handshakeTimeout bounds everything before a request is carried out
+	handshakeTimeout = 30 * time.Second
+
+	// dialTimeout bounds resolving and connecting to a destination
+	dialTimeout = 10 * time.Second
+)
+
+// idleTimeout ends a relay that has carried nothing either way for this
+// long, including one left half-closed by a peer that never finishes
+var idleTimeout = 10 * time.Minute
+
+// Protocol constants from RFC 1928 and RFC 1929
+const (
+	socksVersion = 0x05
+	authVersion  = 0x01
+
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+
+	repSucceeded           = 0x00
+	repFailure             = 0x01
+	repNotAllowed          = 0x02
+	repNetworkUnreachable  = 0x03
+	repHostUnreachable     = 0x04
+	repConnectionRefused   = 0x05
+	repCommandNotSupported = 0x07
+	repAddressNotSupported = 0x08
+)
+
+var errAddressType = errors.New("unsupported address type")
+
+// Server is a SOCKS5 proxy (RFC 1928) that requires username/password
+// authentication (RFC 1929). It supports CONNECT and UDP ASSOCIATE; BIND is
+// refused.
+//
+// Clients and destinations are checked against an access policy the way the
+// Dante configuration applies it. Loopback clients are admitted so the
+// agent's self-check works under any policy, and so are the exits when the
+// host has several, unless the policy sets BlockLocalClients.
+type Server struct {
+	creds *Credentials
+	rules atomic.Pointer[rules]
+
+	// With exits, each listener serves one address and traffic leaves from
+	// the address the client connected to
+	exits map[netip.Addr]bool
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[io.Closer]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a server accepting creds under policy p. Call Listen to
+// start serving.
+func NewServer(creds *Credentials, p *policy.Policy) (*Server, error) {
+	s := &Server{
+		creds: creds,
+		exits: make(map[netip.Addr]bool),
+		conns: make(map[io.Closer]struct{}),
+	}
+	if err := s.SetPolicy(p); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetPolicy replaces the access policy. Connections already open are not
+// checked again.
+func (s *Server) SetPolicy(p *policy.Policy) error {
+	r, err := compileRules(p)
+	if err != nil {
+		return err
+	}
+	s.rules.Store(r)
+	return nil
+}
+
+// Listen starts serving on port. Without exits the server listens on every
+// address of the host; with them, on each exit alone.
+func (s *Server) Listen(port int, exits []string) error {
+	addrs := []string{":" + strconv.Itoa(port)}
+	if len(exits) > 0 {
+		addrs = nil
+		for _, exit := range exits {
+			ip, err := netip.ParseAddr(exit)
+			if err != nil {
+				return fmt.Errorf("invalid exit %q", exit)
+			}
+			s.exits[ip.Unmap()] = true
+			addrs = append(addrs, net.JoinHostPort(exit, strconv.Itoa(port)))
+		}
+	}
+
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, listeners...)
+	for _, l := range listeners {
+		s.wg.Add(1)
+		go s.serve(l)
+	}
+	return nil
+}
+
+// Close stops the listeners, closes every connection and waits for their
+// handlers to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serve(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("[-] SOCKS accept on %s: %v", l.Addr(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !s.track(conn) {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// track registers a connection to close with the server, closing it at
+// once if the server is already closed
+func (s *Server) track(conn io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+func (s *Server) allowsClient(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	r := s.rules.Load()
+	if r.admitLocal && (addr.IsLoopback() || s.exits[addr]) {
+		return true
+	}
+	return r.allowsClient(addr)
+}
+
+// handle serves one client connection. Clients outside the policy are
+// disconnected without a reply, as Dante does.
+func (s *Server) handle(conn net.Conn) {
+	client := addrOf(conn.RemoteAddr()).Addr()
+	if !s.allowsClient(client) {
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := s.authenticate(conn); err != nil {
+		return
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socksVersion {
+		return
+	}
+	dest, err := readAddress(conn)
+	if err == errAddressType {
+		writeReply(conn, repAddressNotSupported, nil)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	switch header[1] {
+	case cmdConnect:
+		s.connect(conn, dest)
+	case cmdUDPAssociate:
+		s.associate(conn, dest)
+	default:
+		writeReply(conn, repCommandNotSupported, nil)
+	}
+}
+
+// authenticate negotiates username/password authentication, the only
+// method offered, and checks the login
+func (s *Server) authenticate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	offered := false
+	for _, method := range methods {
+		if method == methodUserPass {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return fmt.Errorf("client does not offer username authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, methodUserPass}); err != nil {
+		return err
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != authVersion {
+		return fmt.Errorf("unsupported authentication version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if !s.creds.Valid(string(username), string(password)) {
+		conn.Write([]byte{authVersion, 0x01})
+		return fmt.Errorf("invalid credentials")
+	}
+	_, err := conn.Write([]byte{authVersion, 0x00})
+	return err
+}
+
+// connect carries out a CONNECT and relays data until either side closes
+func (s *Server) connect(conn net.Conn, dest address) {
+	local := addrOf(conn.LocalAddr()).Addr()
+	ips, code := s.resolve(dest, local)
+	if code != repSucceeded {
+		writeReply(conn, code, nil)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	if s.exits[local.Unmap()] {
+		dialer.LocalAddr = &net.TCPAddr{IP: local.Unmap().AsSlice()}
+	}
+	var out net.Conn
+	var err error
+	for _, ip := range ips {
+		out, err = dialer.Dial("tcp", netip.AddrPortFrom(ip, dest.Port).String())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		writeReply(conn, replyFor(err), nil)
+		return
+	}
+	if !s.track(out) {
+		return
+	}
+	defer s.untrack(out)
+
+	if err := writeReply(conn, repSucceeded, out.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	relay(conn, out)
+}
+
+// resolve returns the addresses dest may be reached at, or the reply code
+// explaining why it may not. A name is resolved first so the policy applies
+// to the addresses it points to. Traffic leaving from an exit can only go
+// to destinations of the exit's address family.
+func (s *Server) resolve(dest address, local netip.Addr) ([]netip.Addr, byte) {
+	candidates := []netip.Addr{dest.IP}
+	if dest.Name != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", dest.Name)
+		if err != nil || len(resolved) == 0 {
+			return nil, repHostUnreachable
+		}
+		candidates = resolved
+	}
+
+	rules := s.rules.Load()
+	sameFamily := s.exits[local.Unmap()]
+	var allowed []netip.Addr
+	code := byte(repNotAllowed)
+	for _, ip := range candidates {
+		if sameFamily && ip.Unmap().Is4() != local.Unmap().Is4() {
+			code = repNetworkUnreachable
+			continue
+		}
+		if rules.allowsDestination(ip, dest.Port) {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, code
+	}
+	return allowed, repSucceeded
+}
+
+// relay copies data both ways. Each direction is half-closed when its
+// source ends, so a client can finish sending and still read the response.
+// It ends once neither direction has carried data for idleTimeout.
+func relay(client, remote net.Conn) {
+	var active atomic.Int64
+	active.Store(time.Now().UnixNano())
+	idle := func() bool {
+		return time.Since(time.Unix(0, active.Load())) >= idleTimeout
+	}
+
+	done := make(chan struct{}, 2)
+	copyHalf := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := src.Read(buf)
+			if n > 0 {
+				active.Store(time.Now().UnixNano())
+				dst.SetWriteDeadline(time.Now().Add(idleTimeout))
+				if _, err := dst.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+			// A quiet direction waits on while the other is busy
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !idle() {
+				continue
+			}
+			if err != nil {
+				break
+			}
+		}
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(remote, client)
+	go copyHalf(client, remote)
+	<-done
+	<-done
+}
+
+// replyFor maps a dial error to the closest reply code
+func replyFor(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return repConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return repNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return repHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return repHostUnreachable
+	default:
+		return repFailure
+	}
+}
+
+// writeReply sends a reply with bound as BND.ADDR and BND.PORT, or the zero
+// address when there is none
+func writeReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	addr := address{IP: netip.IPv4Unspecified()}
+	if bound != nil {
+		ap := addrOf(bound)
+		addr = address{IP: ap.Addr(), Port: ap.Port()}
+	}
+	_, err := w.Write(addr.appendTo(reply))
+	return err
+}
+
+// address is a SOCKS address: a domain name or an IP, and a port
+type address struct {
+	Name string
+	IP   netip.Addr
+	Port uint16
+}
+
+// readAddress reads ATYP, DST.ADDR and DST.PORT
+func readAddress(r io.Reader) (address, error) {
+	var addr address
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return addr, err
+	}
+
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		size := 4
+		if atyp[0] == atypIPv6 {
+			size = 16
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return addr, err
+		}
+		addr.IP, _ = netip.AddrFromSlice(buf)
+	case atypDomain:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return addr, err
+		}
+		name := make([]byte, atyp[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return addr, err
+		}
+		// A literal IP sent as a name is treated as the IP
+		if ip, err := netip.ParseAddr(string(name)); err == nil {
+			addr.IP = ip
+		} else {
+			addr.Name = string(name)
+		}
+	default:
+		return addr, errAddressType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return addr, err
+	}
+	addr.Port = binary.BigEndian.Uint16(port)
+	return addr, nil
+}
+
+// appendTo encodes the address as ATYP, ADDR and PORT
+func (a address) appendTo(b []byte) []byte {
+	switch {
+	case a.Name != "":
+		b = append(b, atypDomain, byte(len(a.Name)))
+		b = append(b, a.Name...)
+	case a.IP.Unmap().Is4():
+		ip := a.IP.Unmap().As4()
+		b = append(b, atypIPv4)
+		b = append(b, ip[:]...)
+	default:
+		ip := a.IP.As16()
+		b = append(b, atypIPv6)
+		b = append(b, ip[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, a.Port)
+}
+
+// addrOf returns the IP and port of a TCP or UDP address
+func addrOf(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort()
+	case *net.UDPAddr:
+		return a.AddrPort()
+	}
+	return netip.AddrPort{}
+}
@@ -0,0 +1,371 @@
+// internal/socks5/server_test.go
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+// testPolicy lets clients in from anywhere and allows private destinations,
+// so the loopback listeners the tests connect to can be reached
+func testPolicy() *policy.Policy {
+	return &policy.Policy{
+		AllowedClientCIDRs:      []string{"0.0.0.0/0", "::/0"},
+		BlockedDestinationPorts: []int{25},
+		BlockedDestinationCIDRs: []string{"192.0.2.0/24"},
+	}
+}
+
+// startServer serves p on a free port and returns the loopback address to
+// connect to. The login is user/secret.
+func startServer(t *testing.T, p *policy.Policy) string {
+	t.Helper()
+	creds := NewCredentials()
+	creds.Set("user", "secret")
+
+	s, err := NewServer(creds, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Listen(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	port := addrOf(s.listeners[0].Addr()).Port()
+	return netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port).String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func send(t *testing.T, conn net.Conn, b ...byte) {
+	t.Helper()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expect(t *testing.T, conn net.Conn, want ...byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading %x: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+}
+
+// login negotiates username authentication and sends the login, returning
+// the server's status byte
+func login(t *testing.T, conn net.Conn, username, password string) byte {
+	t.Helper()
+	send(t, conn, socksVersion, 1, methodUserPass)
+	expect(t, conn, socksVersion, methodUserPass)
+
+	msg := []byte{authVersion, byte(len(username))}
+	msg = append(msg, username...)
+	msg = append(msg, byte(len(password)))
+	send(t, conn, append(msg, password...)...)
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		t.Fatal(err)
+	}
+	if status[0] != authVersion {
+		t.Fatalf("auth reply version %d", status[0])
+	}
+	return status[1]
+}
+
+// request sends a command after logging in and returns the reply code and
+// bound address
+func request(t *testing.T, server string, cmd byte, dest address) (net.Conn, byte, address) {
+	t.Helper()
+	conn := dial(t, server)
+	if status := login(t, conn, "user", "secret"); status != 0x00 {
+		t.Fatalf("login rejected with status %d", status)
+	}
+	send(t, conn, dest.appendTo([]byte{socksVersion, cmd, 0x00})...)
+	code, bound := readReply(t, conn)
+	return conn, code, bound
+}
+
+func readReply(t *testing.T, conn net.Conn) (byte, address) {
+	t.Helper()
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	bound, err := readAddress(conn)
+	if err != nil {
+		t.Fatalf("reading bound address: %v", err)
+	}
+	return header[1], bound
+}
+
+// echoServer accepts TCP connections on loopback and echoes what they send
+func echoServer(t *testing.T) netip.AddrPort {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return addrOf(l.Addr())
+}
+
+func TestAuthentication(t *testing.T) {
+	server := startServer(t, testPolicy())
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		conn := dial(t, server)
+		send(t, conn, socksVersion, 1, 0x00)
+		expect(t, conn, socksVersion, methodNoAcceptable)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		conn := dial(t, server)
+		if status := login(t, conn, "user", "wrong"); status == 0x00 {
+			t.Fatal("wrong password accepted")
+		}
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("connection left open after a failed login")
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		if status := login(t, dial(t, server), "nobody", "secret"); status == 0x00 {
+			t.Fatal("unknown user accepted")
+		}
+	})
+
+	t.Run("valid login", func(t *testing.T) {
+		if status := login(t, dial(t, server), "user", "secret"); status != 0x00 {
+			t.Fatalf("status %d, want 0", status)
+		}
+	})
+}
+
+func TestConnect(t *testing.T) {
+	server := startServer(t, testPolicy())
+	echo := echoServer(t)
+
+	conn, code, bound := request(t, server, cmdConnect, address{IP: echo.Addr(), Port: echo.Port()})
+	if code != repSucceeded {
+		t.Fatalf("reply %d, want %d", code, repSucceeded)
+	}
+	if !bound.IP.IsLoopback() || bound.Port == 0 {
+		t.Errorf("bound address %v:%d, want the outgoing loopback address", bound.IP, bound.Port)
+	}
+
+	send(t, conn, []byte("ping")...)
+	expect(t, conn, []byte("ping")...)
+}
+
+func TestConnectRefused(t *testing.T) {
+	// Taken and released, so nothing is listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := addrOf(l.Addr())
+	l.Close()
+
+	server := startServer(t, testPolicy())
+	_, code, _ := request(t, server, cmdConnect, address{IP: closed.Addr(), Port: closed.Port()})
+	if code != repConnectionRefused {
+		t.Errorf("reply %d, want %d", code, repConnectionRefused)
+	}
+}
+
+func TestDestinationRules(t *testing.T) {
+	blockPrivate := testPolicy()
+	blockPrivate.BlockPrivateDestinations = true
+	server := startServer(t, blockPrivate)
+
+	tests := []struct {
+		name string
+		dest address
+	}{
+		{"blocked CIDR", address{IP: netip.MustParseAddr("192.0.2.10"), Port: 80}},
+		{"blocked port", address{IP: netip.MustParseAddr("198.51.100.1"), Port: 25}},
+		{"private address", address{IP: netip.MustParseAddr("10.1.2.3"), Port: 80}},
+		{"IPv4-mapped private address", address{IP: netip.MustParseAddr("::ffff:127.0.0.1"), Port: 80}},
+		{"name resolving to a private address", address{Name: "localhost", Port: 80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, code, _ := request(t, server, cmdConnect, tt.dest)
+			if code != repNotAllowed {
+				t.Errorf("reply %d, want %d", code, repNotAllowed)
+			}
+		})
+	}
+}
+
+func TestUnsupportedRequests(t *testing.T) {
+	server := startServer(t, testPolicy())
+
+	t.Run("BIND", func(t *testing.T) {
+		_, code, _ := request(t, server, 0x02, address{IP: netip.MustParseAddr("198.51.100.1"), Port: 80})
+		if code != repCommandNotSupported {
+			t.Errorf("reply %d, want %d", code, repCommandNotSupported)
+		}
+	})
+
+	t.Run("unknown ATYP", func(t *testing.T) {
+		conn := dial(t, server)
+		if status := login(t, conn, "user", "secret"); status != 0x00 {
+			t.Fatalf("login rejected with status %d", status)
+		}
+		send(t, conn, socksVersion, cmdConnect, 0x00, 0x05, 1, 2, 3, 4, 0, 80)
+		if code, _ := readReply(t, conn); code != repAddressNotSupported {
+			t.Errorf("reply %d, want %d", code, repAddressNotSupported)
+		}
+	})
+}
+
+func TestClientPolicy(t *testing.T) {
+	elsewhere := testPolicy()
+	elsewhere.AllowedClientCIDRs = []string{"203.0.113.0/24"}
+
+	// Loopback is admitted for the self-check by default
+	server := startServer(t, elsewhere)
+	if status := login(t, dial(t, server), "user", "secret"); status != 0x00 {
+		t.Fatalf("loopback client rejected with status %d", status)
+	}
+
+	// and dropped without a reply when the policy blocks local clients
+	elsewhere.BlockLocalClients = true
+	conn := dial(t, startServer(t, elsewhere))
+	send(t, conn, socksVersion, 1, methodUserPass)
+	if _, err := conn.Read(make([]byte, 2)); err == nil {
+		t.Error("local client answered although the policy blocks it")
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	server := startServer(t, testPolicy())
+	_, code, bound := request(t, server, cmdUDPAssociate, address{IP: netip.IPv4Unspecified()})
+	if code != repSucceeded {
+		t.Fatalf("reply %d, want %d", code, repSucceeded)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	relay := net.UDPAddrFromAddrPort(netip.AddrPortFrom(bound.IP, bound.Port))
+
+	target := addrOf(echo.LocalAddr())
+	header := address{IP: target.Addr(), Port: target.Port()}.appendTo([]byte{0x00, 0x00, 0x00})
+
+	// A blocked destination is dropped, so only the second datagram returns
+	blocked := address{IP: netip.MustParseAddr("192.0.2.1"), Port: 53}.appendTo([]byte{0x00, 0x00, 0x00})
+	client.WriteToUDP(append(blocked, "blocked"...), relay)
+	client.WriteToUDP(append(header, "hello"...), relay)
+
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, payload, ok := parseDatagram(buf[:n])
+	if !ok {
+		t.Fatalf("malformed reply %x", buf[:n])
+	}
+	if netip.AddrPortFrom(from.IP, from.Port) != target || string(payload) != "hello" {
+		t.Errorf("reply from %v:%d with %q, want %v with \"hello\"", from.IP, from.Port, payload, target)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	saved := idleTimeout
+	idleTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { idleTimeout = saved })
+
+	// A destination that reads until the client half-closes, then holds its
+	// end open without sending anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		time.Sleep(5 * time.Second)
+	}()
+
+	server := startServer(t, testPolicy())
+	dest := addrOf(l.Addr())
+	conn, code, _ := request(t, server, cmdConnect, address{IP: dest.Addr(), Port: dest.Port()})
+	if code != repSucceeded {
+		t.Fatalf("reply %d, want %d", code, repSucceeded)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("read data from a silent destination")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatal("relay still open after the idle timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("relay closed after %s", elapsed)
+	}
+}
@@ -0,0 +1,121 @@
+// internal/socks5/udp.go
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// associate carries out a UDP ASSOCIATE. The relay socket is bound to the
+// address the client connected to, so with exits datagrams leave from the
+// same address as TCP traffic. It lasts until the control connection
+// closes.
+func (s *Server) associate(conn net.Conn, expected address) {
+	local := addrOf(conn.LocalAddr()).Addr().Unmap()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.AsSlice()})
+	if err != nil {
+		writeReply(conn, repFailure, nil)
+		return
+	}
+	if !s.track(udp) {
+		return
+	}
+	defer s.untrack(udp)
+
+	if err := writeReply(conn, repSucceeded, udp.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The control connection carries nothing more; its end ends the relay
+	go func() {
+		io.Copy(io.Discard, conn)
+		udp.Close()
+	}()
+
+	client := addrOf(conn.RemoteAddr()).Addr().Unmap()
+	s.relayUDP(udp, client, expected.Port)
+}
+
+// relayUDP forwards the client's datagrams to their destinations and
+// replies back to the client. Datagrams are only taken from the client's IP
+// (and the port it announced, if any), and replies only from destinations
+// the client has sent to.
+func (s *Server) relayUDP(udp *net.UDPConn, clientIP netip.Addr, clientPort uint16) {
+	var client netip.AddrPort
+	peers := make(map[netip.AddrPort]bool)
+	resolved := make(map[string]netip.Addr)
+	buf := make([]byte, 65535)
+
+	for {
+		n, from, err := udp.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+
+		fromClient := from.Addr() == clientIP && (clientPort == 0 || from.Port() == clientPort)
+		if fromClient && (!client.IsValid() || from == client) {
+			client = from
+			dest, payload, ok := parseDatagram(buf[:n])
+			if !ok {
+				continue
+			}
+			to, ok := s.udpDestination(dest, resolved)
+			if !ok {
+				continue
+			}
+			peers[to] = true
+			udp.WriteToUDPAddrPort(payload, to)
+			continue
+		}
+
+		if client.IsValid() && peers[from] {
+			datagram := address{IP: from.Addr(), Port: from.Port()}.appendTo([]byte{0x00, 0x00, 0x00})
+			udp.WriteToUDPAddrPort(append(datagram, buf[:n]...), client)
+		}
+	}
+}
+
+// udpDestination resolves and checks a datagram's destination. Names are
+// resolved once per association.
+func (s *Server) udpDestination(dest address, resolved map[string]netip.Addr) (netip.AddrPort, bool) {
+	ip := dest.IP
+	if dest.Name != "" {
+		var ok bool
+		if ip, ok = resolved[dest.Name]; !ok {
+			ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", dest.Name)
+			cancel()
+			if err != nil || len(addrs) == 0 {
+				return netip.AddrPort{}, false
+			}
+			ip = addrs[0]
+			resolved[dest.Name] = ip
+		}
+	}
+	ip = ip.Unmap()
+	if !s.rules.Load().allowsDestination(ip, dest.Port) {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ip, dest.Port), true
+}
+
+// parseDatagram splits a client datagram into its destination and payload:
+// RSV (2 bytes), FRAG, then the address. Fragments are not supported, so
+// datagrams with FRAG set are dropped, as RFC 1928 allows.
+func parseDatagram(datagram []byte) (address, []byte, bool) {
+	if len(datagram) < 4 || datagram[2] != 0x00 {
+		return address{}, nil, false
+	}
+	r := bytes.NewReader(datagram[3:])
+	dest, err := readAddress(r)
+	if err != nil {
+		return address{}, nil, false
+	}
+	return dest, datagram[len(datagram)-r.Len():], true
+}
@@ -0,0 +1,232 @@
+// internal/storage/apikeys.go
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// API key scopes. Admin keys are accepted for every scope. Agents do not use
+// API keys; their heartbeats are signed with per-node enrollment keys.
+const (
+	ScopeReadNodes = "read-nodes"
+	ScopeAdmin     = "admin"
+
+	// Deprecated: heartbeats are signed by enrolled nodes. Keys issued with
+	// this scope no longer authenticate anything, and new ones are refused.
+	ScopeAgentHeartbeat = "agent-heartbeat"
+
+	apiKeyPrefix = "tp_"
+)
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid or revoked API key")
+
+	ErrHeartbeatScopeRemoved = errors.New(`scope "agent-heartbeat" was removed: agents enroll with a join token and sign their heartbeats`)
+)
+
+type APIKey struct {
+	ID         string     `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+// HasScope reports whether the key grants the given scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope reports whether scope is one of the known API key scopes
+func ValidScope(scope string) bool {
+	switch scope {
+	case ScopeReadNodes, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// hashSecret returns the hex SHA-256 of a raw secret. Keys and tokens are random
+// high-entropy values, so a fast hash is sufficient for storage at rest.
+func hashSecret(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// CreateAPIKey generates a new key with the given scopes. The raw key is
+// returned once and only its hash is persisted.
+func (s *NodeStorage) CreateAPIKey(name string, scopes []string) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if scope == ScopeAgentHeartbeat {
+			return nil, "", ErrHeartbeatScopeRemoved
+		}
+		if !ValidScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := apiKeyPrefix + secret
+
+	key := &APIKey{
+		ID:        id,
+		Name:      name,
+		Prefix:    raw[:len(apiKeyPrefix)+8],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+
+	query := `
+	INSERT INTO api_keys (id, name, prefix, key_hash, scopes, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err = s.db.Exec(query, key.ID, key.Name, key.Prefix, hashSecret(raw),
+		strings.Join(scopes, ","), key.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return key, raw, nil
+}
+
+// AuthenticateAPIKey looks up an active key by its raw value and records its use
+func (s *NodeStorage) AuthenticateAPIKey(raw string) (*APIKey, error) {
+	if !strings.HasPrefix(raw, apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	query := `
+	SELECT id, name, prefix, scopes, created_at, last_used_at, revoked_at
+	FROM api_keys
+	WHERE key_hash = ? AND revoked_at IS NULL
+	`
+	key, err := scanAPIKey(s.db.QueryRow(query, hashSecret(raw)))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now, key.ID)
+	key.LastUsedAt = &now
+
+	return key, nil
+}
+
+func (s *NodeStorage) ListAPIKeys() ([]APIKey, error) {
+	query := `
+	SELECT id, name, prefix, scopes, created_at, last_used_at, revoked_at
+	FROM api_keys
+	ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, *key)
+	}
+
+	return keys, nil
+}
+
+func (s *NodeStorage) RevokeAPIKey(id string) error {
+	result, err := s.db.Exec(`
+	UPDATE api_keys SET revoked_at = ?
+	WHERE id = ? AND revoked_at IS NULL
+	`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// HasActiveAdminKey reports whether at least one unrevoked admin key exists
+func (s *NodeStorage) HasActiveAdminKey() (bool, error) {
+	keys, err := s.ListAPIKeys()
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if key.RevokedAt == nil && key.HasScope(ScopeAdmin) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &scopes,
+		&key.CreatedAt, &lastUsed, &revoked)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+
+	return &key, nil
+}
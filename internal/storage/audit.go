@@ -0,0 +1,168 @@
+// internal/storage/audit.go
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// Audit results, derived from the HTTP status of the audited request
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditError   = "error"
+)
+
+// AuditEvent records one API request: who made it, what it touched and how
+// it ended. Events are append-only; the table rejects updates and deletes,
+// except for PruneAuditEvents removing events past the retention period.
+type AuditEvent struct {
+	ID        int64     `json:"id" db:"id"`
+	Actor     string    `json:"actor" db:"actor"`
+	Method    string    `json:"method" db:"method"`
+	Route     string    `json:"route" db:"route"`
+	NodeIDs   []string  `json:"node_ids,omitempty" db:"node_ids"`
+	Status    int       `json:"status" db:"status"`
+	Result    string    `json:"result" db:"result"`
+	Detail    string    `json:"detail,omitempty" db:"detail"`
+	RemoteIP  string    `json:"remote_ip" db:"remote_ip"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// AuditFilter narrows ListAuditEvents. Zero values match everything. Before
+// is an event ID cursor: only older events are returned.
+type AuditFilter struct {
+	Actor  string
+	Route  string
+	NodeID string
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Before int64
+	Limit  int
+}
+
+// AuditResult classifies an HTTP status as success, denied or error
+func AuditResult(status int) string {
+	switch {
+	case status < 400:
+		return AuditSuccess
+	case status == 401 || status == 403 || status == 429:
+		return AuditDenied
+	default:
+		return AuditError
+	}
+}
+
+// RecordAuditEvent appends an event, filling in its ID
+func (s *NodeStorage) RecordAuditEvent(event *AuditEvent) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	query := `
+	INSERT INTO audit_events (actor, method, route, node_ids, status, result, detail, remote_ip, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	res, err := s.db.Exec(query, event.Actor, event.Method, event.Route,
+		strings.Join(event.NodeIDs, ","), event.Status, event.Result,
+		event.Detail, event.RemoteIP, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	event.ID, err = res.LastInsertId()
+	return err
+}
+
+// ListAuditEvents returns matching events, newest first
+func (s *NodeStorage) ListAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	query := `
+	SELECT id, actor, method, route, node_ids, status, result, detail, remote_ip, created_at
+	FROM audit_events
+	WHERE 1 = 1
+	`
+	var args []interface{}
+
+	if filter.Actor != "" {
+		query += ` AND actor = ?`
+		args = append(args, filter.Actor)
+	}
+	if filter.Route != "" {
+		query += ` AND route = ?`
+		args = append(args, filter.Route)
+	}
+	if filter.NodeID != "" {
+		// node_ids is comma separated; wrap both sides so IDs match whole
+		query += ` AND instr(',' || node_ids || ',', ?) > 0`
+		args = append(args, ","+filter.NodeID+",")
+	}
+	if filter.Result != "" {
+		query += ` AND result = ?`
+		args = append(args, filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, filter.Until)
+	}
+	if filter.Before > 0 {
+		query += ` AND id < ?`
+		args = append(args, filter.Before)
+	}
+
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var nodeIDs string
+		err := rows.Scan(&event.ID, &event.Actor, &event.Method, &event.Route, &nodeIDs,
+			&event.Status, &event.Result, &event.Detail, &event.RemoteIP, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if nodeIDs != "" {
+			event.NodeIDs = strings.Split(nodeIDs, ",")
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// PruneAuditEvents deletes events recorded before the retention period. It
+// lifts the delete trigger for the duration of its transaction, so no other
+// delete can slip through.
+func (s *NodeStorage) PruneAuditEvents(retention time.Duration) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DROP TRIGGER IF EXISTS audit_events_no_delete`); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM audit_events WHERE created_at < ?`, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(auditNoDeleteTrigger); err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
@@ -0,0 +1,224 @@
+// internal/storage/commands.go
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Command types an agent understands
+const (
+	CommandRestartProxy      = "restart_proxy"
+	CommandRotateCredentials = "rotate_credentials"
+	CommandReloadPolicy      = "reload_policy"
+	CommandDrain             = "drain"
+	CommandRunDiagnostics    = "run_diagnostics"
+	CommandSetInterval       = "set_heartbeat_interval"
+	CommandUpdateAgent       = "update_agent"
+)
+
+// Command states. A command is pending until it is handed to the agent in a
+// heartbeat response, then sent until the agent acknowledges it with the
+// outcome on a later heartbeat.
+const (
+	CommandPending   = "pending"
+	CommandSent      = "sent"
+	CommandSucceeded = "succeeded"
+	CommandFailed    = "failed"
+)
+
+var ErrCommandNotFound = errors.New("command not found or already completed")
+
+// NodeCommand is an instruction queued for one node. Args and Result are
+// JSON whose shape depends on the command type.
+type NodeCommand struct {
+	ID          string          `json:"id" db:"id"`
+	NodeID      string          `json:"node_id" db:"node_id"`
+	Type        string          `json:"type" db:"type"`
+	Args        json.RawMessage `json:"args,omitempty" db:"args"`
+	Status      string          `json:"status" db:"status"`
+	RequestedBy string          `json:"requested_by" db:"requested_by"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	SentAt      *time.Time      `json:"sent_at,omitempty" db:"sent_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty" db:"completed_at"`
+	Result      json.RawMessage `json:"result,omitempty" db:"result"`
+	Error       string          `json:"error,omitempty" db:"error"`
+}
+
+// CommandFilter selects commands for ListCommands. Empty fields match all.
+type CommandFilter struct {
+	NodeID string
+	Type   string
+	Status string
+	Limit  int
+}
+
+const commandColumns = `id, node_id, type, args, status, requested_by, created_at,
+	       sent_at, completed_at, result, error`
+
+func scanCommand(row rowScanner) (*NodeCommand, error) {
+	var cmd NodeCommand
+	var args, result string
+	var sent, completed sql.NullTime
+	err := row.Scan(&cmd.ID, &cmd.NodeID, &cmd.Type, &args, &cmd.Status, &cmd.RequestedBy,
+		&cmd.CreatedAt, &sent, &completed, &result, &cmd.Error)
+	if err != nil {
+		return nil, err
+	}
+	if args != "" {
+		cmd.Args = json.RawMessage(args)
+	}
+	if result != "" {
+		cmd.Result = json.RawMessage(result)
+	}
+	if sent.Valid {
+		cmd.SentAt = &sent.Time
+	}
+	if completed.Valid {
+		cmd.CompletedAt = &completed.Time
+	}
+	return &cmd, nil
+}
+
+// QueueCommand adds a command for a node, delivered on its next heartbeat
+func (s *NodeStorage) QueueCommand(nodeID, cmdType string, args json.RawMessage, requestedBy string) (*NodeCommand, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := &NodeCommand{
+		ID:          id,
+		NodeID:      nodeID,
+		Type:        cmdType,
+		Args:        args,
+		Status:      CommandPending,
+		RequestedBy: requestedBy,
+		CreatedAt:   time.Now(),
+	}
+
+	_, err = s.db.Exec(`
+	INSERT INTO node_commands (id, node_id, type, args, status, requested_by, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, cmd.ID, cmd.NodeID, cmd.Type, string(cmd.Args), cmd.Status, cmd.RequestedBy, cmd.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// DueCommands returns the node's unacknowledged commands in the order they
+// were queued, marking pending ones sent. Sent commands are returned again
+// until acknowledged, so a lost response does not lose them.
+func (s *NodeStorage) DueCommands(nodeID string) ([]NodeCommand, error) {
+	rows, err := s.db.Query(`
+	SELECT `+commandColumns+`
+	FROM node_commands
+	WHERE node_id = ? AND status IN (?, ?)
+	ORDER BY created_at
+	`, nodeID, CommandPending, CommandSent)
+	if err != nil {
+		return nil, err
+	}
+
+	var commands []NodeCommand
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		commands = append(commands, *cmd)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range commands {
+		if commands[i].Status != CommandPending {
+			continue
+		}
+		_, err := s.db.Exec(`UPDATE node_commands SET status = ?, sent_at = ? WHERE id = ?`,
+			CommandSent, now, commands[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		commands[i].Status = CommandSent
+		commands[i].SentAt = &now
+	}
+	return commands, nil
+}
+
+// AckCommand records the outcome the agent reported for a sent command.
+// Acknowledging a completed command again is a no-op.
+func (s *NodeStorage) AckCommand(id, nodeID string, succeeded bool, result json.RawMessage, errMsg string) error {
+	status := CommandFailed
+	if succeeded {
+		status = CommandSucceeded
+	}
+
+	res, err := s.db.Exec(`
+	UPDATE node_commands SET status = ?, completed_at = ?, result = ?, error = ?
+	WHERE id = ? AND node_id = ? AND status = ?
+	`, status, time.Now(), string(result), errMsg, id, nodeID, CommandSent)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var current string
+	err = s.db.QueryRow(`SELECT status FROM node_commands WHERE id = ? AND node_id = ?`, id, nodeID).Scan(&current)
+	if err == nil && (current == CommandSucceeded || current == CommandFailed) {
+		return nil
+	}
+	return ErrCommandNotFound
+}
+
+// PruneCommands deletes commands that completed before the retention
+// period, and undelivered ones queued before it for nodes that never
+// collected them
+func (s *NodeStorage) PruneCommands(retention time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-retention)
+	res, err := s.db.Exec(`
+	DELETE FROM node_commands
+	WHERE (status IN (?, ?) AND completed_at < ?) OR (status IN (?, ?) AND created_at < ?)
+	`, CommandSucceeded, CommandFailed, cutoff, CommandPending, CommandSent, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// ListCommands returns commands, newest first
+func (s *NodeStorage) ListCommands(filter CommandFilter) ([]NodeCommand, error) {
+	rows, err := s.db.Query(`
+	SELECT `+commandColumns+`
+	FROM node_commands
+	WHERE (? = '' OR node_id = ?) AND (? = '' OR type = ?) AND (? = '' OR status = ?)
+	ORDER BY created_at DESC LIMIT ?
+	`, filter.NodeID, filter.NodeID, filter.Type, filter.Type, filter.Status, filter.Status, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []NodeCommand
+	for rows.Next() {
+		cmd, err := scanCommand(rows)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, *cmd)
+	}
+	return commands, rows.Err()
+}
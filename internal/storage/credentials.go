@@ -0,0 +1,149 @@
+// internal/storage/credentials.go
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// decryptCredentials replaces a node's stored username and password with
+// their plaintext values
+func (s *NodeStorage) decryptCredentials(node *ProxyNode) error {
+	username, err := s.cipher.Decrypt(node.Username)
+	if err != nil {
+		return err
+	}
+	password, err := s.cipher.Decrypt(node.Password)
+	if err != nil {
+		return err
+	}
+
+	node.Username = username
+	node.Password = password
+	return nil
+}
+
+// verifyMasterKey decrypts one stored credential so a wrong master key fails
+// at startup instead of on the first node listing
+func (s *NodeStorage) verifyMasterKey() error {
+	var id, username string
+	err := s.db.QueryRow(`SELECT id, username FROM proxy_nodes WHERE username LIKE ? LIMIT 1`,
+		envelopePrefix+"%").Scan(&id, &username)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.cipher.Decrypt(username); err != nil {
+		return fmt.Errorf("master key does not decrypt the credentials of node %s: %w", id, err)
+	}
+	return nil
+}
+
+// HasEncryptedCredentials reports whether the database at dbPath holds
+// encrypted credentials. A missing database holds none; it is not created.
+func HasEncryptedCredentials(dbPath string) (bool, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var tables int
+	err = db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'proxy_nodes'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return false, err
+	}
+
+	var encrypted bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM proxy_nodes WHERE username LIKE ? OR password LIKE ?)`,
+		envelopePrefix+"%", envelopePrefix+"%").Scan(&encrypted)
+	return encrypted, err
+}
+
+// encryptPlaintextRows encrypts credentials written before encryption at
+// rest was introduced
+func (s *NodeStorage) encryptPlaintextRows() error {
+	_, err := s.rewrapCredentials(s.cipher, func(value string) bool {
+		return !strings.HasPrefix(value, envelopePrefix)
+	})
+	return err
+}
+
+// Rekey re-encrypts every node's credentials under newMasterKey in a single
+// transaction. Once it returns, the storage uses the new key and the old key
+// is no longer needed.
+func (s *NodeStorage) Rekey(newMasterKey []byte) (int, error) {
+	next, err := newCredentialCipher(newMasterKey)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := s.rewrapCredentials(next, func(string) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+
+	s.cipher = next
+	return count, nil
+}
+
+// rewrapCredentials rewrites the username and password of every row for
+// which selected returns true, wrapping their data keys under next, and
+// returns the number of rows rewritten
+func (s *NodeStorage) rewrapCredentials(next *credentialCipher, selected func(string) bool) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, username, password FROM proxy_nodes`)
+	if err != nil {
+		return 0, err
+	}
+
+	type row struct{ id, username, password string }
+	var pending []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.username, &r.password); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if selected(r.username) || selected(r.password) {
+			pending = append(pending, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, r := range pending {
+		username, err := s.cipher.rewrap(r.username, next)
+		if err != nil {
+			return 0, fmt.Errorf("node %s: %w", r.id, err)
+		}
+		password, err := s.cipher.rewrap(r.password, next)
+		if err != nil {
+			return 0, fmt.Errorf("node %s: %w", r.id, err)
+		}
+
+		_, err = tx.Exec(`UPDATE proxy_nodes SET username = ?, password = ? WHERE id = ?`,
+			username, password, r.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(pending), tx.Commit()
+}
@@ -0,0 +1,199 @@
+// internal/storage/crypto.go
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Encrypted column values look like enc:v1:<key-id>:<wrapped-dek>:<ciphertext>.
+// Each value gets its own random data key which is wrapped with the master
+// key, so rekeying only has to rewrap data keys.
+const (
+	envelopePrefix = "enc:v1:"
+	MasterKeySize  = 32
+)
+
+var ErrWrongMasterKey = errors.New("value was encrypted under a different master key")
+
+type credentialCipher struct {
+	keyID  string
+	master cipher.AEAD
+}
+
+func newCredentialCipher(masterKey []byte) (*credentialCipher, error) {
+	if len(masterKey) != MasterKeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", MasterKeySize, len(masterKey))
+	}
+
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(masterKey)
+	return &credentialCipher{keyID: hex.EncodeToString(sum[:4]), master: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealAEAD(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openAEAD(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// Encrypt seals plaintext under a fresh data key wrapped by the master key
+func (c *credentialCipher) Encrypt(plaintext string) (string, error) {
+	dek := make([]byte, MasterKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+
+	wrapped, err := sealAEAD(c.master, dek)
+	if err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	data, err := sealAEAD(dataAEAD, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	return envelopePrefix + c.keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+// Decrypt opens an envelope. Values without the envelope prefix are legacy
+// plaintext rows and are returned unchanged.
+func (c *credentialCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return value, nil
+	}
+
+	dek, data, err := c.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newGCM(dek)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openAEAD(dataAEAD, data)
+	if err != nil {
+		return "", fmt.Errorf("decrypt error: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// unwrap returns the data key and sealed payload of an envelope
+func (c *credentialCipher) unwrap(value string) ([]byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, envelopePrefix), ":")
+	if len(parts) != 3 {
+		return nil, nil, fmt.Errorf("malformed encrypted value")
+	}
+	if parts[0] != c.keyID {
+		return nil, nil, ErrWrongMasterKey
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed data key: %w", err)
+	}
+	data, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed ciphertext: %w", err)
+	}
+
+	dek, err := openAEAD(c.master, wrapped)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dek, data, nil
+}
+
+// rewrap re-encrypts an envelope's data key under next without touching the
+// payload. Plaintext values are encrypted under next.
+func (c *credentialCipher) rewrap(value string, next *credentialCipher) (string, error) {
+	if !strings.HasPrefix(value, envelopePrefix) {
+		return next.Encrypt(value)
+	}
+
+	dek, data, err := c.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := sealAEAD(next.master, dek)
+	if err != nil {
+		return "", err
+	}
+
+	return envelopePrefix + next.keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+// ParseMasterKey accepts a 32-byte key encoded as hex or base64
+func ParseMasterKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == MasterKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes encoded as hex or base64", MasterKeySize)
+}
+
+// LoadOrCreateMasterKey reads a master key file, generating a new random key
+// with 0600 permissions if the file does not exist
+func LoadOrCreateMasterKey(path string) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := ParseMasterKey(string(data))
+		return key, false, err
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, false, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
@@ -4,6 +4,8 @@ package storage
 import (
 	"database/sql"
 	"fmt"
+	"net"
+	"strconv"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -13,8 +15,8 @@ type ProxyNode struct {
 	ID        string    `json:"id" db:"id"`
 	IP        string    `json:"ip" db:"ip"`
 	Port      int       `json:"port" db:"port"`
-	Username  string    `json:"username" db:"username"`
-	Password  string    `json:"password" db:"password"`
+	Username  string    `json:"username,omitempty" db:"username"`
+	Password  string    `json:"password,omitempty" db:"password"`
 	Country   string    `json:"country" db:"country"`
 	Region    string    `json:"region" db:"region"`
 	City      string    `json:"city" db:"city"`
@@ -22,26 +24,82 @@ type ProxyNode struct {
 	LastSeen  time.Time `json:"last_seen" db:"last_seen"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+
+	// IPv6 egress address reported alongside IP, if the node has one
+	IPv6 string `json:"ipv6,omitempty" db:"ipv6"`
+
+	// Set by the controller from the heartbeat's source address and its own
+	// geo database. Mismatch lists what disagrees with the reported values
+	// ("ip", "country"), empty when everything checked out.
+	ObservedIP      string `json:"observed_ip" db:"observed_ip"`
+	VerifiedCountry string `json:"verified_country" db:"verified_country"`
+	VerifiedRegion  string `json:"verified_region" db:"verified_region"`
+	VerifiedCity    string `json:"verified_city" db:"verified_city"`
+	Mismatch        string `json:"mismatch,omitempty" db:"mismatch"`
+
+	// Result of the agent's SOCKS5 check against its own service: "ok" or
+	// the step that failed. Empty for agents that do not run the check.
+	SelfCheck          string `json:"self_check,omitempty" db:"self_check"`
+	SelfCheckError     string `json:"self_check_error,omitempty" db:"self_check_error"`
+	SelfCheckLatencyMs int64  `json:"self_check_latency_ms,omitempty" db:"self_check_latency_ms"`
+
+	// Set while the agent has been told to drain: it keeps serving existing
+	// clients but is not handed out to new ones
+	Draining bool `json:"draining,omitempty" db:"draining"`
+
+	// HostID is the enrolled agent this endpoint belongs to. A host with
+	// several public addresses reports one endpoint per address; the one
+	// with the host's own ID is its primary.
+	HostID string `json:"host_id,omitempty" db:"host_id"`
+
+	// Version of the agent binary, empty for agents that predate reporting it
+	AgentVersion string `json:"agent_version,omitempty" db:"agent_version"`
 }
 
 type NodeStorage struct {
-	db *sql.DB
+	db     *sql.DB
+	cipher *credentialCipher
 }
 
-func NewNodeStorage(dbPath string) (*NodeStorage, error) {
+// NewNodeStorage opens the database. SOCKS credentials are encrypted at rest
+// under masterKey, and any plaintext rows left from older versions are
+// encrypted on open.
+func NewNodeStorage(dbPath string, masterKey []byte) (*NodeStorage, error) {
+	cipher, err := newCredentialCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	storage := &NodeStorage{db: db}
+	storage := &NodeStorage{db: db, cipher: cipher}
 	if err := storage.createTables(); err != nil {
 		return nil, err
 	}
 
+	if err := storage.verifyMasterKey(); err != nil {
+		return nil, err
+	}
+
+	if err := storage.encryptPlaintextRows(); err != nil {
+		return nil, fmt.Errorf("failed to encrypt existing credentials: %w", err)
+	}
+
 	return storage, nil
 }
 
+// auditNoDeleteTrigger keeps audit events from being deleted. Only
+// PruneAuditEvents lifts it, inside its own transaction.
+const auditNoDeleteTrigger = `
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_events is append-only');
+	END;
+	`
+
 func (s *NodeStorage) createTables() error {
 	query := `
 	CREATE TABLE IF NOT EXISTS proxy_nodes (
@@ -53,6 +111,18 @@ func (s *NodeStorage) createTables() error {
 		country TEXT,
 		region TEXT,
 		city TEXT,
+		ipv6 TEXT NOT NULL DEFAULT '',
+		observed_ip TEXT NOT NULL DEFAULT '',
+		verified_country TEXT NOT NULL DEFAULT '',
+		verified_region TEXT NOT NULL DEFAULT '',
+		verified_city TEXT NOT NULL DEFAULT '',
+		mismatch TEXT NOT NULL DEFAULT '',
+		self_check TEXT NOT NULL DEFAULT '',
+		self_check_error TEXT NOT NULL DEFAULT '',
+		self_check_latency_ms INTEGER NOT NULL DEFAULT 0,
+		draining BOOLEAN NOT NULL DEFAULT false,
+		host_id TEXT NOT NULL DEFAULT '',
+		agent_version TEXT NOT NULL DEFAULT '',
 		is_online BOOLEAN DEFAULT true,
 		last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -62,66 +132,338 @@ func (s *NodeStorage) createTables() error {
 	CREATE INDEX IF NOT EXISTS idx_nodes_online ON proxy_nodes(is_online);
 	CREATE INDEX IF NOT EXISTS idx_nodes_country ON proxy_nodes(country);
 	CREATE INDEX IF NOT EXISTS idx_nodes_last_seen ON proxy_nodes(last_seen);
-	`
-	_, err := s.db.Exec(query)
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		revoked_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS join_tokens (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		used_by TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS node_keys (
+		node_id TEXT PRIMARY KEY,
+		hostname TEXT,
+		public_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		revoked_at DATETIME
+	);
+
+	CREATE TABLE IF NOT EXISTS credential_leases (
+		id TEXT PRIMARY KEY,
+		node_id TEXT NOT NULL,
+		leased_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		invalidated_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_leases_node ON credential_leases(node_id);
+	CREATE INDEX IF NOT EXISTS idx_leases_expires ON credential_leases(expires_at);
+
+	CREATE TABLE IF NOT EXISTS access_policies (
+		id TEXT PRIMARY KEY,
+		policy TEXT NOT NULL,
+		version TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS credential_rotations (
+		id TEXT PRIMARY KEY,
+		node_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		overlap_seconds INTEGER NOT NULL,
+		requested_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		not_before DATETIME NOT NULL,
+		sent_at DATETIME,
+		completed_at DATETIME,
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_rotations_node ON credential_rotations(node_id, status);
+
+	CREATE TABLE IF NOT EXISTS node_commands (
+		id TEXT PRIMARY KEY,
+		node_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		args TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		requested_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		sent_at DATETIME,
+		completed_at DATETIME,
+		result TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_commands_node ON node_commands(node_id, status);
+
+	CREATE TABLE IF NOT EXISTS agent_releases (
+		version TEXT PRIMARY KEY,
+		sha256 TEXT NOT NULL,
+		signature TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		binary BLOB NOT NULL, -- empty; binaries are kept in the release directory
+		uploaded_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS heartbeat_sequences (
+		node_id TEXT PRIMARY KEY,
+		last_seq INTEGER NOT NULL,
+		last_sent_at DATETIME NOT NULL,
+		last_backfill_seq INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS heartbeat_replays (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		last_seq INTEGER NOT NULL,
+		sent_at DATETIME NOT NULL,
+		reason TEXT NOT NULL,
+		remote_ip TEXT NOT NULL,
+		detected_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_replays_node ON heartbeat_replays(node_id);
+
+	CREATE TABLE IF NOT EXISTS node_metrics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_id TEXT NOT NULL,
+		recorded_at DATETIME NOT NULL,
+		cpu_percent REAL NOT NULL,
+		mem_total_bytes INTEGER NOT NULL,
+		mem_available_bytes INTEGER NOT NULL,
+		load1 REAL NOT NULL,
+		load5 REAL NOT NULL,
+		load15 REAL NOT NULL,
+		uptime_seconds REAL NOT NULL,
+		interfaces TEXT NOT NULL,
+		socks_connections INTEGER NOT NULL,
+		self_check TEXT NOT NULL DEFAULT '',
+		backfilled BOOLEAN NOT NULL DEFAULT false,
+		seq INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_metrics_node ON node_metrics(node_id, recorded_at);
+
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL,
+		method TEXT NOT NULL,
+		route TEXT NOT NULL,
+		node_ids TEXT NOT NULL DEFAULT '',
+		status INTEGER NOT NULL,
+		result TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		remote_ip TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_audit_created ON audit_events(created_at);
+	CREATE INDEX IF NOT EXISTS idx_audit_actor ON audit_events(actor);
+
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_events is append-only');
+	END;
+	` + auditNoDeleteTrigger
+	if _, err := s.db.Exec(query); err != nil {
+		return err
+	}
+	if err := s.addMissingColumns(); err != nil {
+		return err
+	}
+	// After addMissingColumns, which adds seq to older databases
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_metrics_seq ON node_metrics(node_id, seq)`); err != nil {
+		return err
+	}
+	if err := s.uniqueOpenRotations(); err != nil {
+		return err
+	}
+	return s.convertMetricsTimes()
+}
+
+// uniqueOpenRotations indexes open rotations so a node can have only one.
+// Older versions could schedule two at once; all but the oldest are failed
+// first so the index can be built.
+func (s *NodeStorage) uniqueOpenRotations() error {
+	_, err := s.db.Exec(`
+	UPDATE credential_rotations SET status = ?, completed_at = ?, error = 'superseded by an earlier open rotation'
+	WHERE status IN (?, ?) AND EXISTS (
+		SELECT 1 FROM credential_rotations earlier
+		WHERE earlier.node_id = credential_rotations.node_id AND earlier.status IN (?, ?)
+		  AND (earlier.created_at < credential_rotations.created_at
+		       OR (earlier.created_at = credential_rotations.created_at AND earlier.id < credential_rotations.id))
+	)
+	`, RotationFailed, time.Now(), RotationPending, RotationSent, RotationPending, RotationSent)
+	if err != nil {
+		return err
+	}
+
+	// The statuses are RotationPending and RotationSent; a partial index
+	// needs them as literals
+	_, err = s.db.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_rotations_open ON credential_rotations(node_id)
+	WHERE status IN ('pending', 'sent')
+	`)
 	return err
 }
 
-func (s *NodeStorage) UpsertNode(node *ProxyNode) error {
-	query := `
-	INSERT OR REPLACE INTO proxy_nodes 
-	(id, ip, port, username, password, country, region, city, is_online, last_seen, updated_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, true, ?, ?)
-	`
+// addedColumns are columns introduced after their table was first created.
+// Databases from older versions get them on open.
+var addedColumns = []struct{ table, column, definition string }{
+	{"proxy_nodes", "observed_ip", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "verified_country", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "verified_region", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "verified_city", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "mismatch", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "ipv6", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "self_check", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "self_check_error", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "self_check_latency_ms", "INTEGER NOT NULL DEFAULT 0"},
+	{"proxy_nodes", "draining", "BOOLEAN NOT NULL DEFAULT false"},
+	{"proxy_nodes", "host_id", "TEXT NOT NULL DEFAULT ''"},
+	{"proxy_nodes", "agent_version", "TEXT NOT NULL DEFAULT ''"},
+	{"node_metrics", "self_check", "TEXT NOT NULL DEFAULT ''"},
+	{"node_metrics", "backfilled", "BOOLEAN NOT NULL DEFAULT false"},
+	{"node_metrics", "seq", "INTEGER NOT NULL DEFAULT 0"},
+	{"heartbeat_sequences", "last_backfill_seq", "INTEGER NOT NULL DEFAULT 0"},
+}
 
-	nodeID := fmt.Sprintf("%s:%d", node.IP, node.Port)
-	now := time.Now()
+func (s *NodeStorage) addMissingColumns() error {
+	for _, c := range addedColumns {
+		var count int
+		err := s.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return nil
+}
 
-	_, err := s.db.Exec(query, nodeID, node.IP, node.Port, node.Username,
-		node.Password, node.Country, node.Region, node.City, now, now)
+// convertMetricsTimes rewrites sample times stored by older versions in the
+// controller's local zone as UTC. Times are compared as text, which only
+// orders them correctly when every row uses the same zone.
+func (s *NodeStorage) convertMetricsTimes() error {
+	_, err := s.db.Exec(`
+	UPDATE node_metrics SET recorded_at = strftime('%Y-%m-%d %H:%M:%f+00:00', recorded_at)
+	WHERE recorded_at NOT LIKE '%+00:00'
+	`)
 	return err
 }
 
-func (s *NodeStorage) GetOnlineNodes() ([]ProxyNode, error) {
+// nodeColumns is the column list scanned by scanNode
+const nodeColumns = `id, ip, port, username, password, country, region, city, ipv6,
+	       observed_ip, verified_country, verified_region, verified_city, mismatch,
+	       self_check, self_check_error, self_check_latency_ms, draining, host_id, agent_version,
+	       is_online, last_seen, created_at, updated_at`
+
+// scanNode reads a row selected with nodeColumns. Credentials are left
+// encrypted.
+func scanNode(row rowScanner) (*ProxyNode, error) {
+	var node ProxyNode
+	err := row.Scan(&node.ID, &node.IP, &node.Port, &node.Username,
+		&node.Password, &node.Country, &node.Region, &node.City, &node.IPv6,
+		&node.ObservedIP, &node.VerifiedCountry, &node.VerifiedRegion, &node.VerifiedCity, &node.Mismatch,
+		&node.SelfCheck, &node.SelfCheckError, &node.SelfCheckLatencyMs, &node.Draining, &node.HostID, &node.AgentVersion,
+		&node.IsOnline, &node.LastSeen, &node.CreatedAt, &node.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// UpsertNode stores a heartbeat and reports whether the node came back with
+// different credentials than the ones on record
+func (s *NodeStorage) UpsertNode(node *ProxyNode) (bool, error) {
 	query := `
-	SELECT id, ip, port, username, password, country, region, city, 
-	       is_online, last_seen, created_at, updated_at 
-	FROM proxy_nodes 
-	WHERE is_online = true AND last_seen > datetime('now', '-5 minutes')
-	ORDER BY last_seen DESC
+	INSERT OR REPLACE INTO proxy_nodes 
+	(id, ip, port, username, password, country, region, city, ipv6,
+	 observed_ip, verified_country, verified_region, verified_city, mismatch,
+	 self_check, self_check_error, self_check_latency_ms, draining, host_id, agent_version,
+	 is_online, last_seen, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, true, ?, ?)
 	`
 
-	rows, err := s.db.Query(query)
+	// Enrolled nodes carry their assigned ID; fall back to ip:port otherwise
+	nodeID := node.ID
+	if nodeID == "" {
+		nodeID = net.JoinHostPort(node.IP, strconv.Itoa(node.Port))
+	}
+	now := time.Now()
+	changed := s.credentialsChanged(nodeID, node)
+
+	username, err := s.cipher.Encrypt(node.Username)
 	if err != nil {
-		return nil, err
+		return false, err
+	}
+	password, err := s.cipher.Encrypt(node.Password)
+	if err != nil {
+		return false, err
 	}
-	defer rows.Close()
 
-	var nodes []ProxyNode
-	for rows.Next() {
-		var node ProxyNode
-		err := rows.Scan(&node.ID, &node.IP, &node.Port, &node.Username,
-			&node.Password, &node.Country, &node.Region, &node.City,
-			&node.IsOnline, &node.LastSeen, &node.CreatedAt, &node.UpdatedAt)
-		if err != nil {
-			continue
-		}
-		nodes = append(nodes, node)
+	_, err = s.db.Exec(query, nodeID, node.IP, node.Port, username,
+		password, node.Country, node.Region, node.City, node.IPv6,
+		node.ObservedIP, node.VerifiedCountry, node.VerifiedRegion, node.VerifiedCity, node.Mismatch,
+		node.SelfCheck, node.SelfCheckError, node.SelfCheckLatencyMs, node.Draining, node.HostID, node.AgentVersion,
+		now, now)
+	if err != nil {
+		return false, err
 	}
 
-	return nodes, nil
+	// Credentials handed out by expired leases stop working once they change
+	if changed {
+		return true, s.invalidateExpiredLeases(nodeID)
+	}
+	return false, nil
+}
+
+func (s *NodeStorage) GetOnlineNodes() ([]ProxyNode, error) {
+	query := `
+	SELECT ` + nodeColumns + `
+	FROM proxy_nodes
+	WHERE is_online = true AND last_seen > datetime('now', '-5 minutes')
+	ORDER BY last_seen DESC
+	`
+	return s.queryNodes(query)
 }
 
 func (s *NodeStorage) GetNodesByCountry(country string) ([]ProxyNode, error) {
 	query := `
-	SELECT id, ip, port, username, password, country, region, city,
-	       is_online, last_seen, created_at, updated_at 
-	FROM proxy_nodes 
+	SELECT ` + nodeColumns + `
+	FROM proxy_nodes
 	WHERE country = ? AND is_online = true AND last_seen > datetime('now', '-5 minutes')
 	ORDER BY last_seen DESC
 	`
+	return s.queryNodes(query, country)
+}
 
-	rows, err := s.db.Query(query, country)
+// queryNodes runs a node query and decrypts each row's credentials. A row
+// that cannot be read fails the query rather than silently going missing.
+func (s *NodeStorage) queryNodes(query string, args ...interface{}) ([]ProxyNode, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -129,17 +471,17 @@ func (s *NodeStorage) GetNodesByCountry(country string) ([]ProxyNode, error) {
 
 	var nodes []ProxyNode
 	for rows.Next() {
-		var node ProxyNode
-		err := rows.Scan(&node.ID, &node.IP, &node.Port, &node.Username,
-			&node.Password, &node.Country, &node.Region, &node.City,
-			&node.IsOnline, &node.LastSeen, &node.CreatedAt, &node.UpdatedAt)
+		node, err := scanNode(rows)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		nodes = append(nodes, node)
+		if err := s.decryptCredentials(node); err != nil {
+			return nil, fmt.Errorf("node %s: %w", node.ID, err)
+		}
+		nodes = append(nodes, *node)
 	}
 
-	return nodes, nil
+	return nodes, rows.Err()
 }
 
 func (s *NodeStorage) MarkOfflineNodes() error {
@@ -152,6 +494,17 @@ func (s *NodeStorage) MarkOfflineNodes() error {
 	return err
 }
 
+// DeregisterNode takes a node and its exits offline at once, as on a clean
+// agent shutdown. Its next heartbeat brings them back.
+func (s *NodeStorage) DeregisterNode(nodeID string) error {
+	_, err := s.db.Exec(`
+	UPDATE proxy_nodes
+	SET is_online = false, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? OR host_id = ?
+	`, nodeID, nodeID)
+	return err
+}
+
 func (s *NodeStorage) Close() error {
 	return s.db.Close()
 }
@@ -0,0 +1,209 @@
+// internal/storage/enrollment.go
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const joinTokenPrefix = "tpj_"
+
+var (
+	ErrInvalidJoinToken = errors.New("join token is invalid, expired or already used")
+	ErrUnknownNode      = errors.New("unknown or revoked node")
+)
+
+type JoinToken struct {
+	ID        string     `json:"id" db:"id"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty" db:"used_at"`
+	UsedBy    string     `json:"used_by,omitempty" db:"used_by"`
+}
+
+type NodeKey struct {
+	NodeID    string     `json:"node_id" db:"node_id"`
+	Hostname  string     `json:"hostname" db:"hostname"`
+	PublicKey string     `json:"public_key" db:"public_key"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+}
+
+// CreateJoinToken issues a single-use enrollment token valid for ttl. The raw
+// token is returned once and only its hash is persisted.
+func (s *NodeStorage) CreateJoinToken(ttl time.Duration) (*JoinToken, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", err
+	}
+	raw := joinTokenPrefix + secret
+
+	now := time.Now()
+	token := &JoinToken{
+		ID:        id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	query := `
+	INSERT INTO join_tokens (id, token_hash, created_at, expires_at)
+	VALUES (?, ?, ?, ?)
+	`
+	if _, err := s.db.Exec(query, token.ID, hashSecret(raw), token.CreatedAt, token.ExpiresAt); err != nil {
+		return nil, "", err
+	}
+
+	return token, raw, nil
+}
+
+func (s *NodeStorage) ListJoinTokens() ([]JoinToken, error) {
+	query := `
+	SELECT id, created_at, expires_at, used_at, COALESCE(used_by, '')
+	FROM join_tokens
+	ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []JoinToken
+	for rows.Next() {
+		var token JoinToken
+		var usedAt sql.NullTime
+		err := rows.Scan(&token.ID, &token.CreatedAt, &token.ExpiresAt, &usedAt, &token.UsedBy)
+		if err != nil {
+			continue
+		}
+		if usedAt.Valid {
+			token.UsedAt = &usedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// EnrollNode consumes a join token and registers the node's public key in a
+// single transaction, returning the newly assigned node ID
+func (s *NodeStorage) EnrollNode(rawToken, hostname, publicKey string) (string, error) {
+	nodeID, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	nodeID = "node-" + nodeID
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(`
+	UPDATE join_tokens SET used_at = ?, used_by = ?
+	WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, now, nodeID, hashSecret(rawToken), now)
+	if err != nil {
+		return "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return "", ErrInvalidJoinToken
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO node_keys (node_id, hostname, public_key, created_at)
+	VALUES (?, ?, ?, ?)
+	`, nodeID, hostname, publicKey, now)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return nodeID, nil
+}
+
+// GetNodeKey returns the active key for a node, or ErrUnknownNode if the node
+// was never enrolled or its key has been revoked
+func (s *NodeStorage) GetNodeKey(nodeID string) (*NodeKey, error) {
+	query := `
+	SELECT node_id, hostname, public_key, created_at
+	FROM node_keys
+	WHERE node_id = ? AND revoked_at IS NULL
+	`
+
+	var key NodeKey
+	err := s.db.QueryRow(query, nodeID).Scan(&key.NodeID, &key.Hostname, &key.PublicKey, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownNode
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *NodeStorage) ListNodeKeys() ([]NodeKey, error) {
+	query := `
+	SELECT node_id, hostname, public_key, created_at, revoked_at
+	FROM node_keys
+	ORDER BY created_at DESC
+	`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []NodeKey
+	for rows.Next() {
+		var key NodeKey
+		var revoked sql.NullTime
+		err := rows.Scan(&key.NodeID, &key.Hostname, &key.PublicKey, &key.CreatedAt, &revoked)
+		if err != nil {
+			continue
+		}
+		if revoked.Valid {
+			key.RevokedAt = &revoked.Time
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// RevokeNodeKey revokes a node's signing key and takes the node and its
+// exits offline
+func (s *NodeStorage) RevokeNodeKey(nodeID string) error {
+	result, err := s.db.Exec(`
+	UPDATE node_keys SET revoked_at = ?
+	WHERE node_id = ? AND revoked_at IS NULL
+	`, time.Now(), nodeID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = s.db.Exec(`
+	UPDATE proxy_nodes SET is_online = false, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? OR host_id = ?
+	`, nodeID, nodeID)
+	return err
+}
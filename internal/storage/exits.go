@@ -0,0 +1,37 @@
+// internal/storage/exits.go
+package storage
+
+import (
+	"strings"
+	"time"
+)
+
+// ExitID is the node ID of an additional public address on an enrolled host
+func ExitID(hostID, ip string) string {
+	return hostID + "@" + ip
+}
+
+// IsExit reports whether the node is an additional address of another host
+// rather than a host's primary endpoint
+func (n *ProxyNode) IsExit() bool {
+	return n.HostID != "" && n.HostID != n.ID
+}
+
+// RetireExits takes offline the host's exits that are not in current, such
+// as an address removed from the server. Their rows are kept so leases and
+// history still resolve.
+func (s *NodeStorage) RetireExits(hostID string, current []string) error {
+	query := `
+	UPDATE proxy_nodes SET is_online = false, updated_at = ?
+	WHERE host_id = ? AND id != ? AND is_online = true`
+	args := []interface{}{time.Now(), hostID, hostID}
+	if len(current) > 0 {
+		query += ` AND id NOT IN (?` + strings.Repeat(", ?", len(current)-1) + `)`
+		for _, id := range current {
+			args = append(args, id)
+		}
+	}
+
+	_, err := s.db.Exec(query, args...)
+	return err
+}
@@ -0,0 +1,154 @@
+// internal/storage/leases.go
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Lease states as reported by ListLeases. An expired lease stays "expired"
+// until the credentials it handed out stop working, when the node's
+// credentials change or a rotation's overlap ends, and it becomes
+// "invalidated".
+const (
+	LeaseActive      = "active"
+	LeaseExpired     = "expired"
+	LeaseInvalidated = "invalidated"
+)
+
+type CredentialLease struct {
+	ID            string     `json:"id" db:"id"`
+	NodeID        string     `json:"node_id" db:"node_id"`
+	LeasedBy      string     `json:"leased_by" db:"leased_by"`
+	Status        string     `json:"status"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at" db:"expires_at"`
+	InvalidatedAt *time.Time `json:"invalidated_at,omitempty" db:"invalidated_at"`
+}
+
+// GetNode returns a single node with decrypted credentials
+func (s *NodeStorage) GetNode(id string) (*ProxyNode, error) {
+	query := `
+	SELECT ` + nodeColumns + `
+	FROM proxy_nodes
+	WHERE id = ?
+	`
+
+	node, err := scanNode(s.db.QueryRow(query, id))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decryptCredentials(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// CreateLease records that leasedBy was handed the node's credentials until
+// now+ttl
+func (s *NodeStorage) CreateLease(nodeID, leasedBy string, ttl time.Duration) (*CredentialLease, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	lease := &CredentialLease{
+		ID:        id,
+		NodeID:    nodeID,
+		LeasedBy:  leasedBy,
+		Status:    LeaseActive,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	query := `
+	INSERT INTO credential_leases (id, node_id, leased_by, created_at, expires_at)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	_, err = s.db.Exec(query, lease.ID, lease.NodeID, lease.LeasedBy, lease.CreatedAt, lease.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// ListLeases returns leases, newest first, optionally filtered by status
+// and node
+func (s *NodeStorage) ListLeases(status, nodeID string, limit int) ([]CredentialLease, error) {
+	query := `
+	SELECT id, node_id, leased_by, created_at, expires_at, invalidated_at
+	FROM credential_leases
+	WHERE (? = '' OR node_id = ?)
+	`
+	now := time.Now()
+	args := []interface{}{nodeID, nodeID}
+
+	switch status {
+	case LeaseActive:
+		query += ` AND expires_at > ?`
+		args = append(args, now)
+	case LeaseExpired:
+		query += ` AND expires_at <= ? AND (invalidated_at IS NULL OR invalidated_at > ?)`
+		args = append(args, now, now)
+	case LeaseInvalidated:
+		query += ` AND invalidated_at <= ?`
+		args = append(args, now)
+	}
+
+	query += ` ORDER BY created_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leases []CredentialLease
+	for rows.Next() {
+		var lease CredentialLease
+		var invalidated sql.NullTime
+		err := rows.Scan(&lease.ID, &lease.NodeID, &lease.LeasedBy,
+			&lease.CreatedAt, &lease.ExpiresAt, &invalidated)
+		if err != nil {
+			continue
+		}
+
+		if invalidated.Valid {
+			lease.InvalidatedAt = &invalidated.Time
+		}
+		switch {
+		case invalidated.Valid && !invalidated.Time.After(now):
+			lease.Status = LeaseInvalidated
+		case lease.ExpiresAt.After(now):
+			lease.Status = LeaseActive
+		default:
+			lease.Status = LeaseExpired
+		}
+		leases = append(leases, lease)
+	}
+
+	return leases, nil
+}
+
+// invalidateExpiredLeases marks a node's expired leases as invalidated. It is
+// called once the node's credentials have changed.
+func (s *NodeStorage) invalidateExpiredLeases(nodeID string) error {
+	now := time.Now()
+	_, err := s.db.Exec(`
+	UPDATE credential_leases SET invalidated_at = ?
+	WHERE node_id = ? AND expires_at <= ? AND invalidated_at IS NULL
+	`, now, nodeID, now)
+	return err
+}
+
+// credentialsChanged reports whether node carries different credentials
+// from the ones stored for the same ID
+func (s *NodeStorage) credentialsChanged(nodeID string, node *ProxyNode) bool {
+	existing, err := s.GetNode(nodeID)
+	if err != nil {
+		return false
+	}
+	return existing.Username != node.Username || existing.Password != node.Password
+}
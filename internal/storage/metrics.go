@@ -0,0 +1,200 @@
+// internal/storage/metrics.go
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// NodeMetrics is one sample of a node's host and traffic metrics, as sent in
+// a heartbeat. Interface counters are totals since the node booted.
+type NodeMetrics struct {
+	ID                int64               `json:"id,omitempty" db:"id"`
+	NodeID            string              `json:"node_id,omitempty" db:"node_id"`
+	RecordedAt        time.Time           `json:"recorded_at" db:"recorded_at"`
+	CPUPercent        float64             `json:"cpu_percent" db:"cpu_percent"`
+	MemTotalBytes     uint64              `json:"mem_total_bytes" db:"mem_total_bytes"`
+	MemAvailableBytes uint64              `json:"mem_available_bytes" db:"mem_available_bytes"`
+	Load1             float64             `json:"load1" db:"load1"`
+	Load5             float64             `json:"load5" db:"load5"`
+	Load15            float64             `json:"load15" db:"load15"`
+	UptimeSeconds     float64             `json:"uptime_seconds" db:"uptime_seconds"`
+	Interfaces        []InterfaceCounters `json:"interfaces" db:"interfaces"`
+	SOCKSConnections  int                 `json:"socks_connections" db:"socks_connections"`
+
+	// Seq is the sequence number of the heartbeat that carried the sample,
+	// live or spooled; 0 for samples stored by older versions
+	Seq int64 `json:"seq,omitempty" db:"seq"`
+
+	// SelfCheck is the SOCKS self-check status at the time of the sample.
+	// Backfilled samples were spooled by the agent while the controller was
+	// unreachable and delivered later.
+	SelfCheck  string `json:"self_check,omitempty" db:"self_check"`
+	Backfilled bool   `json:"backfilled,omitempty" db:"backfilled"`
+}
+
+// InterfaceCounters are one network interface's byte and packet totals
+type InterfaceCounters struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+// MetricsFilter selects samples for ListMetrics. Zero times are unbounded.
+type MetricsFilter struct {
+	NodeID string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// RecordMetrics stores a sample for the node
+func (s *NodeStorage) RecordMetrics(nodeID string, m *NodeMetrics) error {
+	return insertMetrics(s.db, nodeID, m)
+}
+
+// BackfillSample is a spooled sample with the heartbeat sequence number the
+// agent reserved for it
+type BackfillSample struct {
+	Seq     int64
+	Metrics *NodeMetrics
+}
+
+// BackfillMetrics stores spooled samples that are newer than the last
+// backfilled sequence for the node, so a batch delivered twice is only
+// stored once. A sample whose heartbeat was stored live is skipped too: the
+// agent spools a heartbeat when the response is lost, even if the request
+// got through. Samples must be in sequence order. It returns how many were
+// stored.
+func (s *NodeStorage) BackfillMetrics(nodeID string, samples []BackfillSample) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	err = tx.QueryRow(`SELECT last_backfill_seq FROM heartbeat_sequences WHERE node_id = ?`, nodeID).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	stored := 0
+	for _, sample := range samples {
+		if sample.Seq <= last {
+			continue
+		}
+		var live bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM node_metrics WHERE node_id = ? AND seq = ?)`,
+			nodeID, sample.Seq).Scan(&live)
+		if err != nil {
+			return 0, err
+		}
+		if live {
+			continue
+		}
+		sample.Metrics.Seq = sample.Seq
+		sample.Metrics.Backfilled = true
+		if err := insertMetrics(tx, nodeID, sample.Metrics); err != nil {
+			return 0, err
+		}
+		last = sample.Seq
+		stored++
+	}
+
+	if stored > 0 {
+		_, err = tx.Exec(`UPDATE heartbeat_sequences SET last_backfill_seq = ? WHERE node_id = ?`, last, nodeID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return stored, tx.Commit()
+}
+
+// execer is satisfied by *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertMetrics(db execer, nodeID string, m *NodeMetrics) error {
+	if m.RecordedAt.IsZero() {
+		m.RecordedAt = time.Now()
+	}
+	// Stored in UTC so samples sort and compare by time as text
+	m.RecordedAt = m.RecordedAt.UTC()
+	m.NodeID = nodeID
+
+	interfaces, err := json.Marshal(m.Interfaces)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`
+	INSERT INTO node_metrics (node_id, recorded_at, cpu_percent, mem_total_bytes, mem_available_bytes,
+		load1, load5, load15, uptime_seconds, interfaces, socks_connections, self_check, backfilled, seq)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, m.NodeID, m.RecordedAt, m.CPUPercent, int64(m.MemTotalBytes), int64(m.MemAvailableBytes),
+		m.Load1, m.Load5, m.Load15, m.UptimeSeconds, string(interfaces), m.SOCKSConnections,
+		m.SelfCheck, m.Backfilled, m.Seq)
+	if err != nil {
+		return err
+	}
+	m.ID, err = res.LastInsertId()
+	return err
+}
+
+// ListMetrics returns a node's samples in time order. With a limit, the most
+// recent samples in the range are returned.
+func (s *NodeStorage) ListMetrics(filter MetricsFilter) ([]NodeMetrics, error) {
+	until := filter.Until
+	if until.IsZero() {
+		until = time.Now().Add(time.Hour)
+	}
+
+	rows, err := s.db.Query(`
+	SELECT * FROM (
+		SELECT id, node_id, recorded_at, cpu_percent, mem_total_bytes, mem_available_bytes,
+		       load1, load5, load15, uptime_seconds, interfaces, socks_connections,
+		       self_check, backfilled, seq
+		FROM node_metrics
+		WHERE node_id = ? AND recorded_at >= ? AND recorded_at <= ?
+		ORDER BY recorded_at DESC, id DESC LIMIT ?
+	) ORDER BY recorded_at ASC, id ASC
+	`, filter.NodeID, filter.Since.UTC(), until.UTC(), filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []NodeMetrics
+	for rows.Next() {
+		var m NodeMetrics
+		var memTotal, memAvailable int64
+		var interfaces string
+		err := rows.Scan(&m.ID, &m.NodeID, &m.RecordedAt, &m.CPUPercent, &memTotal, &memAvailable,
+			&m.Load1, &m.Load5, &m.Load15, &m.UptimeSeconds, &interfaces, &m.SOCKSConnections,
+			&m.SelfCheck, &m.Backfilled, &m.Seq)
+		if err != nil {
+			return nil, err
+		}
+		m.MemTotalBytes, m.MemAvailableBytes = uint64(memTotal), uint64(memAvailable)
+		if err := json.Unmarshal([]byte(interfaces), &m.Interfaces); err != nil {
+			return nil, err
+		}
+		samples = append(samples, m)
+	}
+
+	return samples, rows.Err()
+}
+
+// PruneMetrics deletes samples older than the retention period
+func (s *NodeStorage) PruneMetrics(retention time.Duration) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM node_metrics WHERE recorded_at < ?`, time.Now().Add(-retention).UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
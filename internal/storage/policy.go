@@ -0,0 +1,51 @@
+// internal/storage/policy.go
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/Skillz147/TrinityProxy/internal/policy"
+)
+
+const fleetPolicyID = "fleet"
+
+// GetFleetPolicy returns the access policy pushed to every agent, or nil if
+// none has been set and agents keep the policy they were installed with
+func (s *NodeStorage) GetFleetPolicy() (*policy.Policy, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT policy FROM access_policies WHERE id = ?`, fleetPolicyID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p policy.Policy
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		return nil, err
+	}
+	p.Version = p.ComputeVersion()
+	return &p, nil
+}
+
+// SetFleetPolicy validates and stores the access policy for every agent
+func (s *NodeStorage) SetFleetPolicy(p *policy.Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	p.Version = p.ComputeVersion()
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`
+	INSERT OR REPLACE INTO access_policies (id, policy, version, updated_at)
+	VALUES (?, ?, ?, ?)
+	`, fleetPolicyID, string(data), p.Version, time.Now())
+	return err
+}
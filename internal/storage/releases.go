@@ -0,0 +1,121 @@
+// internal/storage/releases.go
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrReleaseNotFound = errors.New("release not found")
+	ErrReleaseExists   = errors.New("release version already exists")
+)
+
+// AgentRelease is an uploaded agent binary. Signature is the release key's
+// Ed25519 signature over the version and SHA256, checked by agents before
+// they install it.
+type AgentRelease struct {
+	Version    string    `json:"version" db:"version"`
+	SHA256     string    `json:"sha256" db:"sha256"`
+	Signature  string    `json:"signature" db:"signature"`
+	Size       int64     `json:"size" db:"size"`
+	UploadedBy string    `json:"uploaded_by" db:"uploaded_by"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// CreateRelease records a release. The binary itself is kept by the caller,
+// outside the database. Versions are immutable, so an existing version is
+// never replaced.
+func (s *NodeStorage) CreateRelease(rel *AgentRelease) error {
+	var exists int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM agent_releases WHERE version = ?`, rel.Version).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return ErrReleaseExists
+	}
+
+	_, err = s.db.Exec(`
+	INSERT INTO agent_releases (version, sha256, signature, size, binary, uploaded_by, created_at)
+	VALUES (?, ?, ?, ?, x'', ?, ?)
+	`, rel.Version, rel.SHA256, rel.Signature, rel.Size, rel.UploadedBy, rel.CreatedAt)
+	return err
+}
+
+// GetRelease returns a release without its binary
+func (s *NodeStorage) GetRelease(version string) (*AgentRelease, error) {
+	var rel AgentRelease
+	err := s.db.QueryRow(`
+	SELECT version, sha256, signature, size, uploaded_by, created_at
+	FROM agent_releases WHERE version = ?
+	`, version).Scan(&rel.Version, &rel.SHA256, &rel.Signature, &rel.Size, &rel.UploadedBy, &rel.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrReleaseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
+
+// ListReleases returns every release, newest first, without binaries
+func (s *NodeStorage) ListReleases() ([]AgentRelease, error) {
+	rows, err := s.db.Query(`
+	SELECT version, sha256, signature, size, uploaded_by, created_at
+	FROM agent_releases ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var releases []AgentRelease
+	for rows.Next() {
+		var rel AgentRelease
+		if err := rows.Scan(&rel.Version, &rel.SHA256, &rel.Signature, &rel.Size, &rel.UploadedBy, &rel.CreatedAt); err != nil {
+			return nil, err
+		}
+		releases = append(releases, rel)
+	}
+	return releases, rows.Err()
+}
+
+// MoveReleaseBinaries hands each binary still stored in the database to
+// write, one at a time, and clears it once written. Releases uploaded before
+// binaries were kept on disk are moved this way.
+func (s *NodeStorage) MoveReleaseBinaries(write func(version string, binary []byte) error) (int, error) {
+	rows, err := s.db.Query(`SELECT version FROM agent_releases WHERE length(binary) > 0`)
+	if err != nil {
+		return 0, err
+	}
+	var versions []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		versions = append(versions, version)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, version := range versions {
+		var binary []byte
+		if err := s.db.QueryRow(`SELECT binary FROM agent_releases WHERE version = ?`, version).Scan(&binary); err != nil {
+			return i, err
+		}
+		if err := write(version, binary); err != nil {
+			return i, fmt.Errorf("release %s: %w", version, err)
+		}
+		if _, err := s.db.Exec(`UPDATE agent_releases SET binary = x'' WHERE version = ?`, version); err != nil {
+			return i, err
+		}
+	}
+	return len(versions), nil
+}
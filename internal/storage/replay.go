@@ -0,0 +1,115 @@
+// internal/storage/replay.go
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Reasons a heartbeat was rejected as a possible replay
+const (
+	ReplayStaleSequence = "stale-sequence"
+	ReplayClockSkew     = "clock-skew"
+)
+
+var ErrStaleSequence = errors.New("heartbeat sequence is not newer than the last one accepted")
+
+// HeartbeatReplay is a rejected heartbeat that reused an old sequence number
+// or carried a timestamp outside the allowed clock skew
+type HeartbeatReplay struct {
+	ID         int64     `json:"id" db:"id"`
+	NodeID     string    `json:"node_id" db:"node_id"`
+	Seq        int64     `json:"seq" db:"seq"`
+	LastSeq    int64     `json:"last_seq" db:"last_seq"`
+	SentAt     time.Time `json:"sent_at" db:"sent_at"`
+	Reason     string    `json:"reason" db:"reason"`
+	RemoteIP   string    `json:"remote_ip" db:"remote_ip"`
+	DetectedAt time.Time `json:"detected_at" db:"detected_at"`
+}
+
+// AdvanceHeartbeatSequence accepts seq for the node only if it is greater
+// than every sequence accepted before. The check and the update are a single
+// statement, so two copies of the same heartbeat cannot both be accepted.
+// On ErrStaleSequence the last accepted sequence is returned.
+func (s *NodeStorage) AdvanceHeartbeatSequence(nodeID string, seq int64, sentAt time.Time) (int64, error) {
+	res, err := s.db.Exec(`
+	INSERT INTO heartbeat_sequences (node_id, last_seq, last_sent_at, updated_at)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(node_id) DO UPDATE SET
+		last_seq = excluded.last_seq,
+		last_sent_at = excluded.last_sent_at,
+		updated_at = excluded.updated_at
+	WHERE excluded.last_seq > heartbeat_sequences.last_seq
+	`, nodeID, seq, sentAt, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return seq, err
+	}
+
+	last, err := s.LastHeartbeatSequence(nodeID)
+	if err != nil {
+		return 0, err
+	}
+	return last, ErrStaleSequence
+}
+
+// LastHeartbeatSequence returns the highest sequence accepted from the node,
+// or 0 if none has been
+func (s *NodeStorage) LastHeartbeatSequence(nodeID string) (int64, error) {
+	var last int64
+	err := s.db.QueryRow(`SELECT last_seq FROM heartbeat_sequences WHERE node_id = ?`, nodeID).Scan(&last)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return last, err
+}
+
+// RecordReplay stores a rejected heartbeat
+func (s *NodeStorage) RecordReplay(replay *HeartbeatReplay) error {
+	if replay.DetectedAt.IsZero() {
+		replay.DetectedAt = time.Now()
+	}
+
+	res, err := s.db.Exec(`
+	INSERT INTO heartbeat_replays (node_id, seq, last_seq, sent_at, reason, remote_ip, detected_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, replay.NodeID, replay.Seq, replay.LastSeq, replay.SentAt, replay.Reason,
+		replay.RemoteIP, replay.DetectedAt)
+	if err != nil {
+		return err
+	}
+	replay.ID, err = res.LastInsertId()
+	return err
+}
+
+// ListReplays returns rejected heartbeats, newest first, optionally for one
+// node
+func (s *NodeStorage) ListReplays(nodeID string, limit int) ([]HeartbeatReplay, error) {
+	rows, err := s.db.Query(`
+	SELECT id, node_id, seq, last_seq, sent_at, reason, remote_ip, detected_at
+	FROM heartbeat_replays
+	WHERE (? = '' OR node_id = ?)
+	ORDER BY id DESC LIMIT ?
+	`, nodeID, nodeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replays []HeartbeatReplay
+	for rows.Next() {
+		var replay HeartbeatReplay
+		err := rows.Scan(&replay.ID, &replay.NodeID, &replay.Seq, &replay.LastSeq,
+			&replay.SentAt, &replay.Reason, &replay.RemoteIP, &replay.DetectedAt)
+		if err != nil {
+			return nil, err
+		}
+		replays = append(replays, replay)
+	}
+
+	return replays, rows.Err()
+}
@@ -0,0 +1,269 @@
+// internal/storage/rotations.go
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Rotation states. A rotation is pending until it is handed to the agent in
+// a heartbeat response, then sent until the agent confirms or reports a
+// failure.
+const (
+	RotationPending   = "pending"
+	RotationSent      = "sent"
+	RotationConfirmed = "confirmed"
+	RotationFailed    = "failed"
+)
+
+var (
+	ErrRotationInProgress = errors.New("node already has a rotation in progress")
+	ErrRotationNotFound   = errors.New("rotation not found or already completed")
+)
+
+// CredentialRotation asks a node to replace its SOCKS credentials. The old
+// credentials stay valid on the node for Overlap after it confirms.
+type CredentialRotation struct {
+	ID             string     `json:"id" db:"id"`
+	NodeID         string     `json:"node_id" db:"node_id"`
+	Status         string     `json:"status" db:"status"`
+	OverlapSeconds int64      `json:"overlap_seconds" db:"overlap_seconds"`
+	RequestedBy    string     `json:"requested_by" db:"requested_by"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	NotBefore      time.Time  `json:"not_before" db:"not_before"`
+	SentAt         *time.Time `json:"sent_at,omitempty" db:"sent_at"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+	Error          string     `json:"error,omitempty" db:"error"`
+}
+
+const rotationColumns = `id, node_id, status, overlap_seconds, requested_by, created_at,
+	       not_before, sent_at, completed_at, error`
+
+func scanRotation(row rowScanner) (*CredentialRotation, error) {
+	var rot CredentialRotation
+	var sent, completed sql.NullTime
+	err := row.Scan(&rot.ID, &rot.NodeID, &rot.Status, &rot.OverlapSeconds, &rot.RequestedBy,
+		&rot.CreatedAt, &rot.NotBefore, &sent, &completed, &rot.Error)
+	if err != nil {
+		return nil, err
+	}
+	if sent.Valid {
+		rot.SentAt = &sent.Time
+	}
+	if completed.Valid {
+		rot.CompletedAt = &completed.Time
+	}
+	return &rot, nil
+}
+
+// ScheduleRotation queues a rotation for one node, to be handed out on its
+// first heartbeat after notBefore. The idx_rotations_open index allows one
+// open rotation per node, so concurrent requests cannot both create one.
+func (s *NodeStorage) ScheduleRotation(nodeID, requestedBy string, overlap time.Duration, notBefore time.Time) (*CredentialRotation, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	rot := &CredentialRotation{
+		ID:             id,
+		NodeID:         nodeID,
+		Status:         RotationPending,
+		OverlapSeconds: int64(overlap / time.Second),
+		RequestedBy:    requestedBy,
+		CreatedAt:      time.Now(),
+		NotBefore:      notBefore,
+	}
+
+	_, err = s.db.Exec(`
+	INSERT INTO credential_rotations (id, node_id, status, overlap_seconds, requested_by, created_at, not_before)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, rot.ID, rot.NodeID, rot.Status, rot.OverlapSeconds, rot.RequestedBy, rot.CreatedAt, rot.NotBefore)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return nil, ErrRotationInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rot, nil
+}
+
+// ScheduleFleetRotation queues a rotation for every enrolled node that has
+// reported in and has no rotation in progress. It returns the rotations
+// created and the number of nodes skipped.
+func (s *NodeStorage) ScheduleFleetRotation(requestedBy string, overlap time.Duration, notBefore time.Time) ([]CredentialRotation, int, error) {
+	rows, err := s.db.Query(`
+	SELECT p.id FROM proxy_nodes p
+	JOIN node_keys k ON k.node_id = p.id
+	WHERE k.revoked_at IS NULL
+	`)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var nodeIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			nodeIDs = append(nodeIDs, id)
+		}
+	}
+	rows.Close()
+
+	var rotations []CredentialRotation
+	skipped := 0
+	for _, nodeID := range nodeIDs {
+		rot, err := s.ScheduleRotation(nodeID, requestedBy, overlap, notBefore)
+		if err == ErrRotationInProgress {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return rotations, skipped, err
+		}
+		rotations = append(rotations, *rot)
+	}
+	return rotations, skipped, nil
+}
+
+// DueRotation returns the node's open rotation once it is due, marking it
+// sent. A sent rotation is returned again until the agent confirms it, so a
+// lost response does not stall the rotation.
+func (s *NodeStorage) DueRotation(nodeID string) (*CredentialRotation, error) {
+	now := time.Now()
+	rot, err := scanRotation(s.db.QueryRow(`
+	SELECT `+rotationColumns+`
+	FROM credential_rotations
+	WHERE node_id = ? AND status IN (?, ?) AND not_before <= ?
+	ORDER BY created_at LIMIT 1
+	`, nodeID, RotationPending, RotationSent, now))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rot.Status == RotationPending {
+		_, err = s.db.Exec(`UPDATE credential_rotations SET status = ?, sent_at = ? WHERE id = ?`,
+			RotationSent, now, rot.ID)
+		if err != nil {
+			return nil, err
+		}
+		rot.Status = RotationSent
+		rot.SentAt = &now
+	}
+	return rot, nil
+}
+
+// ConfirmRotation stores the credentials the agent switched to and closes the
+// rotation. This is the only point where a rotation changes proxy_nodes.
+// Confirming an already confirmed rotation again is a no-op.
+func (s *NodeStorage) ConfirmRotation(id, nodeID, username, password string) error {
+	encUsername, err := s.cipher.Encrypt(username)
+	if err != nil {
+		return err
+	}
+	encPassword, err := s.cipher.Encrypt(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var overlapSeconds int64
+	err = tx.QueryRow(`SELECT status, overlap_seconds FROM credential_rotations WHERE id = ? AND node_id = ?`,
+		id, nodeID).Scan(&status, &overlapSeconds)
+	if err == sql.ErrNoRows {
+		return ErrRotationNotFound
+	}
+	if err != nil {
+		return err
+	}
+	switch status {
+	case RotationConfirmed:
+		return nil
+	case RotationSent:
+	default:
+		return ErrRotationNotFound
+	}
+
+	// Exits on the same host share its SOCKS service and credentials
+	now := time.Now()
+	_, err = tx.Exec(`UPDATE proxy_nodes SET username = ?, password = ?, updated_at = ? WHERE id = ? OR host_id = ?`,
+		encUsername, encPassword, now, nodeID, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE credential_rotations SET status = ?, completed_at = ? WHERE id = ?`,
+		RotationConfirmed, now, id)
+	if err != nil {
+		return err
+	}
+	// Credentials handed out by expired leases stop working once the agent
+	// deletes the old login at the end of the overlap
+	overlapEnd := now.Add(time.Duration(overlapSeconds) * time.Second)
+	_, err = tx.Exec(`
+	UPDATE credential_leases SET invalidated_at = ?
+	WHERE node_id IN (SELECT id FROM proxy_nodes WHERE id = ? OR host_id = ?)
+	AND expires_at <= ? AND invalidated_at IS NULL
+	`, overlapEnd, nodeID, nodeID, now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FailRotation closes a sent rotation the agent could not carry out
+func (s *NodeStorage) FailRotation(id, nodeID, reason string) error {
+	res, err := s.db.Exec(`
+	UPDATE credential_rotations SET status = ?, completed_at = ?, error = ?
+	WHERE id = ? AND node_id = ? AND status = ?
+	`, RotationFailed, time.Now(), reason, id, nodeID, RotationSent)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRotationNotFound
+	}
+	return nil
+}
+
+// ListRotations returns rotation history, newest first, optionally filtered
+// by node and status
+func (s *NodeStorage) ListRotations(nodeID, status string, limit int) ([]CredentialRotation, error) {
+	rows, err := s.db.Query(`
+	SELECT `+rotationColumns+`
+	FROM credential_rotations
+	WHERE (? = '' OR node_id = ?) AND (? = '' OR status = ?)
+	ORDER BY created_at DESC LIMIT ?
+	`, nodeID, nodeID, status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rotations []CredentialRotation
+	for rows.Next() {
+		rot, err := scanRotation(rows)
+		if err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, *rot)
+	}
+	return rotations, rows.Err()
+}
@@ -2,15 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Skillz147/TrinityProxy/internal/agent"
 )
 
+// Version is stamped in at build time (see the Makefile)
+var Version = "dev"
+
 func runCommand(name string, args ...string) {
 	cmd := exec.Command(name, args...)
 	cmd.Stdout = os.Stdout
@@ -141,23 +149,128 @@ func fileExists(filename string) bool {
 	return !os.IsNotExist(err)
 }
 
+// runInstaller runs the installer built alongside this binary, falling back
+// to building it from source in a checkout
 func runInstaller() {
 	log.Println("[*] Running TrinityProxy installer...")
-	runCommand("go", "run", "./cmd/installer/installer.go")
+	if exe, err := os.Executable(); err == nil {
+		installer := filepath.Join(filepath.Dir(exe), "installer")
+		if _, err := os.Stat(installer); err == nil {
+			runCommand(installer)
+			return
+		}
+	}
+	runCommand("go", "run", "./cmd/installer")
+}
+
+// loadAgentConfig validates and applies the agent configuration from the
+// config file, environment and args, exiting with the problem if it is invalid
+func loadAgentConfig(args []string) {
+	cfg, err := agent.LoadConfig(args)
+	if err != nil {
+		log.Fatalf("[-] %v", err)
+	}
+	agent.Configure(cfg)
 }
 
+// shutdownGrace is how long a stopping agent waits for a heartbeat in flight
+// before deregistering anyway
+const shutdownGrace = 2 * time.Second
+
+// deregisterTimeout bounds the deregistration call, within the service's
+// stop timeout
+const deregisterTimeout = 10 * time.Second
+
+// runHeartbeatAgent sends heartbeats until SIGINT or SIGTERM, then
+// deregisters the node so the controller stops handing it out. A second
+// signal exits immediately. With the native backend it also serves SOCKS,
+// until after deregistering.
 func runHeartbeatAgent() {
+	if err := agent.StartProxy(); err != nil {
+		log.Fatalf("[-] Failed to start SOCKS5 server: %v", err)
+	}
+	defer agent.StopProxy()
+
 	log.Println("[*] Starting heartbeat agent...")
-	go agent.StartHeartbeatLoop()
-	select {} // block forever
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		agent.StartHeartbeatLoop(ctx)
+		close(done)
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("[*] Shutting down, deregistering from controller...")
+
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+		log.Println("[!] Heartbeat still in progress, deregistering anyway")
+	}
+
+	deregisterCtx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+	if err := agent.Deregister(deregisterCtx, "shutdown"); err != nil {
+		log.Printf("[-] Failed to deregister: %v", err)
+		return
+	}
+	log.Println("[+] Deregistered, node removed from selection")
 }
 
 func runAPIController() {
 	log.Println("[*] Starting API server...")
-	runCommand("go", "run", "./cmd/api/enhanced_main.go")
+	runCommand("go", "run", "./cmd/api")
+}
+
+func runJoin(args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		log.Fatalf("[-] Usage: trinityproxy join <controller-url> <token> [ca-fingerprint]")
+	}
+
+	caFingerprint := ""
+	if len(args) == 3 {
+		caFingerprint = args[2]
+	}
+
+	loadAgentConfig(nil)
+
+	log.Printf("[*] Enrolling with controller %s...", args[0])
+	id, err := agent.Enroll(args[0], args[1], caFingerprint)
+	if err != nil {
+		log.Fatalf("[-] Enrollment failed: %v", err)
+	}
+	log.Printf("[+] Enrolled as node %s", id.NodeID)
+	if id.Certificate != "" {
+		log.Println("[+] Received client certificate, heartbeats will use mutual TLS")
+	}
 }
 
 func main() {
+	agent.Version = Version
+
+	if len(os.Args) > 1 && os.Args[1] == "join" {
+		runJoin(os.Args[2:])
+		return
+	}
+
+	// Non-interactive agent for service managers: heartbeats only, the
+	// SOCKS service is expected to be installed already
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		loadAgentConfig(os.Args[2:])
+		runHeartbeatAgent()
+		return
+	}
+
+	// Run by systemd after an update: rolls back a release that never
+	// confirmed itself
+	if len(os.Args) > 1 && os.Args[1] == "update-check" {
+		loadAgentConfig(os.Args[2:])
+		agent.CheckUpdate()
+		return
+	}
+
 	role := strings.ToLower(os.Getenv("TRINITY_ROLE"))
 
 	// Always show current status and allow override
@@ -205,6 +318,7 @@ func main() {
 	case "agent":
 		fmt.Println("\n[*] Starting in Agent mode...")
 		fmt.Println("[*] This will install SOCKS5 proxy and start heartbeat reporting")
+		loadAgentConfig(nil)
 		runInstaller()
 		runHeartbeatAgent()
 	default:
@@ -31,6 +31,12 @@ if [[ ! -f "$PROJECT_ROOT/build/trinityproxy" ]]; then
     exit 1
 fi
 
+# The service only sends heartbeats, so install the SOCKS service first
+if [[ ! -f /etc/trinityproxy-port ]]; then
+    echo "[*] Installing SOCKS5 proxy..."
+    "$PROJECT_ROOT/build/installer"
+fi
+
 # Stop existing service if running
 if systemctl is-active --quiet "$SERVICE_NAME" 2>/dev/null; then
     echo "[*] Stopping existing $SERVICE_NAME service..."
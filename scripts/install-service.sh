@@ -22,7 +22,7 @@ cp scripts/trinityproxy-controller.service /etc/systemd/system/
 # Update the service file with the correct path
 CURRENT_DIR=$(pwd)
 sed -i "s|WorkingDirectory=/root/TrinityProxy|WorkingDirectory=$CURRENT_DIR|g" /etc/systemd/system/trinityproxy-controller.service
-sed -i "s|ExecStart=/usr/local/go/bin/go run ./cmd/api/enhanced_main.go|ExecStart=$CURRENT_DIR/build/trinityproxy-api|g" /etc/systemd/system/trinityproxy-controller.service
+sed -i "s|ExecStart=/usr/local/go/bin/go run ./cmd/api|ExecStart=$CURRENT_DIR/build/trinityproxy-api|g" /etc/systemd/system/trinityproxy-controller.service
 
 # Reload systemd and enable the service
 echo "[*] Enabling TrinityProxy Controller service..."